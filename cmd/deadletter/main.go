@@ -0,0 +1,120 @@
+// Command deadletter lists entries that won't be delivered anymore and requeues them.
+//
+// Usage:
+//
+//	deadletter list              lists the dead entries
+//	deadletter history <id>      shows the delivery attempts of the entry
+//	deadletter requeue <id>...   schedules the entries for immediate delivery
+//	deadletter requeue -all      schedules all dead entries for immediate delivery
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/store"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: deadletter list | history <id> | requeue [-all] [<id>...]")
+	os.Exit(2)
+}
+
+func list(ctx context.Context, db store.Store) error {
+	entries, err := db.DeadEntries(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tMAIL\tSCHEDULED FOR\tFAILS\tLAST ERROR")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", e.ID, e.Status, e.Mail, e.ScheduledFor.Format(time.RFC3339), e.Fails, e.LastError)
+	}
+	return w.Flush()
+}
+
+func history(ctx context.Context, db store.Store, id string) error {
+	attempts, err := db.Attempts(ctx, id)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tHOST\tTLS\tDURATION\tOUTCOME\tERROR")
+	for _, a := range attempts {
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\n", a.CreatedAt.Format(time.RFC3339), a.Host, a.TLS, a.Duration, a.Outcome, a.Error)
+	}
+	return w.Flush()
+}
+
+func requeue(ctx context.Context, db store.Store, args []string) error {
+	fs := flag.NewFlagSet("requeue", flag.ExitOnError)
+	all := fs.Bool("all", false, "requeue all dead entries")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ids := fs.Args()
+	if *all {
+		entries, err := db.DeadEntries(ctx)
+		if err != nil {
+			return err
+		}
+		for i := range entries {
+			ids = append(ids, entries[i].ID)
+		}
+	}
+	if len(ids) == 0 {
+		usage()
+	}
+	now := time.Now()
+	for _, id := range ids {
+		err := db.Requeue(ctx, id, now)
+		if errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("dead entry %s not found", id)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("requeued", id)
+	}
+	return nil
+}
+
+func main() {
+	var storageCfg cfg.StorageConfig
+	if err := cfg.LoadConfigs(&storageCfg); err != nil {
+		panic(err)
+	}
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	ctx := context.Background()
+	db, err := store.Open(&storageCfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "open storage:", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	switch cmd, args := os.Args[1], os.Args[2:]; {
+	case cmd == "list":
+		err = list(ctx, db)
+	case cmd == "history" && len(args) == 1:
+		err = history(ctx, db, args[0])
+	case cmd == "requeue":
+		err = requeue(ctx, db, args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		db.Close()
+		os.Exit(1)
+	}
+}
@@ -1,7 +1,20 @@
+// Command migrate applies the versioned migrations of the storage schema.
+//
+// Usage:
+//
+//	migrate up        applies all the migrations that weren't applied yet
+//	migrate down      reverts the last applied migration
+//	migrate status    lists the migrations and whether they were applied
+//	migrate to <N>    migrates the schema up or down to version N, 0 reverts all the migrations
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -9,11 +22,47 @@ import (
 	"github.com/matoous/mailback/internal/store"
 )
 
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: migrate up | down | status | to <N>")
+	os.Exit(2)
+}
+
+func status(ctx context.Context, db store.Store) error {
+	states, err := db.Migrations(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, m := range states {
+		applied := "-"
+		if m.AppliedAt != nil {
+			applied = m.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+	}
+	return w.Flush()
+}
+
+func down(ctx context.Context, db store.Store) error {
+	version, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return nil
+	}
+	return db.MigrateTo(ctx, version-1)
+}
+
 func main() {
 	var storageCfg cfg.StorageConfig
 	if err := cfg.LoadConfigs(&storageCfg); err != nil {
 		panic(err)
 	}
+	if len(os.Args) < 2 {
+		usage()
+	}
 
 	log, err := zap.NewDevelopment()
 	if err != nil {
@@ -26,7 +75,8 @@ func main() {
 		}
 	}()
 
-	db, err := store.NewSQLiteStore(storageCfg.Database)
+	ctx := context.Background()
+	db, err := store.Open(&storageCfg)
 	if err != nil {
 		log.Error("storage.init", zap.Error(err))
 		os.Exit(1)
@@ -37,8 +87,32 @@ func main() {
 			log.Error("storage.close", zap.Error(err))
 		}
 	}()
-	if err := db.Migrate(); err != nil {
+
+	switch cmd, args := os.Args[1], os.Args[2:]; {
+	case cmd == "up" && len(args) == 0:
+		err = db.Migrate(ctx)
+	case cmd == "down" && len(args) == 0:
+		err = down(ctx, db)
+	case cmd == "status" && len(args) == 0:
+		err = status(ctx, db)
+	case cmd == "to" && len(args) == 1:
+		version, convErr := strconv.Atoi(args[0])
+		if convErr != nil {
+			usage()
+		}
+		err = db.MigrateTo(ctx, version)
+	default:
+		usage()
+	}
+	if err != nil {
 		log.Error("storage.migrate", zap.Error(err))
+		db.Close()
 		os.Exit(1)
 	}
+	version, err := db.SchemaVersion(ctx)
+	if err != nil {
+		log.Error("storage.version", zap.Error(err))
+		return
+	}
+	log.Info("storage.migrate", zap.Int("version", version))
 }
@@ -6,6 +6,7 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"go.uber.org/zap"
 
+	"github.com/matoous/mailback/internal/blob"
 	"github.com/matoous/mailback/internal/cfg"
 	"github.com/matoous/mailback/internal/receiver"
 	"github.com/matoous/mailback/internal/store"
@@ -27,7 +28,7 @@ func main() {
 		panic("failed to init logger")
 	}
 
-	db, err := store.NewSQLiteStore(storageCfg.Database)
+	db, err := store.Open(&storageCfg)
 	if err != nil {
 		log.Error("store.init", zap.Error(err))
 		exitCode++
@@ -40,7 +41,14 @@ func main() {
 		}
 	}()
 
-	srv, err := receiver.New(db, log, recCfg)
+	blobs, err := blob.NewFSStore(storageCfg.BlobDir)
+	if err != nil {
+		log.Error("blob.init", zap.Error(err))
+		exitCode++
+		return
+	}
+
+	srv, err := receiver.New(db, blobs, log, recCfg)
 	if err != nil {
 		log.Error("receiver.init", zap.Error(err))
 		exitCode++
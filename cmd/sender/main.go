@@ -5,6 +5,7 @@ import (
 
 	"go.uber.org/zap"
 
+	"github.com/matoous/mailback/internal/blob"
 	"github.com/matoous/mailback/internal/cfg"
 	"github.com/matoous/mailback/internal/sender"
 	"github.com/matoous/mailback/internal/store"
@@ -17,7 +18,7 @@ func main() {
 		panic(err)
 	}
 
-	db, err := store.NewSQLiteStore("test.db")
+	db, err := store.Open(&storageCfg)
 	if err != nil {
 		panic("failed to connect database")
 	}
@@ -28,6 +29,11 @@ func main() {
 		panic("failed to init logger")
 	}
 
-	be := sender.New(db, log, &sCfg)
+	blobs, err := blob.NewFSStore(storageCfg.BlobDir)
+	if err != nil {
+		panic("failed to open blob storage")
+	}
+
+	be := sender.New(db, blobs, log, &sCfg)
 	be.Run(context.TODO())
 }
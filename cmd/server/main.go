@@ -6,6 +6,7 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"go.uber.org/zap"
 
+	"github.com/matoous/mailback/internal/blob"
 	"github.com/matoous/mailback/internal/cfg"
 	"github.com/matoous/mailback/internal/server"
 	"github.com/matoous/mailback/internal/store"
@@ -23,7 +24,7 @@ func main() {
 		panic("failed to init logger")
 	}
 
-	db, err := store.NewSQLiteStore(storageCfg.Database)
+	db, err := store.Open(&storageCfg)
 	if err != nil {
 		log.Error("storage.init", zap.Error(err))
 		os.Exit(1)
@@ -35,7 +36,13 @@ func main() {
 		}
 	}()
 
-	s, err := server.New(db, log, webConfig)
+	blobs, err := blob.NewFSStore(storageCfg.BlobDir)
+	if err != nil {
+		log.Error("blob.init", zap.Error(err))
+		os.Exit(1)
+	}
+
+	s, err := server.New(db, blobs, log, webConfig)
 	if err != nil {
 		log.Error("server.init", zap.Error(err))
 		os.Exit(1)
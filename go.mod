@@ -8,16 +8,19 @@ require (
 	github.com/DusanKasan/parsemail v0.0.0-20200228075709-6e5c9f904641
 	github.com/caarlos0/env/v6 v6.2.1
 	github.com/caddyserver/certmagic v0.10.4
-	github.com/emersion/go-msgauth v0.4.0
+	github.com/emersion/go-msgauth v0.5.0
+	github.com/emersion/go-sasl v0.0.0-20190817083125-240c8404624e
 	github.com/emersion/go-smtp v0.12.1
 	github.com/go-acme/lego/v3 v3.4.0
 	github.com/gofiber/fiber v1.8.33
 	github.com/jinzhu/gorm v1.9.12
 	github.com/jpillora/backoff v1.0.0
 	github.com/matoous/go-nanoid v1.2.0
+	github.com/mattn/go-sqlite3 v2.0.1+incompatible
 	github.com/pkg/errors v0.9.1
 	github.com/rickb777/date v1.12.4
 	github.com/stretchr/testify v1.5.1
 	go.uber.org/zap v1.14.1
+	golang.org/x/net v0.0.0-20191027093000-83d349e8ac1a
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 )
@@ -0,0 +1,93 @@
+// Package blob provides storage for binary objects, such as email attachments, that don't belong into
+// the database.
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned when there is no blob stored under the requested key.
+var ErrNotFound = errors.New("blob not found")
+
+// Store stores binary objects under unique keys.
+type Store interface {
+	// Put stores content read from r under the key, replacing any previous content.
+	Put(key string, r io.Reader) error
+	// Get opens the content stored under the key. The caller is responsible for closing it.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the content stored under the key.
+	Delete(key string) error
+}
+
+// FSStore is Store that keeps each blob in separate file in given directory.
+type FSStore struct {
+	dir string
+}
+
+// NewFSStore creates new filesystem store using given directory, creating it if necessary.
+func NewFSStore(dir string) (*FSStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("create blob directory: %w", err)
+	}
+	return &FSStore{dir: dir}, nil
+}
+
+func (s *FSStore) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid blob key: %q", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+// Put stores the content into a temporary file first and then moves it in place so that readers never
+// see partially written blobs.
+func (s *FSStore) Put(key string, r io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, ".tmp-"+key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *FSStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s *FSStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -26,14 +26,92 @@ func LoadConfigs(configStructs ...interface{}) error {
 type WebServerConfig struct {
 	Host string `env:"HOST" envDefault:"localhost"`
 	Port string `env:"SERVER_PORT" envDefault:":8080"`
+	// AdminToken is the bearer token that authorizes requests to the operator API, the API is disabled
+	// if it is empty.
+	AdminToken string `env:"SERVER_ADMIN_TOKEN"`
+	// RequestTimeout limits the time the requests spend in the storage.
+	RequestTimeout time.Duration `env:"SERVER_REQUEST_TIMEOUT" envDefault:"10s"`
 }
 
+// Policies applied to received emails that fail authentication checks.
+const (
+	// PolicyIgnore accepts the email as if the check passed.
+	PolicyIgnore = "ignore"
+	// PolicyTag accepts the email but marks the scheduled entry as unverified.
+	PolicyTag = "tag"
+	// PolicyReject refuses the email.
+	PolicyReject = "reject"
+)
+
 // ReceiverConfig ...
 type ReceiverConfig struct {
 	Host string `env:"HOST" envDefault:"localhost"`
 	Port string `env:"RECEIVER_PORT" envDefault:":25"`
+	// DKIMPolicy is applied to emails without passing DKIM signature.
+	DKIMPolicy string `env:"RECEIVER_DKIM_POLICY" envDefault:"tag"`
+	// AlignmentPolicy is applied to emails whose envelope sender, to which the email is sent back, isn't aligned
+	// with the From header.
+	AlignmentPolicy string `env:"RECEIVER_ALIGNMENT_POLICY" envDefault:"tag"`
+	// TimeZone is the default IANA time zone in which the times in the recipient addresses are interpreted. Users
+	// can give their own with "Time-Zone: Europe/Prague" line at the beginning of the email, otherwise the offset
+	// of the Date header of the email is used if it differs from this time zone.
+	TimeZone string `env:"RECEIVER_TIME_ZONE" envDefault:"UTC"`
+	// Transports choose the transport delivering the entries of the senders from given domains, such as
+	// example.com=relay. Entries of the other senders, and entries whose transport the sender doesn't have
+	// configured, are delivered by the default transport of the sender.
+	Transports []string `env:"RECEIVER_TRANSPORTS"`
+	Notify     NotifyConfig
+}
+
+// NotifyConfig configures the notifications that wake up the sender when new entries are received.
+type NotifyConfig struct {
+	// Addr is the UDP address the sender listens on and the receiver sends the notifications to, the notifications
+	// are disabled if it is empty. It must be reachable only by the receiver, such as the loopback address when
+	// both run on the same host.
+	Addr string `env:"NOTIFY_ADDR" envDefault:"127.0.0.1:2526"`
 }
 
+// TLS policies of connections to the MX hosts.
+const (
+	// TLSOpportunistic encrypts the connection if the host supports it, the certificate isn't verified.
+	TLSOpportunistic = "opportunistic"
+	// TLSRequire refuses to deliver emails over unencrypted connection, the certificate isn't verified.
+	TLSRequire = "require"
+	// TLSVerify refuses to deliver emails over unencrypted connection or to hosts with invalid certificate.
+	TLSVerify = "verify"
+)
+
+// Transports used to deliver the emails.
+const (
+	// TransportMX delivers the emails directly to the MX hosts of the receivers.
+	TransportMX = "mx"
+	// TransportRelay delivers all emails through the configured relay host.
+	TransportRelay = "relay"
+	// TransportMaildir delivers all emails into local Maildir.
+	TransportMaildir = "maildir"
+	// TransportMbox appends all emails to local mbox file.
+	TransportMbox = "mbox"
+	// TransportWebhook posts the entries as JSON to configured URL.
+	TransportWebhook = "webhook"
+)
+
+// Security of connections to the relay host.
+const (
+	// RelayTLS connects to the relay using implicit TLS (usually on port 465).
+	RelayTLS = "tls"
+	// RelaySTARTTLS upgrades the connection to the relay using STARTTLS (usually on port 587).
+	RelaySTARTTLS = "starttls"
+	// RelayPlaintext doesn't encrypt the connection, it is allowed only for relays on the same host.
+	RelayPlaintext = "none"
+)
+
+// Authentication mechanisms supported by the relay client.
+const (
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram-md5"
+)
+
 // SenderConfig ...
 type SenderConfig struct {
 	Host         string        `env:"HOST" envDefault:"localhost"`
@@ -43,9 +121,95 @@ type SenderConfig struct {
 	WorkerCount  int           `env:"SENDER_WORKER_COUNT" envDefault:"16"`
 	SenderMail   string        `env:"SENDER_MAIL" envDefault:"postman"`
 	SenderName   string        `env:"SENDER_NAME" envDefault:"Mailback Postman"`
+	ReplySubject bool          `env:"SENDER_REPLY_SUBJECT" envDefault:"false"`
+	TLSPolicy    string        `env:"SENDER_TLS_POLICY" envDefault:"opportunistic"`
+	MTASTS       bool          `env:"SENDER_MTA_STS" envDefault:"true"`
+	Transport    string        `env:"SENDER_TRANSPORT" envDefault:"mx"`
+	Maildir      string        `env:"SENDER_MAILDIR"`
+	Mbox         string        `env:"SENDER_MBOX"`
+	Relay        RelayConfig
+	Webhook      WebhookConfig
+	Retry        RetryConfig
+	// WorkerID identifies the sender instance when multiple instances share the storage, the hostname and
+	// the process ID are used if it is empty.
+	WorkerID string `env:"SENDER_WORKER_ID"`
+	// BatchSize is the maximal number of entries claimed at once. The workers must be able to deliver the whole
+	// batch within the lease, so ceil(BatchSize / WorkerCount) * EntryTimeout must be shorter than the lease.
+	BatchSize int `env:"SENDER_BATCH_SIZE" envDefault:"16"`
+	// Lease is how long the claimed entries belong to the sender instance. Entries that weren't delivered
+	// until the lease expires, such as when the instance crashed, are recovered by the other instances.
+	Lease time.Duration `env:"SENDER_LEASE" envDefault:"10m"`
+	// EntryTimeout limits how long the delivery of single entry takes, it must be shorter than the lease.
+	EntryTimeout time.Duration `env:"SENDER_ENTRY_TIMEOUT" envDefault:"5m"`
+	// Window is how far ahead the sender loads the upcoming entries, it is woken up when they are due.
+	// The storage is also polled every tick in case some notifications were lost.
+	Window time.Duration `env:"SENDER_WINDOW" envDefault:"1h"`
+	// CatchUp is the default catch-up policy of periodic entries (once, all or skip), the users can choose
+	// the policy of their entries with "Catch-Up: skip" line at the beginning of the email.
+	CatchUp string `env:"SENDER_CATCH_UP" envDefault:"once"`
+	// CatchUpGrace is how late the occurrence can be delivered before it is considered missed.
+	CatchUpGrace time.Duration `env:"SENDER_CATCH_UP_GRACE" envDefault:"1h"`
+	Notify       NotifyConfig
+}
+
+// Address returns the address from which the emails are sent.
+func (c *SenderConfig) Address() string {
+	return c.SenderMail + "@" + c.Host
 }
 
+// RelayConfig configures the relay host (smarthost) used with the relay transport.
+type RelayConfig struct {
+	Host     string `env:"SENDER_RELAY_HOST"`
+	Port     string `env:"SENDER_RELAY_PORT" envDefault:"587"`
+	Security string `env:"SENDER_RELAY_SECURITY" envDefault:"starttls"`
+	// Auth is the authentication mechanism, empty if the relay doesn't require authentication.
+	Auth     string `env:"SENDER_RELAY_AUTH"`
+	Username string `env:"SENDER_RELAY_USERNAME"`
+	Password string `env:"SENDER_RELAY_PASSWORD"`
+}
+
+// WebhookConfig configures the webhook used with the webhook transport.
+type WebhookConfig struct {
+	URL string `env:"SENDER_WEBHOOK_URL"`
+	// Secret is used to sign the requests, the signature is sent in X-Mailback-Signature header.
+	Secret string `env:"SENDER_WEBHOOK_SECRET"`
+}
+
+// RetryConfig configures retrying of temporarily failed deliveries. The delivery is given up once it fails
+// for longer than MaxAge or more than MaxAttempts times, whichever comes first.
+type RetryConfig struct {
+	MaxAge      time.Duration `env:"SENDER_RETRY_MAX_AGE" envDefault:"120h"`
+	MaxAttempts int           `env:"SENDER_RETRY_MAX_ATTEMPTS" envDefault:"30"`
+	// MinBackoff is the delay after the first failure, each following delay is Factor times longer
+	// up to MaxBackoff.
+	MinBackoff time.Duration `env:"SENDER_RETRY_MIN_BACKOFF" envDefault:"5m"`
+	MaxBackoff time.Duration `env:"SENDER_RETRY_MAX_BACKOFF" envDefault:"4h"`
+	Factor     float64       `env:"SENDER_RETRY_FACTOR" envDefault:"2"`
+}
+
+// Storage drivers.
+const (
+	// DriverSQLite stores the entries in SQLite database file.
+	DriverSQLite = "sqlite3"
+	// DriverPostgres stores the entries in PostgreSQL database.
+	DriverPostgres = "postgres"
+	// DriverMemory keeps the entries in memory of single process, optionally snapshotted to JSON file.
+	DriverMemory = "memory"
+)
+
 // StorageConfig ...
 type StorageConfig struct {
+	Driver string `env:"DATABASE_DRIVER" envDefault:"sqlite3"`
+	// Database is the filename of the SQLite database, the DSN of the PostgreSQL database or the snapshot file
+	// of the memory store, the memory store isn't snapshotted if it is empty.
 	Database string `env:"DATABASE" envDefault:"test.db"`
+	// SnapshotInterval is how often the memory store is snapshotted, it is snapshotted only when closed if it
+	// is zero.
+	SnapshotInterval time.Duration `env:"DATABASE_SNAPSHOT_INTERVAL" envDefault:"1m"`
+	// BusyTimeout is how long the writes to the SQLite database wait for the database locked by another
+	// process before they fail.
+	BusyTimeout time.Duration `env:"DATABASE_BUSY_TIMEOUT" envDefault:"5s"`
+	// MaxOpenConns limits the number of open connections to the SQLite database of each process.
+	MaxOpenConns int    `env:"DATABASE_MAX_OPEN_CONNS" envDefault:"4"`
+	BlobDir      string `env:"BLOB_DIR" envDefault:"blobs"`
 }
@@ -81,3 +81,32 @@ func TestLoadConfigs(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadConfigs_Relay(t *testing.T) {
+	env := map[string]string{
+		"SENDER_TRANSPORT":      TransportRelay,
+		"SENDER_RELAY_HOST":     "smtp.example.com",
+		"SENDER_RELAY_AUTH":     AuthPlain,
+		"SENDER_RELAY_USERNAME": "mailback",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	defer func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}()
+
+	var c SenderConfig
+	err := LoadConfigs(&c)
+	assert.NoError(t, err, "shouldn't return error")
+	assert.Equal(t, TransportRelay, c.Transport, "should parse the transport")
+	assert.Equal(t, RelayConfig{
+		Host:     "smtp.example.com",
+		Port:     "587",
+		Security: RelaySTARTTLS,
+		Auth:     AuthPlain,
+		Username: "mailback",
+	}, c.Relay, "should parse nested relay config")
+}
@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"context"
+	"io"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// Results of the DKIM verification of a message.
+const (
+	// DKIMNone means the message doesn't carry any DKIM signature.
+	DKIMNone = "none"
+	// DKIMPass means at least one of the signatures is valid.
+	DKIMPass = "pass"
+	// DKIMFail means the message is signed but none of the signatures is valid.
+	DKIMFail = "fail"
+)
+
+// VerifyDKIM verifies every DKIM-Signature of the raw message read from r, looking up the public keys
+// using given resolver. It returns one verification per signature.
+func VerifyDKIM(ctx context.Context, res Resolver, r io.Reader) ([]*dkim.Verification, error) {
+	return dkim.VerifyWithOptions(r, &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return res.LookupTXT(ctx, domain)
+		},
+	})
+}
+
+// DKIMResult summarizes the verifications into single result.
+func DKIMResult(verifications []*dkim.Verification) string {
+	if len(verifications) == 0 {
+		return DKIMNone
+	}
+	for _, v := range verifications {
+		if v.Err == nil {
+			return DKIMPass
+		}
+	}
+	return DKIMFail
+}
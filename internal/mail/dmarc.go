@@ -0,0 +1,125 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Results of the DMARC evaluation of a message.
+const (
+	// DMARCNone means the author domain doesn't publish DMARC policy.
+	DMARCNone = "none"
+	// DMARCPass means the message passed aligned SPF or DKIM check.
+	DMARCPass = "pass"
+	// DMARCFail means neither SPF nor DKIM passed with identifier aligned with the author domain.
+	DMARCFail = "fail"
+	// DMARCTempError means the policy couldn't be obtained because of a temporary error.
+	DMARCTempError = "temperror"
+)
+
+// DMARCInput holds the authentication results of a message that DMARC evaluation is based on.
+type DMARCInput struct {
+	// From is the domain of the author of the message, taken from the From header.
+	From string
+	// SPFDomain is the domain that was checked by SPF, taken from the envelope sender.
+	SPFDomain string
+	// SPFPass is true if the SPF check passed.
+	SPFPass bool
+	// DKIMDomains are the signing domains of all valid DKIM signatures of the message.
+	DKIMDomains []string
+}
+
+// DMARCVerdict is the outcome of DMARC evaluation.
+type DMARCVerdict struct {
+	// Result is the result of the evaluation.
+	Result string
+	// Policy is the policy the author domain requests to apply on the message if the evaluation fails.
+	Policy dmarc.Policy
+}
+
+// OrganizationalDomain returns the organizational domain (RFC 7489 section 3.2) of given domain.
+func OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+// aligned checks identifier alignment (RFC 7489 section 3.1) of the domain with the author domain.
+func aligned(mode dmarc.AlignmentMode, domain, from string) bool {
+	if domain == "" {
+		return false
+	}
+	if mode == dmarc.AlignmentStrict {
+		return strings.EqualFold(domain, from)
+	}
+	return OrganizationalDomain(domain) == OrganizationalDomain(from)
+}
+
+// lookupDMARC obtains the DMARC record for the domain falling back to the record of its organizational domain.
+// The returned policy is the one that applies to the domain.
+func lookupDMARC(ctx context.Context, res Resolver, domain string) (*dmarc.Record, dmarc.Policy, error) {
+	opts := &dmarc.LookupOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			return res.LookupTXT(ctx, name)
+		},
+	}
+	rec, err := dmarc.LookupWithOptions(domain, opts)
+	if err == nil {
+		return rec, rec.Policy, nil
+	}
+	org := OrganizationalDomain(domain)
+	if !errors.Is(err, dmarc.ErrNoPolicy) || org == strings.ToLower(domain) {
+		return nil, "", err
+	}
+	rec, err = dmarc.LookupWithOptions(org, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	if rec.SubdomainPolicy != "" {
+		return rec, rec.SubdomainPolicy, nil
+	}
+	return rec, rec.Policy, nil
+}
+
+// EvaluateDMARC evaluates DMARC (RFC 7489) for a message with given authentication results.
+// The policy of the author domain is looked up using given resolver.
+func EvaluateDMARC(ctx context.Context, res Resolver, in *DMARCInput) (*DMARCVerdict, error) {
+	rec, policy, err := lookupDMARC(ctx, res, in.From)
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		return &DMARCVerdict{Result: DMARCNone, Policy: dmarc.PolicyNone}, nil
+	case dmarc.IsTempFail(err):
+		return &DMARCVerdict{Result: DMARCTempError, Policy: dmarc.PolicyNone}, err
+	case err != nil:
+		return nil, err
+	}
+
+	if in.SPFPass && aligned(rec.SPFAlignment, in.SPFDomain, in.From) {
+		return &DMARCVerdict{Result: DMARCPass, Policy: policy}, nil
+	}
+	for _, d := range in.DKIMDomains {
+		if aligned(rec.DKIMAlignment, d, in.From) {
+			return &DMARCVerdict{Result: DMARCPass, Policy: policy}, nil
+		}
+	}
+
+	// the policy is applied only to the requested percentage of failing messages,
+	// the rest gets next less strict policy (RFC 7489 section 6.6.4)
+	if rec.Percent != nil && rand.Intn(100) >= *rec.Percent { // nolint:gosec
+		switch policy {
+		case dmarc.PolicyReject:
+			policy = dmarc.PolicyQuarantine
+		case dmarc.PolicyQuarantine:
+			policy = dmarc.PolicyNone
+		}
+	}
+	return &DMARCVerdict{Result: DMARCFail, Policy: policy}, nil
+}
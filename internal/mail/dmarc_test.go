@@ -0,0 +1,129 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubResolver struct {
+	txt map[string][]string
+	mx  map[string][]*net.MX
+	ip  map[string][]net.IPAddr
+	// err is returned for all lookups if set
+	err error
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *stubResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	txts, ok := r.txt[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	return txts, nil
+}
+
+func (r *stubResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	mxs, ok := r.mx[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	// callers may reorder the records so return a copy
+	return append([]*net.MX(nil), mxs...), nil
+}
+
+func (r *stubResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	ips, ok := r.ip[host]
+	if !ok {
+		return nil, notFound(host)
+	}
+	return ips, nil
+}
+
+func TestEvaluateDMARC(t *testing.T) {
+	res := &stubResolver{txt: map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.strict.org":  {"v=DMARC1; p=reject; adkim=s; aspf=s"},
+	}}
+
+	tests := []struct {
+		Name       string
+		Input      DMARCInput
+		WantResult string
+		WantPolicy dmarc.Policy
+	}{
+		{
+			Name:       "no policy",
+			Input:      DMARCInput{From: "example.net"},
+			WantResult: DMARCNone,
+			WantPolicy: dmarc.PolicyNone,
+		},
+		{
+			Name:       "aligned spf",
+			Input:      DMARCInput{From: "example.com", SPFDomain: "example.com", SPFPass: true},
+			WantResult: DMARCPass,
+			WantPolicy: dmarc.PolicyReject,
+		},
+		{
+			Name:       "relaxed spf alignment",
+			Input:      DMARCInput{From: "example.com", SPFDomain: "bounces.example.com", SPFPass: true},
+			WantResult: DMARCPass,
+			WantPolicy: dmarc.PolicyReject,
+		},
+		{
+			Name:       "failed spf",
+			Input:      DMARCInput{From: "example.com", SPFDomain: "example.com"},
+			WantResult: DMARCFail,
+			WantPolicy: dmarc.PolicyReject,
+		},
+		{
+			Name:       "unaligned dkim",
+			Input:      DMARCInput{From: "example.com", DKIMDomains: []string{"example.net"}},
+			WantResult: DMARCFail,
+			WantPolicy: dmarc.PolicyReject,
+		},
+		{
+			Name:       "subdomain policy",
+			Input:      DMARCInput{From: "mail.example.com", DKIMDomains: []string{"example.net"}},
+			WantResult: DMARCFail,
+			WantPolicy: dmarc.PolicyQuarantine,
+		},
+		{
+			Name:       "strict dkim alignment",
+			Input:      DMARCInput{From: "strict.org", DKIMDomains: []string{"mail.strict.org"}},
+			WantResult: DMARCFail,
+			WantPolicy: dmarc.PolicyReject,
+		},
+		{
+			Name:       "strict dkim alignment pass",
+			Input:      DMARCInput{From: "strict.org", DKIMDomains: []string{"mail.strict.org", "strict.org"}},
+			WantResult: DMARCPass,
+			WantPolicy: dmarc.PolicyReject,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			verdict, err := EvaluateDMARC(context.Background(), res, &tt.Input)
+			require.NoError(t, err, "shouldn't return error")
+			assert.Equal(t, tt.WantResult, verdict.Result, "should evaluate the result")
+			assert.Equal(t, tt.WantPolicy, verdict.Policy, "should choose the policy")
+		})
+	}
+}
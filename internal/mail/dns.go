@@ -0,0 +1,17 @@
+package mail
+
+import (
+	"context"
+	"net"
+)
+
+// Resolver looks up DNS records. It is satisfied by *net.Resolver, tests can replace it with a local stub
+// so that the lookups don't leave the process.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DefaultResolver is the resolver used when none is provided.
+var DefaultResolver Resolver = net.DefaultResolver
@@ -0,0 +1,225 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MTA-STS policy modes (RFC 8461 section 3.2).
+const (
+	// STSModeEnforce requires the delivery over TLS with verified certificate to one of the policy MX hosts.
+	STSModeEnforce = "enforce"
+	// STSModeTesting only reports the failures, the email is delivered anyway.
+	STSModeTesting = "testing"
+	// STSModeNone means that the domain doesn't have active policy.
+	STSModeNone = "none"
+)
+
+const (
+	// stsMaxPolicySize is the maximal size of the policy body (RFC 8461 section 3.3).
+	stsMaxPolicySize = 64 * 1024
+	// stsMaxAge caps the time for which the policy is cached (RFC 8461 section 3.2).
+	stsMaxAge = 31557600 * time.Second
+	// stsFetchTimeout limits how long it takes to fetch the policy.
+	stsFetchTimeout = time.Minute
+)
+
+// STSPolicy is MTA-STS policy of a domain (RFC 8461).
+type STSPolicy struct {
+	Mode string
+	// MX are patterns of the MX hosts that are allowed to receive the email, the left-most label can be
+	// a wildcard.
+	MX     []string
+	MaxAge time.Duration
+}
+
+// ParseSTSPolicy parses MTA-STS policy body (RFC 8461 section 3.2).
+func ParseSTSPolicy(r io.Reader) (*STSPolicy, error) {
+	p := &STSPolicy{}
+	var version string
+	scanner := bufio.NewScanner(io.LimitReader(r, stsMaxPolicySize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed policy line: %q", line)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			p.Mode = value
+		case "mx":
+			p.MX = append(p.MX, strings.ToLower(value))
+		case "max_age":
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max_age: %w", err)
+			}
+			p.MaxAge = time.Duration(seconds) * time.Second
+			if p.MaxAge > stsMaxAge {
+				p.MaxAge = stsMaxAge
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if version != "STSv1" {
+		return nil, fmt.Errorf("unsupported policy version: %q", version)
+	}
+	switch p.Mode {
+	case STSModeEnforce, STSModeTesting:
+		if len(p.MX) == 0 {
+			return nil, errors.New("policy without mx hosts")
+		}
+	case STSModeNone:
+	default:
+		return nil, fmt.Errorf("unknown policy mode: %q", p.Mode)
+	}
+	return p, nil
+}
+
+// Match reports whether the MX host is allowed by the policy (RFC 8461 section 4.1).
+func (p *STSPolicy) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		if strings.HasPrefix(pattern, "*.") {
+			// the wildcard matches exactly one label
+			i := strings.IndexByte(host, '.')
+			if i > 0 && host[i+1:] == pattern[2:] {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// stsRecord parses the id of the policy from the _mta-sts TXT records (RFC 8461 section 3.1).
+func stsRecord(txts []string) (string, error) {
+	var id string
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1") {
+			continue
+		}
+		if id != "" {
+			return "", errors.New("multiple MTA-STS records")
+		}
+		for _, field := range strings.Split(txt, ";") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "id=") {
+				id = strings.TrimPrefix(field, "id=")
+			}
+		}
+		if id == "" {
+			return "", errors.New("MTA-STS record without id")
+		}
+	}
+	return id, nil
+}
+
+// stsEntry is cached policy of single domain.
+type stsEntry struct {
+	id      string
+	policy  *STSPolicy
+	expires time.Time
+}
+
+// STSCache fetches MTA-STS policies of the domains and keeps them for their max_age.
+type STSCache struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	entries map[string]stsEntry
+}
+
+// NewSTSCache creates new cache that fetches the policies using given HTTP client. The client must verify
+// the certificates of the policy hosts.
+func NewSTSCache(client *http.Client) *STSCache {
+	c := *client
+	// redirects must not be followed (RFC 8461 section 3.3)
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &STSCache{
+		client:  &c,
+		entries: make(map[string]stsEntry),
+	}
+}
+
+// Policy returns MTA-STS policy of the domain or nil if the domain doesn't have any, the MTA-STS record of the
+// domain is looked up using given resolver. Cached policy is refreshed when its id changes or it expires. Cached
+// policy is used when the lookup fails, errors are returned only if there is no usable policy in the cache.
+func (c *STSCache) Policy(ctx context.Context, res Resolver, domain string) (*STSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	c.mu.Lock()
+	cached, ok := c.entries[domain]
+	c.mu.Unlock()
+	if ok && time.Now().After(cached.expires) {
+		ok = false
+	}
+
+	txts, err := res.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil && !isNotFound(err) {
+		if ok {
+			return cached.policy, nil
+		}
+		return nil, fmt.Errorf("lookup MTA-STS record of %s: %w", domain, err)
+	}
+	id, err := stsRecord(txts)
+	if err != nil || id == "" {
+		// without the record the cached policy stays in effect until it expires
+		if ok {
+			return cached.policy, nil
+		}
+		return nil, err
+	}
+	if ok && cached.id == id {
+		return cached.policy, nil
+	}
+
+	policy, err := c.fetch(ctx, domain)
+	if err != nil {
+		if ok {
+			return cached.policy, nil
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[domain] = stsEntry{id: id, policy: policy, expires: time.Now().Add(policy.MaxAge)}
+	c.mu.Unlock()
+	return policy, nil
+}
+
+// fetch downloads the policy of the domain from the well-known location (RFC 8461 section 3.3).
+func (c *STSCache) fetch(ctx context.Context, domain string) (*STSPolicy, error) {
+	ctx, cancel := context.WithTimeout(ctx, stsFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://mta-sts."+domain+"/.well-known/mta-sts.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch MTA-STS policy of %s: %w", domain, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch MTA-STS policy of %s: unexpected status %s", domain, resp.Status)
+	}
+	return ParseSTSPolicy(resp.Body)
+}
@@ -0,0 +1,157 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSTSPolicy(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Body    string
+		Want    *STSPolicy
+		WantErr bool
+	}{
+		{
+			Name: "enforce",
+			Body: "version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n",
+			Want: &STSPolicy{Mode: STSModeEnforce, MX: []string{"mail.example.com", "*.example.net"}, MaxAge: 24 * time.Hour},
+		},
+		{
+			Name: "none",
+			Body: "version: STSv1\nmode: none\nmax_age: 60\n",
+			Want: &STSPolicy{Mode: STSModeNone, MaxAge: time.Minute},
+		},
+		{
+			Name: "max age capped",
+			Body: "version: STSv1\nmode: testing\nmx: mail.example.com\nmax_age: 99999999\n",
+			Want: &STSPolicy{Mode: STSModeTesting, MX: []string{"mail.example.com"}, MaxAge: stsMaxAge},
+		},
+		{
+			Name:    "missing version",
+			Body:    "mode: enforce\nmx: mail.example.com\nmax_age: 86400\n",
+			WantErr: true,
+		},
+		{
+			Name:    "unknown mode",
+			Body:    "version: STSv1\nmode: strict\nmx: mail.example.com\nmax_age: 86400\n",
+			WantErr: true,
+		},
+		{
+			Name:    "enforce without mx",
+			Body:    "version: STSv1\nmode: enforce\nmax_age: 86400\n",
+			WantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			p, err := ParseSTSPolicy(strings.NewReader(tt.Body))
+			if tt.WantErr {
+				assert.Error(t, err, "should fail")
+				return
+			}
+			require.NoError(t, err, "shouldn't return error")
+			assert.Equal(t, tt.Want, p, "should parse the policy")
+		})
+	}
+}
+
+func TestSTSPolicy_Match(t *testing.T) {
+	p := &STSPolicy{Mode: STSModeEnforce, MX: []string{"mail.example.com", "*.example.net"}}
+	tests := []struct {
+		Host string
+		Want bool
+	}{
+		{Host: "mail.example.com", Want: true},
+		{Host: "MAIL.example.com.", Want: true},
+		{Host: "backup.example.com", Want: false},
+		{Host: "mx1.example.net", Want: true},
+		{Host: "example.net", Want: false},
+		{Host: "a.mx1.example.net", Want: false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Host, func(t *testing.T) {
+			assert.Equal(t, tt.Want, p.Match(tt.Host), "should match the host against the policy")
+		})
+	}
+}
+
+// stsServer starts HTTPS server serving the policy and returns client that connects to it for any host.
+func stsServer(t *testing.T, policy string, fetches *int32) *http.Client {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(fetches, 1)
+		if r.Host != "mta-sts.example.com" || r.URL.Path != "/.well-known/mta-sts.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, policy)
+	}))
+	t.Cleanup(srv.Close)
+
+	client := srv.Client()
+	transport := client.Transport.(*http.Transport)
+	// the test certificate is valid for example.com
+	transport.TLSClientConfig.ServerName = "example.com"
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	return client
+}
+
+func TestSTSCache_Policy(t *testing.T) {
+	var fetches int32
+	client := stsServer(t, "version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 86400\n", &fetches)
+	res := &stubResolver{txt: map[string][]string{
+		"_mta-sts.example.com": {"v=STSv1; id=20200101"},
+	}}
+	cache := NewSTSCache(client)
+
+	p, err := cache.Policy(context.Background(), res, "example.com")
+	require.NoError(t, err, "shouldn't return error")
+	require.NotNil(t, p, "should return the policy")
+	assert.Equal(t, STSModeEnforce, p.Mode, "should fetch the policy")
+
+	_, err = cache.Policy(context.Background(), res, "example.com")
+	require.NoError(t, err, "shouldn't return error")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&fetches), "should cache the policy")
+
+	res.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=20200102"}
+	_, err = cache.Policy(context.Background(), res, "example.com")
+	require.NoError(t, err, "shouldn't return error")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&fetches), "should refresh the policy when the id changes")
+
+	delete(res.txt, "_mta-sts.example.com")
+	p, err = cache.Policy(context.Background(), res, "example.com")
+	require.NoError(t, err, "shouldn't return error")
+	assert.NotNil(t, p, "should keep the cached policy until it expires")
+
+	p, err = cache.Policy(context.Background(), res, "example.org")
+	require.NoError(t, err, "shouldn't return error")
+	assert.Nil(t, p, "shouldn't return policy for domains without the record")
+}
+
+func TestSTSCache_Policy_Untrusted(t *testing.T) {
+	var fetches int32
+	client := stsServer(t, "version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 86400\n", &fetches)
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{}
+	res := &stubResolver{txt: map[string][]string{
+		"_mta-sts.example.com": {"v=STSv1; id=20200101"},
+	}}
+
+	_, err := NewSTSCache(client).Policy(context.Background(), res, "example.com")
+	assert.Error(t, err, "should refuse the policy served with untrusted certificate")
+}
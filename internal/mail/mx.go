@@ -1,25 +1,86 @@
 package mail
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"sort"
 	"strings"
 )
 
-// MXRecordForHost obtains best available MX records for given host.
-func MXRecordForHost(host string) (string, error) {
-	recs, err := net.LookupMX(host)
-	if err != nil {
-		return "", nil
+// ErrNullMX is returned for domains that explicitly don't accept any email by publishing null MX record
+// (RFC 7505).
+var ErrNullMX = errors.New("domain does not accept email")
+
+// ErrNoSuchDomain is returned for domains that have neither MX nor address records according to the DNS server.
+var ErrNoSuchDomain = errors.New("domain does not exist")
+
+// isNotFound reports whether the lookup failed because the record doesn't exist.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// isNoSuchHost reports whether the DNS server answered that the record doesn't exist. Not found errors without
+// the server, such as the ones of the system resolver, may be caused by local misconfiguration.
+func isNoSuchHost(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound && !dnsErr.IsTemporary && dnsErr.Server != ""
+}
+
+// LookupMX returns hosts that accept email for given domain in the order in which they should be tried
+// (RFC 5321 section 5.1). Hosts are sorted by preference, hosts with the same preference are shuffled so that
+// the load is spread between them. If the domain has no MX records, the domain itself is returned provided it
+// has A or AAAA record (implicit MX).
+func LookupMX(ctx context.Context, res Resolver, domain string) ([]string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return nil, errors.New("empty domain")
 	}
-	if len(recs) < 1 {
-		return "", errors.New("no MX records found")
+	records, err := res.LookupMX(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("lookup MX records of %s: %w", domain, err)
 	}
-	sort.Slice(recs, func(i, j int) bool {
-		return recs[i].Pref > recs[j].Pref
+	if len(records) == 0 {
+		hosts, ierr := implicitMX(ctx, res, domain)
+		if ierr != nil && isNoSuchHost(err) && isNoSuchHost(ierr) {
+			return nil, fmt.Errorf("%s: %w", domain, ErrNoSuchDomain)
+		}
+		return hosts, ierr
+	}
+
+	rand.Shuffle(len(records), func(i, j int) {
+		records[i], records[j] = records[j], records[i]
 	})
-	// mx records end with '.' so trim it
-	rec := strings.TrimRight(recs[0].Host, ".")
-	return rec, nil
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+	hosts := make([]string, 0, len(records))
+	for _, r := range records {
+		// mx records end with '.' so trim it
+		host := strings.TrimSuffix(r.Host, ".")
+		if host == "" {
+			// null MX must be the only record, ignore it if the domain is misconfigured
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("%s: %w", domain, ErrNullMX)
+	}
+	return hosts, nil
+}
+
+// implicitMX returns the domain itself if it has A or AAAA records.
+func implicitMX(ctx context.Context, res Resolver, domain string) ([]string, error) {
+	addrs, err := res.LookupIPAddr(ctx, domain)
+	if err != nil {
+		return nil, fmt.Errorf("lookup addresses of %s: %w", domain, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no MX or address records found for %s", domain)
+	}
+	return []string{domain}, nil
 }
@@ -0,0 +1,110 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupMX(t *testing.T) {
+	res := &stubResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "backup.example.com.", Pref: 20},
+				{Host: "mx.example.com.", Pref: 10},
+			},
+			"null.example.com": {{Host: ".", Pref: 0}},
+			"misconfigured.example.com": {
+				{Host: ".", Pref: 0},
+				{Host: "mx.example.com.", Pref: 10},
+			},
+		},
+		ip: map[string][]net.IPAddr{
+			"implicit.example.com": {{IP: net.ParseIP("192.0.2.1")}},
+		},
+	}
+
+	tests := []struct {
+		Name      string
+		Domain    string
+		WantHosts []string
+		WantErr   error
+	}{
+		{
+			Name:      "sorted by preference",
+			Domain:    "example.com",
+			WantHosts: []string{"mx.example.com", "backup.example.com"},
+		},
+		{
+			Name:      "trailing dot",
+			Domain:    "example.com.",
+			WantHosts: []string{"mx.example.com", "backup.example.com"},
+		},
+		{
+			Name:      "implicit MX",
+			Domain:    "implicit.example.com",
+			WantHosts: []string{"implicit.example.com"},
+		},
+		{
+			Name:    "null MX",
+			Domain:  "null.example.com",
+			WantErr: ErrNullMX,
+		},
+		{
+			Name:      "null MX with other records",
+			Domain:    "misconfigured.example.com",
+			WantHosts: []string{"mx.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			hosts, err := LookupMX(context.Background(), res, tt.Domain)
+			if tt.WantErr != nil {
+				assert.True(t, errors.Is(err, tt.WantErr), "should return %v, got %v", tt.WantErr, err)
+				return
+			}
+			require.NoError(t, err, "shouldn't return error")
+			assert.Equal(t, tt.WantHosts, hosts, "should return the hosts in order")
+		})
+	}
+}
+
+func TestLookupMX_Errors(t *testing.T) {
+	_, err := LookupMX(context.Background(), &stubResolver{}, "nonexistent.example.com")
+	assert.Error(t, err, "should fail for domains without any records")
+	assert.False(t, errors.Is(err, ErrNoSuchDomain), "shouldn't trust not found errors of unknown origin")
+
+	nxErr := &net.DNSError{Err: "no such host", Name: "example.com", Server: "192.0.2.53:53", IsNotFound: true}
+	_, err = LookupMX(context.Background(), &stubResolver{err: nxErr}, "example.com")
+	assert.True(t, errors.Is(err, ErrNoSuchDomain), "should report domain the DNS server doesn't know, got %v", err)
+
+	tempErr := &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}
+	_, err = LookupMX(context.Background(), &stubResolver{err: tempErr}, "example.com")
+	assert.True(t, errors.Is(err, tempErr), "should return the lookup error, got %v", err)
+}
+
+func TestLookupMX_Shuffle(t *testing.T) {
+	res := &stubResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "a.example.com.", Pref: 10},
+				{Host: "b.example.com.", Pref: 10},
+				{Host: "backup.example.com.", Pref: 20},
+			},
+		},
+	}
+	first := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		hosts, err := LookupMX(context.Background(), res, "example.com")
+		require.NoError(t, err, "shouldn't return error")
+		require.Len(t, hosts, 3, "should return all hosts")
+		assert.Equal(t, "backup.example.com", hosts[2], "should keep the less preferred host last")
+		first[hosts[0]]++
+	}
+	assert.Len(t, first, 2, "should break the ties randomly")
+}
@@ -0,0 +1,220 @@
+// Package message builds email messages compliant with RFC 5322 (Internet Message Format) and
+// RFC 2045-2047 (MIME). It takes care of encoding of non-ASCII header values, folding of long header lines,
+// transfer encoding of bodies and CRLF line endings.
+package message
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// lineLength is the recommended maximal length of a line (RFC 5322 section 2.1.1).
+	lineLength = 78
+	crlf       = "\r\n"
+)
+
+// Field is single header field of the message.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Message is an email message.
+type Message struct {
+	// From is the author of the message.
+	From *mail.Address
+	// To are the recipients of the message.
+	To []*mail.Address
+	// Subject is the subject of the message, it may contain any unicode characters.
+	Subject string
+	// Date is the origination date of the message.
+	Date time.Time
+	// MessageID is the unique identifier of the message including the angle brackets, see NewMessageID.
+	MessageID string
+	// InReplyTo are the identifiers of the messages this message replies to.
+	InReplyTo []string
+	// References are the identifiers of the messages of the thread this message belongs to.
+	References []string
+	// Header holds additional header fields that are written after the standard ones.
+	Header []Field
+	// Body is the body of the message.
+	Body *Part
+}
+
+// NewMessageID generates new unique message identifier (RFC 5322 section 3.6.4) for given domain.
+func NewMessageID(domain string) (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().Unix(), hex.EncodeToString(b), domain), nil
+}
+
+// FormatID formats the message identifier, adding angle brackets if they are missing.
+func FormatID(id string) string {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return ""
+	}
+	return "<" + strings.Trim(id, "<>") + ">"
+}
+
+// ParseIDs splits list of message identifiers, such as value of References header field.
+func ParseIDs(s string) []string {
+	var ids []string
+	for _, id := range strings.Fields(s) {
+		if id = FormatID(id); id != "<>" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// sanitize removes line breaks from header values so that they can't be used to inject header fields.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// maxEncodedText limits the length of the encoded text in a single encoded word so that each encoded word fits
+// on a line together with the field name (RFC 2047 section 2).
+const maxEncodedText = 48
+
+// needsEncoding reports whether the text contains characters that can't appear in header as they are.
+func needsEncoding(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if (s[i] < ' ' || s[i] > '~') && s[i] != '\t' {
+			return true
+		}
+	}
+	return false
+}
+
+// qEncode encodes single character using the "Q" encoding (RFC 2047 section 4.2).
+func qEncode(r rune) string {
+	switch {
+	case r == ' ':
+		return "_"
+	case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("!*+-/", r)):
+		return string(r)
+	}
+	var b strings.Builder
+	buf := make([]byte, utf8.UTFMax)
+	for _, c := range buf[:utf8.EncodeRune(buf, r)] {
+		fmt.Fprintf(&b, "=%02X", c)
+	}
+	return b.String()
+}
+
+// encodeWord encodes the text as RFC 2047 encoded words if it contains non-ASCII characters. The text is split
+// into multiple short encoded words, so that it can be folded. Characters are never split between the words.
+func encodeWord(s string) string {
+	s = sanitize(s)
+	if !needsEncoding(s) {
+		return s
+	}
+	var words []string
+	var word strings.Builder
+	for _, r := range s {
+		enc := qEncode(r)
+		if word.Len()+len(enc) > maxEncodedText {
+			words = append(words, "=?utf-8?q?"+word.String()+"?=")
+			word.Reset()
+		}
+		word.WriteString(enc)
+	}
+	words = append(words, "=?utf-8?q?"+word.String()+"?=")
+	return strings.Join(words, " ")
+}
+
+// addressList formats the addresses, encoding the display names if necessary.
+func addressList(addrs []*mail.Address) string {
+	list := make([]string, len(addrs))
+	for i, a := range addrs {
+		list[i] = a.String()
+	}
+	return strings.Join(list, ", ")
+}
+
+// fold folds the header field into lines no longer than lineLength where possible. The lines are broken only
+// before spaces (RFC 5322 section 2.2.3), so long words are kept intact.
+func fold(name, value string) string {
+	var b strings.Builder
+	line := name + ":"
+	for i, word := range strings.Split(strings.TrimLeft(value, " "), " ") {
+		if i > 0 && len(line)+1+len(word) > lineLength {
+			b.WriteString(line)
+			b.WriteString(crlf)
+			line = ""
+		}
+		line += " " + word
+	}
+	b.WriteString(line)
+	b.WriteString(crlf)
+	return b.String()
+}
+
+// fields returns all header fields of the message in the order they are written.
+func (m *Message) fields() []Field {
+	var fields []Field
+	if !m.Date.IsZero() {
+		fields = append(fields, Field{"Date", m.Date.Format(time.RFC1123Z)})
+	}
+	if m.From != nil {
+		fields = append(fields, Field{"From", m.From.String()})
+	}
+	if len(m.To) > 0 {
+		fields = append(fields, Field{"To", addressList(m.To)})
+	}
+	if m.MessageID != "" {
+		fields = append(fields, Field{"Message-ID", m.MessageID})
+	}
+	if len(m.InReplyTo) > 0 {
+		fields = append(fields, Field{"In-Reply-To", strings.Join(m.InReplyTo, " ")})
+	}
+	if len(m.References) > 0 {
+		fields = append(fields, Field{"References", strings.Join(m.References, " ")})
+	}
+	fields = append(fields, Field{"Subject", encodeWord(m.Subject)})
+	for _, f := range m.Header {
+		fields = append(fields, Field{f.Name, encodeWord(f.Value)})
+	}
+	fields = append(fields, Field{"MIME-Version", "1.0"})
+	return fields
+}
+
+// WriteTo writes the message into the writer.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, f := range m.fields() {
+		buf.WriteString(fold(f.Name, sanitize(f.Value)))
+	}
+	body := m.Body
+	if body == nil {
+		body = Text("text/plain", "")
+	}
+	body.write(&buf)
+	return buf.WriteTo(w)
+}
+
+// Bytes returns the whole message.
+func (m *Message) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
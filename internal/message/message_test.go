@@ -0,0 +1,132 @@
+package message
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func stableBoundaries() func() {
+	orig := randomBoundary
+	n := 0
+	randomBoundary = func() string {
+		n++
+		return fmt.Sprintf("boundary-%d", n)
+	}
+	return func() { randomBoundary = orig }
+}
+
+func TestMessage_WriteTo(t *testing.T) {
+	date := time.Date(2020, time.March, 14, 15, 9, 26, 0, time.FixedZone("CET", 3600))
+	from := &mail.Address{Name: "Mailback Postman", Address: "postman@mailback.io"}
+	to := []*mail.Address{{Address: "joe@example.com"}}
+
+	tests := []struct {
+		Name    string
+		Message Message
+	}{
+		{
+			Name: "plain",
+			Message: Message{
+				From:      from,
+				To:        to,
+				Subject:   "Water the plants",
+				Date:      date,
+				MessageID: "<1584194966.abc@mailback.io>",
+				Body:      Text("text/plain", "Don't forget the cactus.\nAnd the ficus."),
+			},
+		},
+		{
+			Name: "unicode",
+			Message: Message{
+				From:      &mail.Address{Name: "Poštovní holub", Address: "postman@mailback.io"},
+				To:        to,
+				Subject:   "Připomínka: zalít květiny, než odjedeš na dovolenou do Chorvatska na celé dva týdny",
+				Date:      date,
+				MessageID: "<1584194966.abc@mailback.io>",
+				Body:      Text("text/plain", "Nezapomeň na kaktus = nejdůležitější rostlina v bytě, o kterou se musí někdo postarat."),
+			},
+		},
+		{
+			Name: "multipart",
+			Message: Message{
+				From:      from,
+				To:        to,
+				Subject:   "Trip",
+				Date:      date,
+				MessageID: "<1584194966.abc@mailback.io>",
+				Header:    []Field{{Name: "X-Mailback-Entry", Value: "abc"}},
+				Body: Multipart("mixed",
+					Multipart("alternative",
+						Text("text/plain", "Pack the tickets."),
+						Multipart("related",
+							Text("text/html", `<p>Pack the tickets.<img src="cid:map"></p>`),
+							Inline("map", "map.gif", "image/gif", []byte("GIF89a")),
+						),
+					),
+					Attachment("jízdenky.pdf", "application/pdf", bytes.Repeat([]byte("%PDF-1.4"), 16)),
+				),
+			},
+		},
+		{
+			Name: "header injection",
+			Message: Message{
+				From:    from,
+				To:      to,
+				Subject: "Hello\r\nBcc: victim@example.com",
+				Date:    date,
+				Body:    Text("text/plain", "Hi"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			defer stableBoundaries()()
+			got, err := tt.Message.Bytes()
+			require.NoError(t, err, "shouldn't return error")
+
+			golden := filepath.Join("testdata", strings.ReplaceAll(tt.Name, " ", "_")+".golden")
+			if *update {
+				require.NoError(t, ioutil.WriteFile(golden, got, 0644))
+			}
+			want, err := ioutil.ReadFile(golden)
+			require.NoError(t, err, "should read golden file")
+			assert.Equal(t, string(want), string(got), "should match golden file")
+
+			for _, line := range strings.Split(string(got), "\r\n") {
+				assert.LessOrEqual(t, len(line), lineLength, "should fold long lines: %q", line)
+				assert.NotContains(t, line, "\n", "should use CRLF line endings")
+			}
+			msg, err := mail.ReadMessage(bytes.NewReader(got))
+			require.NoError(t, err, "should be readable")
+			subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+			require.NoError(t, err, "should decode the subject")
+			assert.Equal(t, sanitize(tt.Message.Subject), subject, "should keep the subject")
+		})
+	}
+}
+
+func TestAttachment_Filename(t *testing.T) {
+	for _, filename := range []string{"plants.pdf", "jízdenky.pdf", "květiny a kaktusy.jpg"} {
+		p := Attachment(filename, "application/pdf", []byte("%PDF-1.4"))
+		disposition, params, err := mime.ParseMediaType(p.header.Get("Content-Disposition"))
+		require.NoError(t, err, "should format valid Content-Disposition")
+		assert.Equal(t, "attachment", disposition, "should keep the disposition")
+		assert.Equal(t, filename, params["filename"], "should keep the filename")
+		assert.NotContains(t, p.header.Get("Content-Disposition"), "=?", "shouldn't use encoded words")
+		assert.Equal(t, filename, p.params["name"], "should set the name of the content type")
+	}
+}
@@ -0,0 +1,152 @@
+package message
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// base64LineLength is the maximal length of base64 encoded lines (RFC 2045 section 6.8).
+const base64LineLength = 76
+
+// randomBoundary generates boundaries of multipart parts, tests replace it to get stable output.
+var randomBoundary = func() string {
+	return multipart.NewWriter(nil).Boundary()
+}
+
+// Part is single part of MIME body, either leaf part with content or multipart container of other parts.
+type Part struct {
+	mediaType string
+	params    map[string]string
+	header    textproto.MIMEHeader
+	// content of leaf parts, already transfer encoded
+	content []byte
+	// parts of multipart containers
+	parts []*Part
+}
+
+// normalizeNewlines converts all line endings to CRLF.
+func normalizeNewlines(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", crlf)
+}
+
+// Text creates UTF-8 text part of given media type (such as text/plain or text/html) with quoted-printable
+// transfer encoding.
+func Text(mediaType, text string) *Part {
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	// writing into bytes.Buffer can't fail
+	_, _ = io.WriteString(w, normalizeNewlines(text))
+	_ = w.Close()
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return &Part{
+		mediaType: mediaType,
+		params:    map[string]string{"charset": "utf-8"},
+		header:    header,
+		content:   buf.Bytes(),
+	}
+}
+
+// binary creates base64 encoded part with given disposition.
+func binary(disposition, filename, contentType string, content []byte) *Part {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Transfer-Encoding", "base64")
+	if filename != "" {
+		// non-ASCII filenames are encoded according to RFC 2231 by FormatMediaType, encoded words aren't allowed
+		// in parameters
+		params["name"] = filename
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	} else {
+		header.Set("Content-Disposition", disposition)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(content)
+	var buf bytes.Buffer
+	for len(encoded) > base64LineLength {
+		buf.WriteString(encoded[:base64LineLength])
+		buf.WriteString(crlf)
+		encoded = encoded[base64LineLength:]
+	}
+	buf.WriteString(encoded)
+	return &Part{
+		mediaType: mediaType,
+		params:    params,
+		header:    header,
+		content:   buf.Bytes(),
+	}
+}
+
+// Attachment creates attachment part with given filename and content.
+func Attachment(filename, contentType string, content []byte) *Part {
+	return binary("attachment", filename, contentType, content)
+}
+
+// Inline creates inline part (such as an image) that can be referenced from HTML body using given content ID.
+func Inline(contentID, filename, contentType string, content []byte) *Part {
+	p := binary("inline", filename, contentType, content)
+	p.header.Set("Content-ID", "<"+contentID+">")
+	return p
+}
+
+// Multipart creates multipart container of given subtype (such as mixed, alternative or related).
+func Multipart(subtype string, parts ...*Part) *Part {
+	return &Part{
+		mediaType: "multipart/" + subtype,
+		params:    map[string]string{},
+		header:    make(textproto.MIMEHeader),
+		parts:     parts,
+	}
+}
+
+// write writes the header of the part, blank line and its body into the buffer.
+func (p *Part) write(buf *bytes.Buffer) {
+	var boundary string
+	params := make(map[string]string, len(p.params)+1)
+	for k, v := range p.params {
+		params[k] = v
+	}
+	if p.parts != nil {
+		boundary = randomBoundary()
+		params["boundary"] = boundary
+	}
+
+	header := make(textproto.MIMEHeader, len(p.header)+1)
+	for k, v := range p.header {
+		header[k] = v
+	}
+	header.Set("Content-Type", mime.FormatMediaType(p.mediaType, params))
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range header[k] {
+			buf.WriteString(fold(k, v))
+		}
+	}
+	buf.WriteString(crlf)
+
+	if p.parts == nil {
+		buf.Write(p.content)
+		buf.WriteString(crlf)
+		return
+	}
+	for _, part := range p.parts {
+		buf.WriteString("--" + boundary + crlf)
+		part.write(buf)
+	}
+	buf.WriteString("--" + boundary + "--" + crlf)
+}
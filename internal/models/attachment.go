@@ -0,0 +1,43 @@
+package models
+
+import (
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+// Attachment is a file that was attached to the received email and is send back together with the entry.
+// Content of the attachment is kept in blob storage under the ID of the attachment.
+type Attachment struct {
+	// ID is unique ID for the attachment, it is also the key of its content in the blob storage.
+	ID string `gorm:"primary_key"`
+	// EntryID is the ID of the entry the attachment belongs to.
+	EntryID string `gorm:"index"`
+	// Filename is the original name of the attached file.
+	Filename string
+	// ContentType is the media type of the attachment.
+	ContentType string
+	// ContentID is set for inline parts (such as images) that are referenced from the HTML body.
+	ContentID string
+	// Size is the size of the attachment content in bytes.
+	Size int64
+}
+
+// NewAttachment creates new attachment for the entry.
+func NewAttachment(entryID, filename, contentType, contentID string, size int64) (*Attachment, error) {
+	id, err := gonanoid.Nanoid()
+	if err != nil {
+		return nil, err
+	}
+	return &Attachment{
+		ID:          id,
+		EntryID:     entryID,
+		Filename:    filename,
+		ContentType: contentType,
+		ContentID:   contentID,
+		Size:        size,
+	}, nil
+}
+
+// Inline reports whether the attachment is displayed as part of the HTML body.
+func (a *Attachment) Inline() bool {
+	return a.ContentID != ""
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+)
+
+// Outcomes of the delivery attempts.
+const (
+	// OutcomeDelivered is outcome of attempts that delivered the entry.
+	OutcomeDelivered = "delivered"
+	// OutcomeDeferred is outcome of attempts that failed temporarily, the delivery is retried.
+	OutcomeDeferred = "deferred"
+	// OutcomeRejected is outcome of attempts that failed permanently, such as when the receiver doesn't exist.
+	OutcomeRejected = "rejected"
+)
+
+// DeliveryAttempt is single attempt to deliver the entry, such as delivery to one of the MX hosts of the receiver.
+// Attempts are kept as history of the entry so that operators can find out why the delivery failed.
+type DeliveryAttempt struct {
+	ID uint `gorm:"primary_key" json:"id"`
+	// EntryID is the ID of the delivered entry.
+	EntryID string `gorm:"index" json:"entry_id"`
+	// CreatedAt is the time of the attempt.
+	CreatedAt time.Time `json:"created_at"`
+	// MessageID is the Message-ID of the delivered email.
+	MessageID string `json:"message_id"`
+	// Host is the host the entry was delivered to.
+	Host string `json:"host"`
+	// TLS reports whether the entry was transmitted over TLS.
+	TLS bool `json:"tls"`
+	// Verified reports whether the certificate of the host was verified.
+	Verified bool `json:"verified"`
+	// Code is the SMTP reply code of the failed attempt, 0 if the host didn't reply, such as when the connection
+	// failed.
+	Code int `json:"code,omitempty"`
+	// Response is the SMTP reply of the failed attempt, including the enhanced status code.
+	Response string `json:"response,omitempty"`
+	// Duration is how long the attempt took.
+	Duration time.Duration `json:"duration"`
+	// Outcome is the result of the attempt, one of OutcomeDelivered, OutcomeDeferred and OutcomeRejected.
+	Outcome string `json:"outcome"`
+	// Error is the reason why the attempt failed, empty if the entry was delivered.
+	Error string `json:"error,omitempty"`
+}
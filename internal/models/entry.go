@@ -1,15 +1,46 @@
 package models
 
 import (
+	"errors"
 	"time"
 
 	"github.com/jinzhu/gorm"
 	gonanoid "github.com/matoous/go-nanoid"
 	"github.com/rickb777/date/period"
 
+	"github.com/matoous/mailback/internal/rrule"
 	"github.com/matoous/mailback/internal/when"
 )
 
+// Delivery states of the entries. Entries go through the states scheduled, claimed and sending and end up
+// either sent, or scheduled again if they are periodic or their delivery is retried.
+const (
+	// StatusScheduled entries are waiting to be delivered.
+	StatusScheduled = "scheduled"
+	// StatusClaimed entries were picked up by the sender, but no delivery was attempted yet.
+	StatusClaimed = "claimed"
+	// StatusSending entries are being delivered, the email may have been delivered already.
+	StatusSending = "sending"
+	// StatusSent entries were delivered and will be removed.
+	StatusSent = "sent"
+	// StatusFailed entries were permanently rejected by the receiver, they are kept but never delivered again.
+	StatusFailed = "failed"
+	// StatusDead entries failed temporarily too many times and were given up. They are kept as dead letters
+	// until they are requeued.
+	StatusDead = "dead"
+)
+
+// Catch-up policies of periodic entries, they decide what happens with the occurrences that were missed,
+// such as when the sender was down.
+const (
+	// CatchUpOnce sends single email for all missed occurrences and continues with the next future occurrence.
+	CatchUpOnce = "once"
+	// CatchUpAll sends email for each of the missed occurrences.
+	CatchUpAll = "all"
+	// CatchUpSkip skips the missed occurrences silently and continues with the next future occurrence.
+	CatchUpSkip = "skip"
+)
+
 // Entry is single mailing entry in mailback. Entry encapsulates all that is needed for the service to work.
 // Entry contains information such as when should the email be send back and what the content should be.
 type Entry struct {
@@ -17,8 +48,18 @@ type Entry struct {
 	ID string `gorm:"primary_key"`
 	// Data is the data that should be send back to the user.
 	Data string
+	// HTML is the HTML version of the data, empty if the received email didn't have one.
+	HTML string
+	// Attachments are the files attached to the received email, including inline images of the HTML body.
+	Attachments []Attachment `gorm:"foreignkey:EntryID"`
 	// Title is the subject received in the initial request that will be send back to the user in subject.
 	Title string
+	// MessageID is the Message-ID of the received email, including the angle brackets.
+	MessageID string
+	// InReplyTo is the In-Reply-To header of the received email, space separated message IDs.
+	InReplyTo string
+	// References is the References header of the received email, space separated message IDs.
+	References string
 	// Mail is target mail (the initial sender of the email) to send the data to when the time comes.
 	Mail string
 	// ScheduledFor holds when the email is supposed to be send back to the user.
@@ -31,28 +72,176 @@ type Entry struct {
 	Period *period.Period `gorm:"-"`
 	// PeriodString is used to save the marshaled period into database.
 	PeriodString *string
+	// Recurrence is optional RFC 5545 recurrence of the entry as DTSTART, RRULE and EXDATE properties, floating
+	// times are in the time zone of the entry. It allows schedules the period can't express, such as the last
+	// working day of the month, and is used instead of the period.
+	Recurrence string
+	// TimeZone is the IANA name of the time zone of the user, or fixed offset such as UTC+05:30 if only the offset
+	// is known, empty for UTC.
+	TimeZone string
+	// LocalTime is the wall-clock time (15:04:05) in the time zone of the user at which the periodic entry
+	// is delivered, it stays the same when the offset of the time zone changes.
+	LocalTime string
+	// CatchUp is the catch-up policy of periodic entry given by the user in the email, empty for the default one.
+	CatchUp string
 	// Fails counts the number of fails sending the email back to the user.
 	Fails uint8
+	// Status is the delivery state of the entry.
+	Status string `gorm:"default:'scheduled'"`
+	// LastError is the reason of the last failed delivery.
+	LastError string
+	// FailingSince is the time of the first failed delivery, nil if the last delivery didn't fail.
+	FailingSince *time.Time
+	// DKIM is the result of DKIM verification of the received email (none, pass or fail).
+	DKIM string
+	// DMARC is the result of DMARC evaluation of the received email (none, pass or fail).
+	DMARC string
+	// DMARCPolicy is the DMARC policy of the author domain of the received email that applied to the email.
+	DMARCPolicy string
+	// OutboundMessageID is the Message-ID of the email delivered for the current occurrence of the entry. It is
+	// assigned before the first delivery attempt and kept for the retries, so that the receivers can recognize
+	// duplicates.
+	OutboundMessageID string
+	// ClaimedBy is the ID of the sender instance that claimed the entry for the delivery.
+	ClaimedBy string
+	// LeaseUntil is the time until the claim of the entry is valid. Entries with expired lease that weren't
+	// delivered can be recovered by other sender instances.
+	LeaseUntil *time.Time
+	// Transport is the name of the transport used to deliver the entry, empty for the default one.
+	Transport string
 }
 
-// NewEntry creates new entry from received data.
-func NewEntry(from, content, title string, r *when.Result) (*Entry, error) {
+// localTimeFormat is the format of the local wall-clock time of the entries.
+const localTimeFormat = "15:04:05"
+
+// NewEntry creates new entry from received data. The time zone of the user is kept so that the occurrences
+// of periodic entries are computed in it.
+func NewEntry(from, content, title string, r *when.Result, loc *time.Location) (*Entry, error) {
 	id, err := gonanoid.Nanoid()
 	if err != nil {
 		return nil, err
 	}
-	scheduledFor := r.Time
+	scheduledFor := r.Time.In(loc)
+	e := &Entry{
+		ID:       id,
+		Data:     content,
+		Mail:     from,
+		Title:    title,
+		Period:   r.Period,
+		Status:   StatusScheduled,
+		TimeZone: loc.String(),
+	}
 	if r.Period != nil {
+		e.LocalTime = scheduledFor.Format(localTimeFormat)
 		scheduledFor, _ = r.Period.AddTo(scheduledFor)
 	}
-	return &Entry{
-		ID:           id,
-		Data:         content,
-		Mail:         from,
-		Title:        title,
-		ScheduledFor: scheduledFor,
-		Period:       r.Period,
-	}, nil
+	e.ScheduledFor = e.atLocalTime(scheduledFor)
+	return e, nil
+}
+
+// ErrNoOccurrence is returned when recurrence of the entry has no occurrence.
+var ErrNoOccurrence = errors.New("recurrence has no occurrence")
+
+// SetRecurrence makes the entry recur according to the recurrence set and schedules it for the first occurrence.
+// The occurrences are computed in the time zone of the start of the recurrence.
+func (e *Entry) SetRecurrence(set *rrule.Set) error {
+	first := set.First()
+	if first.IsZero() {
+		return ErrNoOccurrence
+	}
+	e.Recurrence = set.String()
+	e.TimeZone = set.Start.Location().String()
+	e.Period = nil
+	e.PeriodString = nil
+	e.ScheduledFor = first
+	return nil
+}
+
+// IsPeriodic reports whether the entry recurs, either with period or recurrence.
+func (e *Entry) IsPeriodic() bool {
+	return e.Period != nil || e.Recurrence != ""
+}
+
+// Schedule describes how often the periodic entry recurs, such as "every 1 week" or the recurrence rule.
+func (e *Entry) Schedule() string {
+	if e.Recurrence != "" {
+		set, err := rrule.Parse(e.Recurrence, e.Location())
+		if err != nil {
+			return "invalid recurrence"
+		}
+		return "according to " + set.Rule.String()
+	}
+	if e.Period != nil {
+		return "every " + e.Period.Format()
+	}
+	return ""
+}
+
+// fixedZoneFormat is the format of the names of the time zones with fixed offset.
+const fixedZoneFormat = "UTC-07:00"
+
+// FixedZone returns time zone with fixed offset from UTC in seconds. It is named such as UTC+05:30, so that
+// the entries in it can be restored from the name.
+func FixedZone(offset int) *time.Location {
+	return time.FixedZone(time.Unix(0, 0).In(time.FixedZone("", offset)).Format(fixedZoneFormat), offset)
+}
+
+// Location returns the time zone of the entry, UTC is used if the entry doesn't have one or it is unknown.
+func (e *Entry) Location() *time.Location {
+	if e.TimeZone == "" {
+		return time.UTC
+	}
+	if t, err := time.Parse(fixedZoneFormat, e.TimeZone); err == nil {
+		_, offset := t.Zone()
+		return FixedZone(offset)
+	}
+	loc, err := time.LoadLocation(e.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// atLocalTime moves the occurrence of periodic entry to its intended wall-clock time, as it may have shifted
+// when the previous occurrence didn't exist because of DST transition. Periods with time components, such as
+// every 2 hours, are kept as they are.
+func (e *Entry) atLocalTime(t time.Time) time.Time {
+	if e.LocalTime == "" || e.Period == nil || !e.Period.OnlyHMS().IsZero() {
+		return t
+	}
+	clock, err := time.Parse(localTimeFormat, e.LocalTime)
+	if err != nil {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, t.Location())
+}
+
+// NextOccurrence returns the first occurrence of the periodic entry after given time, counting from the time
+// the entry is scheduled for. The occurrences are computed in the time zone of the entry. Entries without period
+// or recurrence and entries whose recurrence ended have no next occurrence, zero time is returned.
+func (e *Entry) NextOccurrence(after time.Time) time.Time {
+	if e.Recurrence != "" {
+		set, err := rrule.Parse(e.Recurrence, e.Location())
+		if err != nil {
+			return time.Time{}
+		}
+		return set.After(after)
+	}
+	if e.Period == nil {
+		return time.Time{}
+	}
+	// days are added in the time zone of the entry, so that the wall-clock time stays the same across DST
+	next := e.ScheduledFor.In(e.Location())
+	for !next.After(after) {
+		t, _ := e.Period.AddTo(next)
+		t = e.atLocalTime(t)
+		if !t.After(next) {
+			// empty or negative period would never get past the time
+			return time.Time{}
+		}
+		next = t
+	}
+	return next
 }
 
 // BeforeSave converts period to PeriodString in order to save it into database.
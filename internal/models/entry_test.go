@@ -0,0 +1,155 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rickb777/date/period"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matoous/mailback/internal/rrule"
+	"github.com/matoous/mailback/internal/when"
+)
+
+func TestEntry_NextOccurrence(t *testing.T) {
+	day := period.NewYMD(0, 0, 1)
+	empty := period.NewYMD(0, 0, 0)
+	scheduledFor := time.Date(2020, 5, 1, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Name   string
+		Period *period.Period
+		After  time.Time
+		Want   time.Time
+	}{
+		{
+			Name:   "not periodic",
+			Period: nil,
+			After:  scheduledFor,
+		},
+		{
+			Name:   "next occurrence",
+			Period: &day,
+			After:  scheduledFor,
+			Want:   scheduledFor.AddDate(0, 0, 1),
+		},
+		{
+			Name:   "missed occurrences",
+			Period: &day,
+			After:  scheduledFor.AddDate(0, 0, 7).Add(time.Hour),
+			Want:   scheduledFor.AddDate(0, 0, 8),
+		},
+		{
+			Name:   "scheduled in future",
+			Period: &day,
+			After:  scheduledFor.Add(-time.Hour),
+			Want:   scheduledFor,
+		},
+		{
+			Name:   "empty period",
+			Period: &empty,
+			After:  scheduledFor,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			e := &Entry{ScheduledFor: scheduledFor, Period: tt.Period}
+			assert.Equal(t, tt.Want, e.NextOccurrence(tt.After), "should return the first occurrence after the time")
+		})
+	}
+}
+
+func TestEntry_NextOccurrence_DST(t *testing.T) {
+	prague, err := time.LoadLocation("Europe/Prague")
+	require.NoError(t, err)
+	day := period.NewYMD(0, 0, 1)
+	twoHours := period.NewHMS(2, 0, 0)
+
+	tests := []struct {
+		Name         string
+		ScheduledFor time.Time
+		Period       period.Period
+		LocalTime    string
+		Want         time.Time
+	}{
+		{
+			Name:         "daily across spring DST transition",
+			ScheduledFor: time.Date(2020, 3, 28, 9, 0, 0, 0, prague).UTC(),
+			Period:       day,
+			LocalTime:    "09:00:00",
+			Want:         time.Date(2020, 3, 29, 9, 0, 0, 0, prague),
+		},
+		{
+			Name:         "daily across autumn DST transition",
+			ScheduledFor: time.Date(2020, 10, 24, 9, 0, 0, 0, prague).UTC(),
+			Period:       day,
+			LocalTime:    "09:00:00",
+			Want:         time.Date(2020, 10, 25, 9, 0, 0, 0, prague),
+		},
+		{
+			Name: "daily after non-existent local time",
+			// 2:30 doesn't exist on the day of the transition, it was moved to 3:30
+			ScheduledFor: time.Date(2020, 3, 29, 3, 30, 0, 0, prague).UTC(),
+			Period:       day,
+			LocalTime:    "02:30:00",
+			Want:         time.Date(2020, 3, 30, 2, 30, 0, 0, prague),
+		},
+		{
+			Name:         "hours across DST transition",
+			ScheduledFor: time.Date(2020, 3, 29, 1, 0, 0, 0, prague).UTC(),
+			Period:       twoHours,
+			LocalTime:    "01:00:00",
+			Want:         time.Date(2020, 3, 29, 4, 0, 0, 0, prague),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			e := &Entry{ScheduledFor: tt.ScheduledFor, Period: &tt.Period, TimeZone: "Europe/Prague", LocalTime: tt.LocalTime}
+			next := e.NextOccurrence(tt.ScheduledFor)
+			assert.True(t, tt.Want.Equal(next), "should keep the local time, got %s", next.In(prague))
+		})
+	}
+}
+
+func TestNewEntry_TimeZone(t *testing.T) {
+	prague, err := time.LoadLocation("Europe/Prague")
+	require.NoError(t, err)
+	day := period.NewYMD(0, 0, 1)
+
+	e, err := NewEntry("joe@example.com", "Water the plants.", "Plants", &when.Result{
+		Time:   time.Date(2020, 3, 28, 8, 0, 0, 0, time.UTC),
+		Period: &day,
+	}, prague)
+	require.NoError(t, err)
+	assert.Equal(t, "Europe/Prague", e.TimeZone, "should keep the time zone")
+	assert.Equal(t, "09:00:00", e.LocalTime, "should keep the local time")
+	assert.True(t, time.Date(2020, 3, 29, 9, 0, 0, 0, prague).Equal(e.ScheduledFor), "should schedule the entry in the time zone")
+}
+
+func TestEntry_SetRecurrence(t *testing.T) {
+	prague, err := time.LoadLocation("Europe/Prague")
+	require.NoError(t, err)
+	set, err := rrule.Parse("DTSTART:20200101T170000\nRRULE:FREQ=MONTHLY;COUNT=3;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1", prague)
+	require.NoError(t, err)
+	day := period.NewYMD(0, 0, 1)
+
+	e := &Entry{Period: &day}
+	require.NoError(t, e.SetRecurrence(set), "shouldn't fail")
+	assert.True(t, e.IsPeriodic(), "should be periodic")
+	assert.Nil(t, e.Period, "should replace the period")
+	assert.Equal(t, "Europe/Prague", e.TimeZone, "should use the time zone of the recurrence")
+	assert.True(t, time.Date(2020, 1, 31, 17, 0, 0, 0, prague).Equal(e.ScheduledFor), "should schedule the first occurrence")
+	assert.Equal(t, "according to FREQ=MONTHLY;COUNT=3;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1", e.Schedule(), "should describe the schedule")
+
+	next := e.NextOccurrence(e.ScheduledFor)
+	assert.True(t, time.Date(2020, 2, 28, 17, 0, 0, 0, prague).Equal(next), "should return the next occurrence")
+	next = e.NextOccurrence(time.Date(2020, 3, 31, 17, 0, 0, 0, prague))
+	assert.True(t, next.IsZero(), "should end the recurrence after the count")
+
+	never, err := rrule.Parse("DTSTART:20200101T170000\nRRULE:FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30", prague)
+	require.NoError(t, err)
+	assert.Equal(t, ErrNoOccurrence, (&Entry{}).SetRecurrence(never), "should fail for recurrence without occurrence")
+}
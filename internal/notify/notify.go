@@ -0,0 +1,98 @@
+// Package notify wakes up the sender when the receiver stores new entries. The notifications are sent as UDP
+// datagrams, which is enough for processes running on the same host. Notifications can be lost, so the sender
+// must not rely on them and has to check the storage periodically anyway.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// maxNotificationSize limits the size of single notification datagram.
+const maxNotificationSize = 1024
+
+// Notification notifies about entry that is due at given time.
+type Notification struct {
+	ID string    `json:"id"`
+	At time.Time `json:"at"`
+}
+
+// Notifier sends notifications to the sender listening on given address.
+type Notifier struct {
+	conn net.Conn
+}
+
+// NewNotifier creates new notifier sending the notifications to given UDP address.
+func NewNotifier(addr string) (*Notifier, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Notifier{conn: conn}, nil
+}
+
+// Notify notifies the sender about the entry. It doesn't wait for the notification to be received.
+func (n *Notifier) Notify(id string, at time.Time) error {
+	b, err := json.Marshal(&Notification{ID: id, At: at})
+	if err != nil {
+		return err
+	}
+	_, err = n.conn.Write(b)
+	return err
+}
+
+// Close closes the notifier.
+func (n *Notifier) Close() error {
+	return n.conn.Close()
+}
+
+// Listener receives the notifications.
+type Listener struct {
+	conn net.PacketConn
+}
+
+// Listen starts listening for the notifications on given UDP address.
+func Listen(addr string) (*Listener, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{conn: conn}, nil
+}
+
+// Addr returns the address the listener listens on.
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Notifications returns channel of the received notifications. Malformed datagrams are ignored. The channel is
+// closed once the context is canceled or the listener fails.
+func (l *Listener) Notifications(ctx context.Context) <-chan Notification {
+	ch := make(chan Notification)
+	go func() {
+		<-ctx.Done()
+		l.conn.Close()
+	}()
+	go func() {
+		defer close(ch)
+		buf := make([]byte, maxNotificationSize)
+		for {
+			size, _, err := l.conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var n Notification
+			if err := json.Unmarshal(buf[:size], &n); err != nil || n.ID == "" {
+				continue
+			}
+			select {
+			case ch <- n:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,46 @@
+package notify
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notifications := l.Notifications(ctx)
+
+	n, err := NewNotifier(l.Addr().String())
+	require.NoError(t, err)
+	defer n.Close()
+
+	// malformed datagrams are ignored
+	conn, err := net.Dial("udp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("garbage"))
+	require.NoError(t, err)
+
+	at := time.Now().Add(time.Minute).Round(0)
+	require.NoError(t, n.Notify("abc", at))
+	select {
+	case got := <-notifications:
+		assert.Equal(t, "abc", got.ID, "should receive the entry ID")
+		assert.True(t, at.Equal(got.At), "should receive the due time")
+	case <-time.After(5 * time.Second):
+		t.Fatal("should receive the notification")
+	}
+
+	cancel()
+	for range notifications {
+	}
+	_, ok := <-notifications
+	assert.False(t, ok, "should close the channel once canceled")
+}
@@ -0,0 +1,89 @@
+package receiver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+
+	"github.com/DusanKasan/parsemail"
+	"go.uber.org/zap"
+
+	"github.com/matoous/mailback/internal/models"
+)
+
+// defaultContentType is used for attachments that don't specify valid content type.
+const defaultContentType = "application/octet-stream"
+
+// attachment is a file extracted from the received email.
+type attachment struct {
+	filename    string
+	contentType string
+	contentID   string
+	data        []byte
+}
+
+// attachments extracts attached files and inline parts (such as images referenced from the HTML body)
+// of the email.
+func attachments(email *parsemail.Email) ([]attachment, error) {
+	res := make([]attachment, 0, len(email.Attachments)+len(email.EmbeddedFiles))
+	for _, a := range email.Attachments {
+		data, err := ioutil.ReadAll(a.Data)
+		if err != nil {
+			return nil, err
+		}
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = defaultContentType
+		}
+		res = append(res, attachment{
+			filename:    a.Filename,
+			contentType: contentType,
+			data:        data,
+		})
+	}
+	for _, f := range email.EmbeddedFiles {
+		data, err := ioutil.ReadAll(f.Data)
+		if err != nil {
+			return nil, err
+		}
+		contentType, params, err := mime.ParseMediaType(f.ContentType)
+		if err != nil {
+			contentType = defaultContentType
+		}
+		res = append(res, attachment{
+			filename:    params["name"],
+			contentType: contentType,
+			contentID:   f.CID,
+			data:        data,
+		})
+	}
+	return res, nil
+}
+
+// saveAttachments saves the content of the attachments into the blob storage and assigns them to the entry.
+// Every entry gets its own copy so that the entries can be removed independently of each other.
+func (s *Session) saveAttachments(e *models.Entry, atts []attachment) error {
+	for _, a := range atts {
+		att, err := models.NewAttachment(e.ID, a.filename, a.contentType, a.contentID, int64(len(a.data)))
+		if err != nil {
+			return err
+		}
+		if err := s.blobs.Put(att.ID, bytes.NewReader(a.data)); err != nil {
+			return err
+		}
+		e.Attachments = append(e.Attachments, *att)
+	}
+	return nil
+}
+
+// removeAttachments removes content of the attachments of the entries from the blob storage.
+// It is used to clean up when the entries couldn't be saved.
+func (s *Session) removeAttachments(entries []*models.Entry) {
+	for _, e := range entries {
+		for _, a := range e.Attachments {
+			if err := s.blobs.Delete(a.ID); err != nil {
+				s.log.Error("session.attachment.remove", zap.Error(err), zap.String("id", a.ID))
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package receiver
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/caddyserver/certmagic"
@@ -9,30 +10,77 @@ import (
 	"github.com/go-acme/lego/v3/providers/dns/cloudflare"
 	"go.uber.org/zap"
 
+	"github.com/matoous/mailback/internal/blob"
 	"github.com/matoous/mailback/internal/cfg"
-	"github.com/matoous/mailback/internal/models"
+	"github.com/matoous/mailback/internal/mail"
+	"github.com/matoous/mailback/internal/notify"
+	"github.com/matoous/mailback/internal/store"
 )
 
-// Storer can save entries into some kind of storage that allows their retrieval later on.
-type Storer interface {
-	Save(e *models.Entry) error
+// sessionTimeout limits reading and writing of the SMTP commands, the received entries must be saved within it too
+// so that the client doesn't give up on the session while the storage is slow.
+const sessionTimeout = 10 * time.Second
+
+// Notifier notifies the sender about new entries, so that it doesn't have to wait for next check of the storage.
+type Notifier interface {
+	Notify(id string, at time.Time) error
 }
 
 // Receiver implements `smtp.Receiver` and is used to handle all incoming smtp connection.
 // Receiver spawns session for individual requests and handles authorization -
 // in our case accepts only unauthorized requests.
 type Receiver struct {
-	storer Storer
-	log    *zap.Logger
-	srv    *smtp.Server
-	config cfg.ReceiverConfig
+	storer   store.Store
+	blobs    blob.Store
+	log      *zap.Logger
+	srv      *smtp.Server
+	resolver mail.Resolver
+	notifier Notifier
+	location *time.Location
+	// transports maps the domains of the senders to the transports delivering their entries.
+	transports map[string]string
+	config     cfg.ReceiverConfig
 }
 
-// New creates new receiver.
-func New(s Storer, log *zap.Logger, config cfg.ReceiverConfig) (*Receiver, error) {
+// New creates new receiver. Attachments of the received emails are saved into given blob storage.
+func New(s store.Store, blobs blob.Store, log *zap.Logger, config cfg.ReceiverConfig) (*Receiver, error) {
+	switch config.DKIMPolicy {
+	case cfg.PolicyIgnore, cfg.PolicyTag, cfg.PolicyReject:
+	default:
+		return nil, fmt.Errorf("unknown dkim policy: %q", config.DKIMPolicy)
+	}
+	switch config.AlignmentPolicy {
+	case cfg.PolicyIgnore, cfg.PolicyTag, cfg.PolicyReject:
+	default:
+		return nil, fmt.Errorf("unknown alignment policy: %q", config.AlignmentPolicy)
+	}
+
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("time zone: %w", err)
+	}
+
+	transports, err := parseTransports(config.Transports)
+	if err != nil {
+		return nil, fmt.Errorf("transports: %w", err)
+	}
+
 	rc := &Receiver{
-		storer: s,
-		log:    log,
+		storer:     s,
+		blobs:      blobs,
+		log:        log,
+		resolver:   mail.DefaultResolver,
+		location:   location,
+		transports: transports,
+		config:     config,
+	}
+
+	if config.Notify.Addr != "" {
+		notifier, err := notify.NewNotifier(config.Notify.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("notifier: %w", err)
+		}
+		rc.notifier = notifier
 	}
 
 	srv := smtp.NewServer(rc)
@@ -53,8 +101,8 @@ func New(s Storer, log *zap.Logger, config cfg.ReceiverConfig) (*Receiver, error
 
 	srv.Addr = config.Port
 	srv.Domain = config.Host
-	srv.ReadTimeout = 10 * time.Second
-	srv.WriteTimeout = 10 * time.Second
+	srv.ReadTimeout = sessionTimeout
+	srv.WriteTimeout = sessionTimeout
 	srv.MaxMessageBytes = 1024 * 1024
 	srv.MaxRecipients = 16
 	rc.srv = srv
@@ -62,6 +110,24 @@ func New(s Storer, log *zap.Logger, config cfg.ReceiverConfig) (*Receiver, error
 	return rc, nil
 }
 
+// parseTransports parses the domain=transport pairs into map from the domains to the transports.
+func parseTransports(pairs []string) (map[string]string, error) {
+	transports := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid domain=transport pair: %q", pair)
+		}
+		switch parts[1] {
+		case cfg.TransportMX, cfg.TransportRelay, cfg.TransportMaildir, cfg.TransportMbox, cfg.TransportWebhook:
+		default:
+			return nil, fmt.Errorf("unknown transport of %s: %q", parts[0], parts[1])
+		}
+		transports[strings.ToLower(parts[0])] = parts[1]
+	}
+	return transports, nil
+}
+
 // Login implements `smtp.Receiver` interface function `Login` that should be used to authorize the incoming message.
 // In our case authorization is disabled, we do not rely any emails, we just accept the ones for us.
 func (be *Receiver) Login(_ *smtp.ConnectionState, _, _ string) (smtp.Session, error) {
@@ -74,6 +140,11 @@ func (be *Receiver) AnonymousLogin(c *smtp.ConnectionState) (smtp.Session, error
 	return &Session{
 		config:     &be.config,
 		store:      be.storer,
+		blobs:      be.blobs,
+		resolver:   be.resolver,
+		notifier:   be.notifier,
+		location:   be.location,
+		transports: be.transports,
 		hostname:   c.Hostname,
 		remoteAddr: c.RemoteAddr,
 		log:        be.log,
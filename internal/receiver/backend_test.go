@@ -5,6 +5,7 @@ import (
 
 	"github.com/emersion/go-smtp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBackend_Login(t *testing.T) {
@@ -13,3 +14,34 @@ func TestBackend_Login(t *testing.T) {
 	assert.Error(t, err, "should return error")
 	assert.Equal(t, err, smtp.ErrAuthUnsupported, "should return ErrAuthUnsupported")
 }
+
+func TestParseTransports(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Pairs   []string
+		Want    map[string]string
+		WantErr bool
+	}{
+		{Name: "empty", Pairs: nil, Want: map[string]string{}},
+		{
+			Name:  "multiple domains",
+			Pairs: []string{"example.com=relay", "Example.ORG=maildir"},
+			Want:  map[string]string{"example.com": "relay", "example.org": "maildir"},
+		},
+		{Name: "missing transport", Pairs: []string{"example.com"}, WantErr: true},
+		{Name: "missing domain", Pairs: []string{"=relay"}, WantErr: true},
+		{Name: "unknown transport", Pairs: []string{"example.com=pigeon"}, WantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			transports, err := parseTransports(tt.Pairs)
+			if tt.WantErr {
+				assert.Error(t, err, "should refuse the transports")
+				return
+			}
+			require.NoError(t, err, "shouldn't fail")
+			assert.Equal(t, tt.Want, transports, "should map the domains to the transports")
+		})
+	}
+}
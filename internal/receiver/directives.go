@@ -0,0 +1,94 @@
+package receiver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matoous/mailback/internal/models"
+	"github.com/matoous/mailback/internal/rrule"
+)
+
+// Names of the directives, they are matched case-insensitively.
+const (
+	// directiveCatchUp sets the catch-up policy of periodic entry (once, all or skip).
+	directiveCatchUp = "catch-up"
+	// directiveRRule sets RFC 5545 recurrence rule of the entry, such as FREQ=MONTHLY;BYDAY=FR;BYSETPOS=-1.
+	directiveRRule = "rrule"
+	// directiveTimeZone sets the IANA time zone in which the times of the recipients are interpreted.
+	directiveTimeZone = "time-zone"
+)
+
+// directives are options of the entries given by the user on the first lines of the plain text body of the email,
+// such as "Catch-Up: skip". Directive lines are removed from the content that is sent back.
+type directives struct {
+	// CatchUp is the catch-up policy of the entries, empty for the default one of the sender.
+	CatchUp string
+	// RRule is the recurrence rule of the entries, empty if they don't recur according to a rule. The recipient
+	// time is the start of the recurrence.
+	RRule string
+	// TimeZone is the IANA time zone of the user, empty if it isn't given.
+	TimeZone string
+}
+
+// directiveError is returned for directive with invalid value.
+type directiveError struct {
+	name  string
+	value string
+}
+
+func (e *directiveError) Error() string {
+	return fmt.Sprintf("invalid value of %s directive: %q", e.name, e.value)
+}
+
+// parseDirectives parses the directives at the beginning of the body and returns the body without them. Parsing
+// stops at the first line that isn't a known directive, empty line following the directives is removed too.
+func parseDirectives(body string) (directives, string, error) {
+	var d directives
+	rest := body
+	parsed := false
+	for rest != "" {
+		line := rest
+		next := ""
+		if i := strings.IndexByte(rest, '\n'); i >= 0 {
+			line, next = rest[:i], rest[i+1:]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if parsed {
+				rest = next
+			}
+			break
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			break
+		}
+		name, value := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+		switch name {
+		case directiveCatchUp:
+			switch v := strings.ToLower(value); v {
+			case models.CatchUpOnce, models.CatchUpAll, models.CatchUpSkip:
+				d.CatchUp = v
+			default:
+				return d, body, &directiveError{name: parts[0], value: value}
+			}
+		case directiveRRule:
+			// the rule is validated only, UNTIL is interpreted in the time zone of the entry once it is known
+			if _, err := rrule.ParseRule(value, time.UTC); err != nil {
+				return d, body, &directiveError{name: parts[0], value: value}
+			}
+			d.RRule = value
+		case directiveTimeZone:
+			if _, err := time.LoadLocation(value); err != nil || value == "" || value == "Local" {
+				return d, body, &directiveError{name: parts[0], value: value}
+			}
+			d.TimeZone = value
+		default:
+			return d, rest, nil
+		}
+		parsed = true
+		rest = next
+	}
+	return d, rest, nil
+}
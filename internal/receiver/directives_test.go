@@ -0,0 +1,88 @@
+package receiver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matoous/mailback/internal/models"
+)
+
+func TestParseDirectives(t *testing.T) {
+	tests := []struct {
+		Name           string
+		Body           string
+		WantDirectives directives
+		WantBody       string
+		WantErr        bool
+	}{
+		{
+			Name:     "no directives",
+			Body:     "Don't forget the cactus.\r\n",
+			WantBody: "Don't forget the cactus.\r\n",
+		},
+		{
+			Name:           "catch-up policy",
+			Body:           "Catch-Up: skip\r\n\r\nDon't forget the cactus.\r\n",
+			WantDirectives: directives{CatchUp: models.CatchUpSkip},
+			WantBody:       "Don't forget the cactus.\r\n",
+		},
+		{
+			Name:           "case-insensitive",
+			Body:           "catch-up: ALL\nDon't forget the cactus.\n",
+			WantDirectives: directives{CatchUp: models.CatchUpAll},
+			WantBody:       "Don't forget the cactus.\n",
+		},
+		{
+			Name:           "recurrence rule",
+			Body:           "Catch-Up: skip\r\nRRULE: FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1\r\n\r\nPay the rent.\r\n",
+			WantDirectives: directives{CatchUp: models.CatchUpSkip, RRule: "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1"},
+			WantBody:       "Pay the rent.\r\n",
+		},
+		{
+			Name:           "time zone",
+			Body:           "Time-Zone: Europe/Prague\r\nWater the plants.\r\n",
+			WantDirectives: directives{TimeZone: "Europe/Prague"},
+			WantBody:       "Water the plants.\r\n",
+		},
+		{
+			Name:     "unknown directive",
+			Body:     "Note: water only on Sundays\r\n",
+			WantBody: "Note: water only on Sundays\r\n",
+		},
+		{
+			Name:     "directive after the content",
+			Body:     "Don't forget the cactus.\r\nCatch-Up: skip\r\n",
+			WantBody: "Don't forget the cactus.\r\nCatch-Up: skip\r\n",
+		},
+		{
+			Name:    "invalid catch-up policy",
+			Body:    "Catch-Up: sometimes\r\n",
+			WantErr: true,
+		},
+		{
+			Name:    "invalid recurrence rule",
+			Body:    "RRULE: FREQ=SOMETIMES\r\n",
+			WantErr: true,
+		},
+		{
+			Name:    "unknown time zone",
+			Body:    "Time-Zone: Europe/Atlantis\r\n",
+			WantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			d, body, err := parseDirectives(tt.Body)
+			if tt.WantErr {
+				assert.Error(t, err, "should refuse the directive")
+				return
+			}
+			require.NoError(t, err, "shouldn't fail")
+			assert.Equal(t, tt.WantDirectives, d, "should parse the directives")
+			assert.Equal(t, tt.WantBody, body, "should remove the directives from the body")
+		})
+	}
+}
@@ -1,8 +1,12 @@
 package receiver
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strings"
 	"time"
@@ -10,30 +14,66 @@ import (
 
 	"blitiri.com.ar/go/spf"
 	"github.com/DusanKasan/parsemail"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
 	"github.com/emersion/go-smtp"
 	"go.uber.org/zap"
 
+	"github.com/matoous/mailback/internal/blob"
 	"github.com/matoous/mailback/internal/cfg"
 	"github.com/matoous/mailback/internal/mail"
+	"github.com/matoous/mailback/internal/message"
 	"github.com/matoous/mailback/internal/models"
+	"github.com/matoous/mailback/internal/rrule"
+	"github.com/matoous/mailback/internal/store"
 	"github.com/matoous/mailback/internal/when"
 )
 
+// dnsTimeout limits the time spent on DNS lookups during the message authentication.
+const dnsTimeout = 5 * time.Second
+
+// unverifiedTag is prepended to the title of entries created from emails that failed authentication
+// when the receiver is configured to tag them.
+const unverifiedTag = "[unverified] "
+
+// Recipient is single accepted recipient of the email.
+type Recipient struct {
+	// Address is the address the email was sent to.
+	Address string
+	// Target is the part of the address that tells when to send the email back, such as "in 2 days".
+	Target string
+	// TargetTime is the time (and optionally the period) that the email should be scheduled for.
+	TargetTime *when.Result
+	// Admin is true if the email is supposed to be delivered to the owner of the domain
+	// instead of scheduled for delivery.
+	Admin bool
+}
+
 // Session is spawned for each incoming smtp request and handles its lifecycle.
 type Session struct {
-	// TargetTime is the time (and optionally the period) that the email should be scheduled for
-	TargetTime *when.Result
+	// Recipients are all accepted recipients of the email, each of them is scheduled separately.
+	Recipients []Recipient
 	// From is the sender of the email that should receive the email back eventually.
 	From string
 	// Content is the content of the email that will be send back.
 	Content string
+	// HTML is the HTML version of the content, if the email has one.
+	HTML string
 	// Title is the subject of the email that will be used in the reply.
 	Title string
-	// ToUs is true if the email is supposed to be delivered to the owner of the domain
-	// instead of scheduled for delivery.
-	ToUs bool
+	// SPF is the result of the SPF check of the envelope sender.
+	SPF spf.Result
+	// DKIM holds the verification results of the DKIM signatures of the received email.
+	DKIM []*dkim.Verification
+	// DMARC is the verdict of the DMARC evaluation of the received email.
+	DMARC *mail.DMARCVerdict
 
-	store      Storer
+	store      store.Store
+	blobs      blob.Store
+	resolver   mail.Resolver
+	notifier   Notifier
+	location   *time.Location
+	transports map[string]string
 	config     *cfg.ReceiverConfig
 	hostname   string
 	remoteAddr net.Addr
@@ -58,18 +98,118 @@ func (s *Session) SPFCheck(from string) error {
 		s.log.Error(
 			"session.spf_check",
 			zap.Error(err),
-			zap.String("ip", string(ip)),
+			zap.String("ip", ip.String()),
 			zap.String("hostname", s.hostname),
 			zap.String("from", from),
 		)
 		return nil
 	}
+	s.SPF = result
 	if result == spf.Fail {
 		return errors.New("unauthorized")
 	}
 	return nil
 }
 
+// DKIMCheck verifies DKIM signatures of the raw email and applies the configured policy on the result.
+// It returns the summarized result of the verification.
+func (s *Session) DKIMCheck(raw []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	verifications, err := mail.VerifyDKIM(ctx, s.resolver, bytes.NewReader(raw))
+	result := mail.DKIMResult(verifications)
+	if err != nil {
+		// the signatures couldn't be processed at all, e.g. because of malformed header
+		s.log.Error("session.dkim_check", zap.Error(err))
+		result = mail.DKIMFail
+	}
+	s.DKIM = verifications
+	for _, v := range verifications {
+		if v.Err != nil {
+			s.log.Info("session.dkim_check.signature", zap.String("domain", v.Domain), zap.Error(v.Err))
+		}
+	}
+
+	if result == mail.DKIMFail && s.config.DKIMPolicy == cfg.PolicyReject {
+		return result, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 20},
+			Message:      "No passing DKIM signature found",
+		}
+	}
+	return result, nil
+}
+
+// DMARCCheck evaluates DMARC for the received email using the results of previous SPF and DKIM checks and
+// enforces the policy published by the domain of the author of the email.
+func (s *Session) DMARCCheck(email *parsemail.Email) (*mail.DMARCVerdict, error) {
+	if len(email.From) == 0 {
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Missing From header",
+		}
+	}
+	in := &mail.DMARCInput{
+		From:      mail.Host(email.From[0].Address),
+		SPFDomain: mail.Host(s.From),
+		SPFPass:   s.SPF == spf.Pass,
+	}
+	for _, v := range s.DKIM {
+		if v.Err == nil {
+			in.DKIMDomains = append(in.DKIMDomains, v.Domain)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	verdict, err := mail.EvaluateDMARC(ctx, s.resolver, in)
+	switch {
+	case dmarc.IsTempFail(err):
+		s.log.Error("session.dmarc_check", zap.Error(err), zap.String("domain", in.From))
+		return nil, &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+			Message:      "DMARC policy temporarily unavailable",
+		}
+	case err != nil:
+		// malformed policy is treated as if the domain didn't publish any (RFC 7489 section 6.6.3)
+		s.log.Error("session.dmarc_check", zap.Error(err), zap.String("domain", in.From))
+		verdict = &mail.DMARCVerdict{Result: mail.DMARCNone, Policy: dmarc.PolicyNone}
+	}
+	s.DMARC = verdict
+
+	if verdict.Result == mail.DMARCFail && verdict.Policy == dmarc.PolicyReject {
+		return verdict, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Rejected by DMARC policy of " + in.From,
+		}
+	}
+	return verdict, nil
+}
+
+// AlignmentCheck checks that the envelope sender, to which the email is sent back, is aligned with the author
+// of the email. Otherwise the author domain authenticated by DMARC says nothing about the address the email is
+// sent back to. The alignment policy is applied if the domains of the addresses aren't aligned.
+func (s *Session) AlignmentCheck(email *parsemail.Email) (bool, error) {
+	from, sender := mail.Host(email.From[0].Address), mail.Host(s.From)
+	if sender != "" && mail.OrganizationalDomain(sender) == mail.OrganizationalDomain(from) {
+		return true, nil
+	}
+	s.log.Info("session.alignment_check", zap.String("from", from), zap.String("sender", sender))
+	if s.config.AlignmentPolicy == cfg.PolicyReject {
+		return false, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Envelope sender isn't aligned with the From header",
+		}
+	}
+	return false, nil
+}
+
 // Mail handles MAIL command setting the From field for the session.
 func (s *Session) Mail(from string, _ smtp.MailOptions) error {
 	if s.config.Host != "localhost" {
@@ -83,11 +223,12 @@ func (s *Session) Mail(from string, _ smtp.MailOptions) error {
 	return nil
 }
 
-// Rcpt handles the SMTP RCPT command.
+// Rcpt handles the SMTP RCPT command. Each recipient is parsed separately and the ones that can't be parsed
+// are refused without affecting the others.
 func (s *Session) Rcpt(to string) error {
 	target := mail.User(to)
 	if target == "admin" {
-		s.ToUs = true
+		s.Recipients = append(s.Recipients, Recipient{Address: to, Admin: true})
 		return nil
 	}
 	// map symbols to spaces, this allow addresses such as in_2_days@mailback.io
@@ -98,49 +239,199 @@ func (s *Session) Rcpt(to string) error {
 		return r
 	}, target)
 	target = strings.TrimSpace(target)
-	x, err := when.Parse(target, time.Now())
+	x, err := when.Parse(target, time.Now().In(s.location))
 	if err != nil {
 		s.log.Error("session.rcpt.parse", zap.Error(err), zap.String("target", target))
-		return err
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      fmt.Sprintf("Can't tell when to send the email back from %q", to),
+		}
 	}
-	s.TargetTime = x
+	s.Recipients = append(s.Recipients, Recipient{Address: to, Target: target, TargetTime: x})
 	return nil
 }
 
-// Data handles the mail data. It reads the received email, creates entry on our sade and saves it into the database.
+// Data handles the mail data. It reads the received email, creates entry for each of the recipients and saves
+// them into the database at once.
 func (s *Session) Data(r io.Reader) error {
-	email, err := parsemail.Parse(r)
+	// the raw message is needed for the DKIM verification
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		s.log.Error("session.entry.read", zap.Error(err))
+		return err
+	}
+
+	dkimResult, err := s.DKIMCheck(raw)
+	if err != nil {
+		s.log.Error("session.dkim_check", zap.Error(err), zap.String("from", s.From))
+		return err
+	}
+
+	email, err := parsemail.Parse(bytes.NewReader(raw))
 	if err != nil {
 		s.log.Error("session.entry.parse", zap.Error(err))
 		return err
 	}
 
-	s.Content = email.TextBody
-	s.Title = email.Subject
-	// TODO verify the DKIM
+	dmarcVerdict, err := s.DMARCCheck(&email)
+	if err != nil {
+		s.log.Error("session.dmarc_check", zap.Error(err), zap.String("from", s.From))
+		return err
+	}
+
+	aligned, err := s.AlignmentCheck(&email)
+	if err != nil {
+		s.log.Error("session.alignment_check", zap.Error(err), zap.String("from", s.From))
+		return err
+	}
 
-	entry, err := models.NewEntry(s.From, s.Content, s.Title, s.TargetTime)
+	atts, err := attachments(&email)
 	if err != nil {
-		s.log.Error("session.entry.new", zap.Error(err))
+		s.log.Error("session.entry.attachments", zap.Error(err))
 		return err
 	}
 
-	err = s.store.Save(entry)
+	dirs, content, err := parseDirectives(email.TextBody)
+	if err != nil {
+		s.log.Info("session.directives", zap.Error(err), zap.String("from", s.From))
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      fmt.Sprintf("Can't accept the email, %v", err),
+		}
+	}
+
+	s.Content = content
+	s.HTML = email.HTMLBody
+	s.Title = email.Subject
+	quarantine := dmarcVerdict.Result == mail.DMARCFail && dmarcVerdict.Policy == dmarc.PolicyQuarantine
+	unsigned := dkimResult == mail.DKIMFail && s.config.DKIMPolicy == cfg.PolicyTag
+	misaligned := !aligned && s.config.AlignmentPolicy == cfg.PolicyTag
+	if quarantine || unsigned || misaligned {
+		s.Title = unverifiedTag + s.Title
+	}
+
+	loc := s.emailLocation(&email, dirs)
+	var entry *models.Entry
+	entries := make([]*models.Entry, 0, len(s.Recipients))
+	for i := range s.Recipients {
+		rcpt := &s.Recipients[i]
+		if rcpt.Admin {
+			s.log.Info("session.admin", zap.String("from", s.From), zap.String("title", s.Title))
+			continue
+		}
+		if loc != s.location {
+			// the recipients were parsed in the time zone of the receiver before the email was received
+			if rcpt.TargetTime, err = when.Parse(rcpt.Target, time.Now().In(loc)); err != nil {
+				s.log.Error("session.rcpt.parse", zap.Error(err), zap.String("target", rcpt.Target))
+				s.removeAttachments(entries)
+				return err
+			}
+		}
+		entry, err = models.NewEntry(s.From, s.Content, s.Title, rcpt.TargetTime, loc)
+		if err != nil {
+			s.log.Error("session.entry.new", zap.Error(err))
+			return err
+		}
+		if dirs.RRule != "" {
+			if err = s.recur(entry, dirs.RRule, rcpt.TargetTime.Time.In(loc)); err != nil {
+				s.log.Info("session.entry.recurrence", zap.Error(err), zap.String("rrule", dirs.RRule))
+				s.removeAttachments(entries)
+				return &smtp.SMTPError{
+					Code:         554,
+					EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+					Message:      fmt.Sprintf("Can't accept the email, %v", err),
+				}
+			}
+		}
+		entry.HTML = s.HTML
+		entry.CatchUp = dirs.CatchUp
+		entry.Transport = s.transports[strings.ToLower(mail.Host(s.From))]
+		entry.MessageID = message.FormatID(email.MessageID)
+		entry.InReplyTo = strings.Join(message.ParseIDs(strings.Join(email.InReplyTo, " ")), " ")
+		entry.References = strings.Join(message.ParseIDs(strings.Join(email.References, " ")), " ")
+		entry.DKIM = dkimResult
+		entry.DMARC = dmarcVerdict.Result
+		entry.DMARCPolicy = string(dmarcVerdict.Policy)
+		entries = append(entries, entry)
+		err = s.saveAttachments(entry, atts)
+		if err != nil {
+			s.log.Error("session.entry.attachments", zap.Error(err))
+			s.removeAttachments(entries)
+			return err
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTimeout)
+	defer cancel()
+	err = s.store.Save(ctx, entries...)
 	if err != nil {
 		s.log.Error("session.entry.save", zap.Error(err))
+		s.removeAttachments(entries)
 		return err
 	}
 
-	s.log.Info("session.entry.save")
+	s.log.Info("session.entry.save", zap.Int("entries", len(entries)))
+	s.notify(entries)
 	return nil
 }
 
+// emailLocation returns the time zone of the user who sent the email. It is given by the Time-Zone directive,
+// or by the offset of the Date header if the email has one. The time zone of the receiver is used otherwise,
+// and also if it has the same offset as the Date header, as it follows the DST transitions unlike the offset.
+func (s *Session) emailLocation(email *parsemail.Email, dirs directives) *time.Location {
+	if dirs.TimeZone != "" {
+		if loc, err := time.LoadLocation(dirs.TimeZone); err == nil {
+			return loc
+		}
+	}
+	if email.Date.IsZero() {
+		return s.location
+	}
+	_, offset := email.Date.Zone()
+	if _, own := email.Date.In(s.location).Zone(); own == offset {
+		return s.location
+	}
+	return models.FixedZone(offset)
+}
+
+// recur makes the entry recur according to the rule, starting at given time. The rule replaces the period
+// of the recipient, if it has one.
+func (s *Session) recur(entry *models.Entry, rule string, start time.Time) error {
+	r, err := rrule.ParseRule(rule, start.Location())
+	if err != nil {
+		return err
+	}
+	return entry.SetRecurrence(&rrule.Set{Start: start, Rule: r})
+}
+
+// notify notifies the sender about the saved entries. The sender finds the entries eventually even if
+// the notification fails, so the failures are only logged.
+func (s *Session) notify(entries []*models.Entry) {
+	if s.notifier == nil {
+		return
+	}
+	for _, e := range entries {
+		if err := s.notifier.Notify(e.ID, e.ScheduledFor); err != nil {
+			s.log.Warn("session.entry.notify", zap.Error(err), zap.String("id", e.ID))
+		}
+	}
+}
+
 // Reset resets the session to initial state.
 func (s *Session) Reset() {
 	s.Title = ""
 	s.Content = ""
-	s.TargetTime = nil
+	s.HTML = ""
+	s.Recipients = nil
 	s.From = ""
+	s.SPF = ""
+	s.DKIM = nil
+	s.DMARC = nil
 }
 
 // Logout handles SMTP logout command.
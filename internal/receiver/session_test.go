@@ -0,0 +1,538 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/mail"
+	"github.com/matoous/mailback/internal/models"
+	"github.com/matoous/mailback/internal/store"
+)
+
+type stubResolver map[string][]string
+
+func (r stubResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	txts, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return txts, nil
+}
+
+func (r stubResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r stubResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// memoryStore records the saved entries, the session uses only Save of the store.
+type memoryStore struct {
+	store.Store
+	entries []*models.Entry
+}
+
+func (s *memoryStore) Save(_ context.Context, entries ...*models.Entry) error {
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+const testMessage = "From: Joe <joe@example.com>\r\n" +
+	"To: tomorrow@mailback.io\r\n" +
+	"Message-ID: <c@example.com>\r\n" +
+	"In-Reply-To: <b@example.com>\r\n" +
+	"References: <a@example.com> <b@example.com>\r\n" +
+	"Subject: Water the plants\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Don't forget the cactus.\r\n"
+
+func signMessage(t *testing.T, msg string) (string, stubResolver) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	var signed bytes.Buffer
+	err = dkim.Sign(&signed, strings.NewReader(msg), &dkim.SignOptions{
+		Domain:   "example.com",
+		Selector: "test",
+		Signer:   priv,
+	})
+	require.NoError(t, err)
+
+	resolver := stubResolver{
+		"test._domainkey.example.com": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}
+	return signed.String(), resolver
+}
+
+type memoryBlobs map[string][]byte
+
+func (b memoryBlobs) Put(key string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	b[key] = data
+	return err
+}
+
+func (b memoryBlobs) Get(key string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(b[key])), nil
+}
+
+func (b memoryBlobs) Delete(key string) error {
+	delete(b, key)
+	return nil
+}
+
+func newTestSession(policy string, resolver mail.Resolver, db store.Store) *Session {
+	return &Session{
+		config:   &cfg.ReceiverConfig{Host: "localhost", DKIMPolicy: policy, AlignmentPolicy: policy},
+		store:    db,
+		blobs:    memoryBlobs{},
+		resolver: resolver,
+		location: time.UTC,
+		log:      zap.NewNop(),
+	}
+}
+
+func TestSession_Data_DKIM(t *testing.T) {
+	signed, resolver := signMessage(t, testMessage)
+	tampered := strings.Replace(signed, "cactus", "ficus", 1)
+
+	tests := []struct {
+		Name      string
+		Policy    string
+		Message   string
+		WantErr   bool
+		WantDKIM  string
+		WantTitle string
+	}{
+		{
+			Name:      "valid signature",
+			Policy:    cfg.PolicyReject,
+			Message:   signed,
+			WantDKIM:  mail.DKIMPass,
+			WantTitle: "Water the plants",
+		},
+		{
+			Name:      "unsigned email",
+			Policy:    cfg.PolicyReject,
+			Message:   testMessage,
+			WantDKIM:  mail.DKIMNone,
+			WantTitle: "Water the plants",
+		},
+		{
+			Name:    "tampered email rejected",
+			Policy:  cfg.PolicyReject,
+			Message: tampered,
+			WantErr: true,
+		},
+		{
+			Name:      "tampered email tagged",
+			Policy:    cfg.PolicyTag,
+			Message:   tampered,
+			WantDKIM:  mail.DKIMFail,
+			WantTitle: unverifiedTag + "Water the plants",
+		},
+		{
+			Name:      "tampered email ignored",
+			Policy:    cfg.PolicyIgnore,
+			Message:   tampered,
+			WantDKIM:  mail.DKIMFail,
+			WantTitle: "Water the plants",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			store := &memoryStore{}
+			s := newTestSession(tt.Policy, resolver, store)
+			require.NoError(t, s.Mail("joe@example.com", smtp.MailOptions{}))
+			require.NoError(t, s.Rcpt("tomorrow@mailback.io"))
+
+			err := s.Data(strings.NewReader(tt.Message))
+			if tt.WantErr {
+				assert.Error(t, err, "should reject the email")
+				assert.Empty(t, store.entries, "shouldn't save any entry")
+				return
+			}
+			require.NoError(t, err, "should accept the email")
+			require.Len(t, store.entries, 1, "should save the entry")
+			assert.Equal(t, tt.WantDKIM, store.entries[0].DKIM, "should record the DKIM result")
+			assert.Equal(t, tt.WantTitle, store.entries[0].Title, "should set the title")
+		})
+	}
+}
+
+func TestSession_Data_DMARC(t *testing.T) {
+	signed, resolver := signMessage(t, testMessage)
+	tampered := strings.Replace(signed, "cactus", "ficus", 1)
+
+	tests := []struct {
+		Name      string
+		Record    string
+		Message   string
+		WantErr   bool
+		WantDMARC string
+		WantTitle string
+	}{
+		{
+			Name:      "no policy",
+			Message:   testMessage,
+			WantDMARC: mail.DMARCNone,
+			WantTitle: "Water the plants",
+		},
+		{
+			Name:      "aligned signature passes",
+			Record:    "v=DMARC1; p=reject",
+			Message:   signed,
+			WantDMARC: mail.DMARCPass,
+			WantTitle: "Water the plants",
+		},
+		{
+			Name:      "monitoring policy",
+			Record:    "v=DMARC1; p=none",
+			Message:   tampered,
+			WantDMARC: mail.DMARCFail,
+			WantTitle: "Water the plants",
+		},
+		{
+			Name:      "quarantine policy",
+			Record:    "v=DMARC1; p=quarantine",
+			Message:   tampered,
+			WantDMARC: mail.DMARCFail,
+			WantTitle: unverifiedTag + "Water the plants",
+		},
+		{
+			Name:    "reject policy",
+			Record:  "v=DMARC1; p=reject",
+			Message: testMessage,
+			WantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			res := stubResolver{}
+			for k, v := range resolver {
+				res[k] = v
+			}
+			if tt.Record != "" {
+				res["_dmarc.example.com"] = []string{tt.Record}
+			}
+			store := &memoryStore{}
+			s := newTestSession(cfg.PolicyIgnore, res, store)
+			require.NoError(t, s.Mail("joe@example.com", smtp.MailOptions{}))
+			require.NoError(t, s.Rcpt("tomorrow@mailback.io"))
+
+			err := s.Data(strings.NewReader(tt.Message))
+			if tt.WantErr {
+				assert.Error(t, err, "should reject the email")
+				assert.Empty(t, store.entries, "shouldn't save any entry")
+				return
+			}
+			require.NoError(t, err, "should accept the email")
+			require.Len(t, store.entries, 1, "should save the entry")
+			assert.Equal(t, tt.WantDMARC, store.entries[0].DMARC, "should record the DMARC result")
+			assert.Equal(t, tt.WantTitle, store.entries[0].Title, "should set the title")
+		})
+	}
+}
+
+func TestSession_Data_Alignment(t *testing.T) {
+	signed, resolver := signMessage(t, testMessage)
+	resolver["_dmarc.example.com"] = []string{"v=DMARC1; p=reject"}
+
+	tests := []struct {
+		Name      string
+		Policy    string
+		Sender    string
+		WantErr   bool
+		WantTitle string
+	}{
+		{
+			Name:      "aligned sender",
+			Policy:    cfg.PolicyReject,
+			Sender:    "joe@mail.example.com",
+			WantTitle: "Water the plants",
+		},
+		{
+			Name:    "forged sender rejected",
+			Policy:  cfg.PolicyReject,
+			Sender:  "victim@example.org",
+			WantErr: true,
+		},
+		{
+			Name:      "forged sender tagged",
+			Policy:    cfg.PolicyTag,
+			Sender:    "victim@example.org",
+			WantTitle: unverifiedTag + "Water the plants",
+		},
+		{
+			Name:      "forged sender ignored",
+			Policy:    cfg.PolicyIgnore,
+			Sender:    "victim@example.org",
+			WantTitle: "Water the plants",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			store := &memoryStore{}
+			s := newTestSession(cfg.PolicyReject, resolver, store)
+			s.config.AlignmentPolicy = tt.Policy
+			require.NoError(t, s.Mail(tt.Sender, smtp.MailOptions{}))
+			require.NoError(t, s.Rcpt("tomorrow@mailback.io"))
+
+			err := s.Data(strings.NewReader(signed))
+			if tt.WantErr {
+				assert.Error(t, err, "should reject the email")
+				assert.Empty(t, store.entries, "shouldn't save any entry")
+				return
+			}
+			require.NoError(t, err, "should accept the email")
+			require.Len(t, store.entries, 1, "should save the entry")
+			assert.Equal(t, mail.DMARCPass, store.entries[0].DMARC, "should pass DMARC of the author domain")
+			assert.Equal(t, tt.WantTitle, store.entries[0].Title, "should set the title")
+		})
+	}
+}
+
+func TestSession_Rcpt(t *testing.T) {
+	store := &memoryStore{}
+	s := newTestSession(cfg.PolicyIgnore, stubResolver{}, store)
+	require.NoError(t, s.Mail("joe@example.com", smtp.MailOptions{}))
+	assert.NoError(t, s.Rcpt("tomorrow@mailback.io"), "should accept the recipient")
+	assert.NoError(t, s.Rcpt("in+2+days@mailback.io"), "should accept the recipient")
+	assert.NoError(t, s.Rcpt("admin@mailback.io"), "should accept the admin")
+
+	err := s.Rcpt("whenever@mailback.io")
+	require.Error(t, err, "should refuse unknown time")
+	var smtpErr *smtp.SMTPError
+	require.True(t, errors.As(err, &smtpErr), "should return SMTP error")
+	assert.Equal(t, 550, smtpErr.Code, "should refuse the recipient permanently")
+
+	require.NoError(t, s.Data(strings.NewReader(testMessage)))
+	require.Len(t, store.entries, 2, "should schedule entry for each time")
+	assert.NotEqual(t, store.entries[0].ID, store.entries[1].ID, "should create distinct entries")
+	assert.True(t, store.entries[0].ScheduledFor.Before(store.entries[1].ScheduledFor), "should keep the times")
+	for _, e := range store.entries {
+		assert.Equal(t, "<c@example.com>", e.MessageID, "should keep the message ID")
+		assert.Equal(t, "<b@example.com>", e.InReplyTo, "should keep the parent")
+		assert.Equal(t, "<a@example.com> <b@example.com>", e.References, "should keep the references")
+	}
+}
+
+const testMultipartMessage = "From: Joe <joe@example.com>\r\n" +
+	"To: tomorrow@mailback.io\r\n" +
+	"Subject: Trip\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Pack the tickets.\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Pack the <b>tickets</b>.</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"tickets.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQ=\r\n" +
+	"--outer--\r\n"
+
+func TestSession_Data_Attachments(t *testing.T) {
+	store := &memoryStore{}
+	s := newTestSession(cfg.PolicyIgnore, stubResolver{}, store)
+	require.NoError(t, s.Mail("joe@example.com", smtp.MailOptions{}))
+	require.NoError(t, s.Rcpt("tomorrow@mailback.io"))
+	require.NoError(t, s.Data(strings.NewReader(testMultipartMessage)))
+
+	require.Len(t, store.entries, 1, "should save the entry")
+	e := store.entries[0]
+	assert.Equal(t, "Pack the tickets.", e.Data, "should keep the text body")
+	assert.Equal(t, "<p>Pack the <b>tickets</b>.</p>", e.HTML, "should keep the HTML body")
+	require.Len(t, e.Attachments, 1, "should keep the attachment")
+	assert.Equal(t, "tickets.pdf", e.Attachments[0].Filename, "should keep the filename")
+	assert.Equal(t, "application/pdf", e.Attachments[0].ContentType, "should keep the content type")
+	assert.Equal(t, []byte("%PDF-1.4"), s.blobs.(memoryBlobs)[e.Attachments[0].ID], "should store the content")
+}
+
+// notifications records the notifications of the sender.
+type notifications map[string]time.Time
+
+func (n notifications) Notify(id string, at time.Time) error {
+	n[id] = at
+	return nil
+}
+
+func TestSession_Data_Notify(t *testing.T) {
+	store := &memoryStore{}
+	notified := notifications{}
+	s := newTestSession(cfg.PolicyIgnore, stubResolver{}, store)
+	s.notifier = notified
+	require.NoError(t, s.Mail("joe@example.com", smtp.MailOptions{}))
+	require.NoError(t, s.Rcpt("tomorrow@mailback.io"))
+	require.NoError(t, s.Rcpt("in+2+days@mailback.io"))
+	require.NoError(t, s.Data(strings.NewReader(testMessage)))
+
+	require.Len(t, store.entries, 2, "should save the entries")
+	assert.Len(t, notified, 2, "should notify the sender about all entries")
+	for _, e := range store.entries {
+		assert.Equal(t, e.ScheduledFor, notified[e.ID], "should notify when the entry is due")
+	}
+}
+
+func TestSession_Data_Transport(t *testing.T) {
+	tests := []struct {
+		Name          string
+		From          string
+		WantTransport string
+	}{
+		{Name: "mapped domain", From: "joe@example.com", WantTransport: "relay"},
+		{Name: "mapped domain in upper case", From: "joe@EXAMPLE.com", WantTransport: "relay"},
+		{Name: "subdomain", From: "joe@mail.example.com", WantTransport: ""},
+		{Name: "other domain", From: "joe@example.org", WantTransport: ""},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			store := &memoryStore{}
+			s := newTestSession(cfg.PolicyIgnore, stubResolver{}, store)
+			s.transports = map[string]string{"example.com": "relay"}
+			require.NoError(t, s.Mail(tt.From, smtp.MailOptions{}))
+			require.NoError(t, s.Rcpt("tomorrow@mailback.io"))
+			require.NoError(t, s.Data(strings.NewReader(testMessage)))
+
+			require.Len(t, store.entries, 1, "should save the entry")
+			assert.Equal(t, tt.WantTransport, store.entries[0].Transport, "should choose the transport of the sender")
+		})
+	}
+}
+
+// directivesMessage is testMessage with directives at the beginning of the body.
+func directivesMessage(directives string) string {
+	return strings.Replace(testMessage, "\r\n\r\n", "\r\n\r\n"+directives+"\r\n", 1)
+}
+
+func TestSession_Data_CatchUp(t *testing.T) {
+	store := &memoryStore{}
+	s := newTestSession(cfg.PolicyIgnore, stubResolver{}, store)
+	require.NoError(t, s.Mail("joe@example.com", smtp.MailOptions{}))
+	require.NoError(t, s.Rcpt("daily@mailback.io"))
+	require.NoError(t, s.Data(strings.NewReader(directivesMessage("Catch-Up: skip"))))
+
+	require.Len(t, store.entries, 1, "should save the entry")
+	assert.Equal(t, models.CatchUpSkip, store.entries[0].CatchUp, "should set the catch-up policy of the entry")
+	assert.Equal(t, "Don't forget the cactus.", strings.TrimSpace(store.entries[0].Data), "should remove the directives")
+
+	s.Reset()
+	require.NoError(t, s.Mail("joe@example.com", smtp.MailOptions{}))
+	require.NoError(t, s.Rcpt("daily@mailback.io"))
+	err := s.Data(strings.NewReader(directivesMessage("Catch-Up: sometimes")))
+	var smtpErr *smtp.SMTPError
+	require.True(t, errors.As(err, &smtpErr), "should refuse invalid directive")
+	assert.Equal(t, 554, smtpErr.Code, "should refuse the email permanently")
+	assert.Len(t, store.entries, 1, "shouldn't save the entry")
+}
+
+func TestSession_Data_Recurrence(t *testing.T) {
+	store := &memoryStore{}
+	s := newTestSession(cfg.PolicyIgnore, stubResolver{}, store)
+	require.NoError(t, s.Mail("joe@example.com", smtp.MailOptions{}))
+	require.NoError(t, s.Rcpt("daily@mailback.io"))
+	start := s.Recipients[0].TargetTime.Time
+	require.NoError(t, s.Data(strings.NewReader(directivesMessage("RRULE: FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1"))))
+
+	require.Len(t, store.entries, 1, "should save the entry")
+	entry := store.entries[0]
+	assert.True(t, entry.IsPeriodic(), "should make the entry periodic")
+	assert.Nil(t, entry.Period, "should replace the period of the recipient")
+	assert.Equal(t, "according to FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1", entry.Schedule(), "should recur according to the rule")
+	assert.False(t, entry.ScheduledFor.Before(start), "should start the recurrence at the recipient time")
+	assert.NotEqual(t, time.Saturday, entry.ScheduledFor.Weekday(), "should schedule the first occurrence")
+	assert.NotEqual(t, time.Sunday, entry.ScheduledFor.Weekday(), "should schedule the first occurrence")
+	assert.Equal(t, "Don't forget the cactus.", strings.TrimSpace(entry.Data), "should remove the directives")
+
+	s.Reset()
+	require.NoError(t, s.Mail("joe@example.com", smtp.MailOptions{}))
+	require.NoError(t, s.Rcpt("daily@mailback.io"))
+	err := s.Data(strings.NewReader(directivesMessage("RRULE: FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30")))
+	var smtpErr *smtp.SMTPError
+	require.True(t, errors.As(err, &smtpErr), "should refuse recurrence without occurrence")
+	assert.Equal(t, 554, smtpErr.Code, "should refuse the email permanently")
+	assert.Len(t, store.entries, 1, "shouldn't save the entry")
+}
+
+func TestSession_Data_TimeZone(t *testing.T) {
+	tests := []struct {
+		Name         string
+		Message      string
+		WantTimeZone string
+	}{
+		{
+			Name:         "receiver time zone",
+			Message:      testMessage,
+			WantTimeZone: "UTC",
+		},
+		{
+			Name:         "time zone directive",
+			Message:      directivesMessage("Time-Zone: Europe/Prague"),
+			WantTimeZone: "Europe/Prague",
+		},
+		{
+			Name:         "offset of the date",
+			Message:      "Date: Mon, 02 Mar 2020 09:00:00 +0530\r\n" + testMessage,
+			WantTimeZone: "UTC+05:30",
+		},
+		{
+			Name:         "date in the receiver time zone",
+			Message:      "Date: Mon, 02 Mar 2020 09:00:00 +0000\r\n" + testMessage,
+			WantTimeZone: "UTC",
+		},
+		{
+			Name:         "directive takes precedence over the date",
+			Message:      "Date: Mon, 02 Mar 2020 09:00:00 +0530\r\n" + directivesMessage("Time-Zone: Europe/Prague"),
+			WantTimeZone: "Europe/Prague",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			store := &memoryStore{}
+			s := newTestSession(cfg.PolicyIgnore, stubResolver{}, store)
+			require.NoError(t, s.Mail("joe@example.com", smtp.MailOptions{}))
+			require.NoError(t, s.Rcpt("tomorrow+at+9am@mailback.io"))
+			require.NoError(t, s.Data(strings.NewReader(tt.Message)))
+
+			require.Len(t, store.entries, 1, "should save the entry")
+			entry := store.entries[0]
+			assert.Equal(t, tt.WantTimeZone, entry.TimeZone, "should keep the time zone of the user")
+			local := entry.ScheduledFor.In(entry.Location())
+			assert.Equal(t, "09:00", local.Format("15:04"), "should interpret the recipient in the time zone of the user")
+		})
+	}
+}
@@ -0,0 +1,296 @@
+// Package rrule implements recurrence rules (RRULE) and recurrence sets of RFC 5545. Only the rule parts
+// needed for periodic entries with daily and coarser frequency are supported, that is FREQ, INTERVAL, COUNT,
+// UNTIL, BYMONTH, BYMONTHDAY, BYDAY and BYSETPOS. The occurrences are computed in the time zone of the start
+// of the recurrence, so their wall-clock time stays the same across DST transitions.
+package rrule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frequency is the frequency of the recurrence rule.
+type Frequency int
+
+// Supported frequencies of the recurrence rules.
+const (
+	// Daily rules recur every day.
+	Daily Frequency = iota + 1
+	// Weekly rules recur every week, the weeks start on Monday.
+	Weekly
+	// Monthly rules recur every month.
+	Monthly
+	// Yearly rules recur every year.
+	Yearly
+)
+
+var frequencies = map[string]Frequency{
+	"DAILY":   Daily,
+	"WEEKLY":  Weekly,
+	"MONTHLY": Monthly,
+	"YEARLY":  Yearly,
+}
+
+// String returns the frequency as used in the FREQ rule part.
+func (f Frequency) String() string {
+	for name, freq := range frequencies {
+		if freq == f {
+			return name
+		}
+	}
+	return strconv.Itoa(int(f))
+}
+
+// weekdays are the names of the days of week used in the BYDAY rule part, indexed by time.Weekday.
+var weekdays = [...]string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// Weekday is day of week of the BYDAY rule part. N is the ordinal of the day within the month or year, such
+// as 2 for the second Tuesday or -1 for the last Friday, 0 matches all such days.
+type Weekday struct {
+	Weekday time.Weekday
+	N       int
+}
+
+// String returns the weekday as used in the BYDAY rule part.
+func (w Weekday) String() string {
+	if w.N == 0 {
+		return weekdays[w.Weekday]
+	}
+	return strconv.Itoa(w.N) + weekdays[w.Weekday]
+}
+
+// Rule is recurrence rule. The BYxxx rule parts limit the days of the periods given by the frequency, when none
+// of BYMONTHDAY and BYDAY is set the day of the start of the recurrence is used.
+type Rule struct {
+	// Freq is the frequency of the rule.
+	Freq Frequency
+	// Interval is the number of periods between the occurrences, such as 2 for every other week.
+	Interval int
+	// Count limits the number of the occurrences, 0 for unlimited.
+	Count int
+	// Until is the time of the last possible occurrence, zero for unlimited.
+	Until time.Time
+	// ByMonth limits the occurrences to given months.
+	ByMonth []time.Month
+	// ByMonthDay limits the occurrences to given days of month, negative days count from the end of the month.
+	ByMonthDay []int
+	// ByDay limits the occurrences to given days of week.
+	ByDay []Weekday
+	// BySetPos selects the occurrences within the period by their position, such as -1 for the last one.
+	BySetPos []int
+}
+
+// ParseRule parses the value of RRULE property, such as FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1 for
+// the last working day of the month. Floating UNTIL is interpreted in given time zone.
+func ParseRule(s string, loc *time.Location) (*Rule, error) {
+	r := &Rule{Interval: 1}
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid rule part %q", part)
+		}
+		if err := r.parsePart(strings.ToUpper(kv[0]), strings.ToUpper(kv[1]), loc); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", kv[0], kv[1], err)
+		}
+	}
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// parsePart parses single part of the rule.
+func (r *Rule) parsePart(name, value string, loc *time.Location) (err error) {
+	switch name {
+	case "FREQ":
+		freq, ok := frequencies[value]
+		if !ok {
+			return fmt.Errorf("unsupported frequency")
+		}
+		r.Freq = freq
+	case "INTERVAL":
+		r.Interval, err = parseInt(value, 1, 1<<16)
+	case "COUNT":
+		r.Count, err = parseInt(value, 1, 1<<16)
+	case "UNTIL":
+		r.Until, err = parseTime(value, loc)
+		if err == nil && len(value) == len(dateFormat) {
+			// date value includes the whole day
+			r.Until = r.Until.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+	case "BYMONTH":
+		err = parseList(value, func(s string) error {
+			m, err := parseInt(s, 1, 12)
+			r.ByMonth = append(r.ByMonth, time.Month(m))
+			return err
+		})
+	case "BYMONTHDAY":
+		err = parseList(value, func(s string) error {
+			d, err := parseOrdinal(s, 31)
+			r.ByMonthDay = append(r.ByMonthDay, d)
+			return err
+		})
+	case "BYDAY":
+		err = parseList(value, func(s string) error {
+			w, err := parseWeekday(s)
+			r.ByDay = append(r.ByDay, w)
+			return err
+		})
+	case "BYSETPOS":
+		err = parseList(value, func(s string) error {
+			p, err := parseOrdinal(s, 366)
+			r.BySetPos = append(r.BySetPos, p)
+			return err
+		})
+	case "WKST":
+		if value != "MO" {
+			return fmt.Errorf("only weeks starting on Monday are supported")
+		}
+	default:
+		return fmt.Errorf("unsupported rule part")
+	}
+	return err
+}
+
+// validate checks the combination of the rule parts.
+func (r *Rule) validate() error {
+	if r.Freq == 0 {
+		return fmt.Errorf("missing FREQ")
+	}
+	if r.Count != 0 && !r.Until.IsZero() {
+		return fmt.Errorf("COUNT and UNTIL can't be used together")
+	}
+	if len(r.BySetPos) > 0 && len(r.ByMonth)+len(r.ByMonthDay)+len(r.ByDay) == 0 {
+		return fmt.Errorf("BYSETPOS requires other BYxxx rule part")
+	}
+	for _, w := range r.ByDay {
+		if w.N != 0 && r.Freq != Monthly && r.Freq != Yearly {
+			return fmt.Errorf("BYDAY with ordinal requires MONTHLY or YEARLY frequency")
+		}
+	}
+	return nil
+}
+
+// String returns the rule as value of the RRULE property.
+func (r *Rule) String() string {
+	parts := []string{"FREQ=" + r.Freq.String()}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format(utcFormat))
+	}
+	if len(r.ByMonth) > 0 {
+		months := make([]string, len(r.ByMonth))
+		for i, m := range r.ByMonth {
+			months[i] = strconv.Itoa(int(m))
+		}
+		parts = append(parts, "BYMONTH="+strings.Join(months, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		parts = append(parts, "BYMONTHDAY="+joinInts(r.ByMonthDay))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, w := range r.ByDay {
+			days[i] = w.String()
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.BySetPos) > 0 {
+		parts = append(parts, "BYSETPOS="+joinInts(r.BySetPos))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Formats of the date and date-time values.
+const (
+	dateFormat     = "20060102"
+	floatingFormat = "20060102T150405"
+	utcFormat      = "20060102T150405Z"
+)
+
+// parseTime parses date or date-time value, values without the UTC designator are interpreted in given time zone.
+func parseTime(s string, loc *time.Location) (time.Time, error) {
+	switch len(s) {
+	case len(dateFormat):
+		return time.ParseInLocation(dateFormat, s, loc)
+	case len(utcFormat):
+		return time.Parse(utcFormat, s)
+	default:
+		return time.ParseInLocation(floatingFormat, s, loc)
+	}
+}
+
+// parseList calls parse for each of the comma separated values.
+func parseList(s string, parse func(string) error) error {
+	for _, v := range strings.Split(s, ",") {
+		if err := parse(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseInt parses integer in given range.
+func parseInt(s string, min, max int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("out of range")
+	}
+	return n, nil
+}
+
+// parseOrdinal parses non-zero integer in range from -max to max.
+func parseOrdinal(s string, max int) (int, error) {
+	n, err := parseInt(s, -max, max)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("out of range")
+	}
+	return n, nil
+}
+
+// parseWeekday parses day of week with optional ordinal, such as MO, 2TU or -1FR.
+func parseWeekday(s string) (Weekday, error) {
+	if len(s) < 2 {
+		return Weekday{}, fmt.Errorf("invalid day %q", s)
+	}
+	name, ordinal := s[len(s)-2:], s[:len(s)-2]
+	w := Weekday{Weekday: -1}
+	for i, day := range weekdays {
+		if day == name {
+			w.Weekday = time.Weekday(i)
+		}
+	}
+	if w.Weekday < 0 {
+		return Weekday{}, fmt.Errorf("invalid day %q", s)
+	}
+	if ordinal != "" {
+		n, err := parseOrdinal(strings.TrimPrefix(ordinal, "+"), 53)
+		if err != nil {
+			return Weekday{}, err
+		}
+		w.N = n
+	}
+	return w, nil
+}
+
+// joinInts joins the integers with commas.
+func joinInts(ns []int) string {
+	s := make([]string, len(ns))
+	for i, n := range ns {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,207 @@
+package rrule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Rule  string
+		Want  string
+		Error bool
+	}{
+		{Name: "daily", Rule: "FREQ=DAILY", Want: "FREQ=DAILY"},
+		{Name: "lowercase", Rule: "freq=weekly;interval=2;byday=tu", Want: "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU"},
+		{
+			Name: "all parts",
+			Rule: "FREQ=YEARLY;COUNT=3;BYMONTH=1,6;BYMONTHDAY=1,-1;BYDAY=+1MO,-1FR;BYSETPOS=1,-1;WKST=MO",
+			Want: "FREQ=YEARLY;COUNT=3;BYMONTH=1,6;BYMONTHDAY=1,-1;BYDAY=1MO,-1FR;BYSETPOS=1,-1",
+		},
+		{Name: "until", Rule: "FREQ=DAILY;UNTIL=20200301T120000Z", Want: "FREQ=DAILY;UNTIL=20200301T120000Z"},
+		{Name: "until date", Rule: "FREQ=DAILY;UNTIL=20200301", Want: "FREQ=DAILY;UNTIL=20200301T235959Z"},
+		{Name: "missing frequency", Rule: "INTERVAL=2", Error: true},
+		{Name: "unsupported frequency", Rule: "FREQ=HOURLY", Error: true},
+		{Name: "unsupported part", Rule: "FREQ=DAILY;BYHOUR=9", Error: true},
+		{Name: "invalid part", Rule: "FREQ=DAILY;COUNT", Error: true},
+		{Name: "count and until", Rule: "FREQ=DAILY;COUNT=2;UNTIL=20200301", Error: true},
+		{Name: "zero interval", Rule: "FREQ=DAILY;INTERVAL=0", Error: true},
+		{Name: "zero month day", Rule: "FREQ=MONTHLY;BYMONTHDAY=0", Error: true},
+		{Name: "invalid day", Rule: "FREQ=WEEKLY;BYDAY=XX", Error: true},
+		{Name: "ordinal day in weekly rule", Rule: "FREQ=WEEKLY;BYDAY=2TU", Error: true},
+		{Name: "lone set position", Rule: "FREQ=MONTHLY;BYSETPOS=1", Error: true},
+		{Name: "week starting on Sunday", Rule: "FREQ=WEEKLY;WKST=SU", Error: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			r, err := ParseRule(tt.Rule, time.UTC)
+			if tt.Error {
+				assert.Error(t, err, "should fail")
+				return
+			}
+			require.NoError(t, err, "shouldn't fail")
+			assert.Equal(t, tt.Want, r.String(), "should format the rule")
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	prague, err := time.LoadLocation("Europe/Prague")
+	require.NoError(t, err)
+
+	set, err := Parse("DTSTART:20200101T090000\r\nRRULE:FREQ=MONTHLY;BYDAY=2TU\r\nEXDATE:20200211T090000,20200310T090000\r\n", prague)
+	require.NoError(t, err, "shouldn't fail")
+	assert.True(t, time.Date(2020, 1, 1, 9, 0, 0, 0, prague).Equal(set.Start), "should parse the start in the time zone")
+	assert.Equal(t, "FREQ=MONTHLY;BYDAY=2TU", set.Rule.String(), "should parse the rule")
+	assert.Len(t, set.ExDates, 2, "should parse the excluded dates")
+	assert.Equal(t, "DTSTART:20200101T090000\nRRULE:FREQ=MONTHLY;BYDAY=2TU\nEXDATE:20200211T090000,20200310T090000",
+		set.String(), "should format the set")
+
+	set, err = Parse("DTSTART;TZID=America/New_York:20200101T090000\nRRULE:FREQ=DAILY", prague)
+	require.NoError(t, err, "shouldn't fail")
+	assert.Equal(t, "America/New_York", set.Start.Location().String(), "should use the time zone of the property")
+
+	for _, s := range []string{
+		"RRULE:FREQ=DAILY",
+		"DTSTART:20200101T090000",
+		"DTSTART:2020\nRRULE:FREQ=DAILY",
+		"DTSTART:20200101T090000\nRRULE:FREQ=SECONDLY",
+		"DTSTART:20200101T090000\nRRULE:FREQ=DAILY\nRDATE:20200102T090000",
+		"DTSTART;TZID=Nowhere/Nothing:20200101T090000\nRRULE:FREQ=DAILY",
+		"garbage",
+	} {
+		_, err := Parse(s, prague)
+		assert.Error(t, err, "should fail to parse %q", s)
+	}
+}
+
+func TestSet_After(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Set   string
+		After string
+		Want  []string
+		Ends  bool
+	}{
+		{
+			Name: "daily",
+			Set:  "DTSTART:20200101T090000\nRRULE:FREQ=DAILY",
+			Want: []string{"20200101T090000", "20200102T090000", "20200103T090000"},
+		},
+		{
+			Name: "every other Tuesday",
+			Set:  "DTSTART:20200101T090000\nRRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=TU",
+			Want: []string{"20200114T090000", "20200128T090000", "20200211T090000"},
+		},
+		{
+			Name: "every second Tuesday of the month",
+			Set:  "DTSTART:20200101T090000\nRRULE:FREQ=MONTHLY;BYDAY=2TU",
+			Want: []string{"20200114T090000", "20200211T090000", "20200310T090000"},
+		},
+		{
+			Name: "last working day of the month",
+			Set:  "DTSTART:20200101T170000\nRRULE:FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1",
+			Want: []string{"20200131T170000", "20200228T170000", "20200331T170000", "20200430T170000", "20200529T170000"},
+		},
+		{
+			Name: "last day of the month",
+			Set:  "DTSTART:20200101T090000\nRRULE:FREQ=MONTHLY;BYMONTHDAY=-1",
+			Want: []string{"20200131T090000", "20200229T090000", "20200331T090000"},
+		},
+		{
+			Name: "monthly on 31st skips shorter months",
+			Set:  "DTSTART:20200131T090000\nRRULE:FREQ=MONTHLY",
+			Want: []string{"20200131T090000", "20200331T090000", "20200531T090000"},
+		},
+		{
+			Name: "Friday the 13th",
+			Set:  "DTSTART:20200101T090000\nRRULE:FREQ=MONTHLY;BYDAY=FR;BYMONTHDAY=13",
+			Want: []string{"20200313T090000", "20201113T090000", "20210813T090000"},
+		},
+		{
+			Name: "yearly on leap day",
+			Set:  "DTSTART:20200229T090000\nRRULE:FREQ=YEARLY",
+			Want: []string{"20200229T090000", "20240229T090000", "20280229T090000"},
+		},
+		{
+			Name: "last Friday of the year",
+			Set:  "DTSTART:20200101T090000\nRRULE:FREQ=YEARLY;BYDAY=-1FR",
+			Want: []string{"20201225T090000", "20211231T090000", "20221230T090000"},
+		},
+		{
+			Name: "first Monday of quarter",
+			Set:  "DTSTART:20200101T090000\nRRULE:FREQ=YEARLY;BYMONTH=1,4,7,10;BYDAY=1MO",
+			Want: []string{"20200106T090000", "20200406T090000", "20200706T090000", "20201005T090000"},
+		},
+		{
+			Name: "count",
+			Set:  "DTSTART:20200101T090000\nRRULE:FREQ=WEEKLY;COUNT=2",
+			Want: []string{"20200101T090000", "20200108T090000"},
+			Ends: true,
+		},
+		{
+			Name: "count includes excluded dates",
+			Set:  "DTSTART:20200101T090000\nRRULE:FREQ=DAILY;COUNT=3\nEXDATE:20200102T090000",
+			Want: []string{"20200101T090000", "20200103T090000"},
+			Ends: true,
+		},
+		{
+			Name: "until",
+			Set:  "DTSTART:20200101T090000\nRRULE:FREQ=DAILY;UNTIL=20200103",
+			Want: []string{"20200101T090000", "20200102T090000", "20200103T090000"},
+			Ends: true,
+		},
+		{
+			Name:  "after given time",
+			Set:   "DTSTART:20200101T090000\nRRULE:FREQ=MONTHLY;BYDAY=2TU",
+			After: "20250101T000000",
+			Want:  []string{"20250114T090000", "20250211T090000"},
+		},
+		{
+			Name: "never",
+			Set:  "DTSTART:20200101T090000\nRRULE:FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30",
+		},
+	}
+	prague, err := time.LoadLocation("Europe/Prague")
+	require.NoError(t, err)
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			set, err := Parse(tt.Set, prague)
+			require.NoError(t, err)
+			after := set.Start.Add(-time.Nanosecond)
+			if tt.After != "" {
+				after, err = time.ParseInLocation(floatingFormat, tt.After, prague)
+				require.NoError(t, err)
+			}
+			var got []string
+			for next := set.After(after); !next.IsZero() && len(got) < len(tt.Want); next = set.After(next) {
+				got = append(got, next.In(prague).Format(floatingFormat))
+			}
+			assert.Equal(t, tt.Want, got, "should return the occurrences")
+			if tt.Ends {
+				last, err := time.ParseInLocation(floatingFormat, tt.Want[len(tt.Want)-1], prague)
+				require.NoError(t, err)
+				assert.True(t, set.After(last).IsZero(), "should end the recurrence")
+			}
+		})
+	}
+}
+
+func TestSet_After_DST(t *testing.T) {
+	prague, err := time.LoadLocation("Europe/Prague")
+	require.NoError(t, err)
+	set, err := Parse("DTSTART:20200327T023000\nRRULE:FREQ=DAILY", prague)
+	require.NoError(t, err)
+
+	next := set.After(time.Date(2020, 3, 28, 12, 0, 0, 0, prague))
+	// 2:30 doesn't exist on the day of the transition
+	assert.True(t, time.Date(2020, 3, 29, 3, 30, 0, 0, prague).Equal(next), "should move the occurrence past the gap")
+	next = set.After(next)
+	assert.True(t, time.Date(2020, 3, 30, 2, 30, 0, 0, prague).Equal(next), "should keep the wall-clock time")
+}
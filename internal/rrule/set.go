@@ -0,0 +1,312 @@
+package rrule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxPeriods limits the number of periods searched for the next occurrence. Rules that can never match, such as
+// every 30th of February, would be searched forever otherwise.
+const maxPeriods = 10000
+
+// Set is recurrence set, the occurrences of the rule counted from the start, without the excluded dates.
+type Set struct {
+	// Start is the first occurrence of the recurrence, it gives the time of day of all the occurrences and its
+	// time zone is used to compute them.
+	Start time.Time
+	// Rule is the recurrence rule.
+	Rule *Rule
+	// ExDates are the excluded occurrences.
+	ExDates []time.Time
+}
+
+// Parse parses recurrence set given as DTSTART, RRULE and EXDATE properties on separate lines, such as:
+//
+//	DTSTART:20200101T090000
+//	RRULE:FREQ=MONTHLY;BYDAY=2TU
+//	EXDATE:20200211T090000
+//
+// Floating times are interpreted in given time zone, unless the property has TZID parameter.
+func Parse(s string, loc *time.Location) (*Set, error) {
+	set := &Set{}
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid property %q", line)
+		}
+		params := strings.Split(line[:i], ";")
+		name, value := strings.ToUpper(params[0]), line[i+1:]
+		tz, err := location(params[1:], loc)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "DTSTART":
+			if set.Start, err = parseTime(value, tz); err != nil {
+				return nil, fmt.Errorf("invalid DTSTART %q: %w", value, err)
+			}
+		case "RRULE":
+			if set.Rule, err = ParseRule(value, tz); err != nil {
+				return nil, err
+			}
+		case "EXDATE":
+			err = parseList(value, func(v string) error {
+				t, err := parseTime(v, tz)
+				set.ExDates = append(set.ExDates, t)
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXDATE %q: %w", value, err)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported property %s", name)
+		}
+	}
+	if set.Start.IsZero() {
+		return nil, fmt.Errorf("missing DTSTART")
+	}
+	if set.Rule == nil {
+		return nil, fmt.Errorf("missing RRULE")
+	}
+	return set, nil
+}
+
+// location returns the time zone given by TZID parameter of the property, or the default one.
+func location(params []string, loc *time.Location) (*time.Location, error) {
+	for _, p := range params {
+		if kv := strings.SplitN(p, "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "TZID") {
+			return time.LoadLocation(kv[1])
+		}
+	}
+	return loc, nil
+}
+
+// String returns the recurrence set as DTSTART, RRULE and EXDATE properties, the times are floating times in
+// the time zone of the start.
+func (s *Set) String() string {
+	loc := s.Start.Location()
+	lines := []string{
+		"DTSTART:" + s.Start.Format(floatingFormat),
+		"RRULE:" + s.Rule.String(),
+	}
+	if len(s.ExDates) > 0 {
+		dates := make([]string, len(s.ExDates))
+		for i, t := range s.ExDates {
+			dates[i] = t.In(loc).Format(floatingFormat)
+		}
+		lines = append(lines, "EXDATE:"+strings.Join(dates, ","))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// First returns the first occurrence of the recurrence, zero time if there is none.
+func (s *Set) First() time.Time {
+	return s.After(s.Start.Add(-time.Nanosecond))
+}
+
+// After returns the first occurrence after given time, zero time if there is none.
+func (s *Set) After(t time.Time) time.Time {
+	r := s.Rule
+	loc := s.Start.Location()
+	start := civil(s.Start)
+	first := r.firstPeriod(start)
+	k := 0
+	if r.Count == 0 {
+		// the periods before the time can be skipped unless the occurrences are counted
+		k = r.periodsBetween(first, civil(t.In(loc)))
+	}
+	count := 0
+	for i := 0; i < maxPeriods; i, k = i+1, k+1 {
+		for _, d := range r.days(r.period(first, k), start) {
+			if d.Before(start) {
+				continue
+			}
+			count++
+			o := time.Date(d.Year(), d.Month(), d.Day(), s.Start.Hour(), s.Start.Minute(), s.Start.Second(), 0, loc)
+			if r.Count > 0 && count > r.Count || !r.Until.IsZero() && o.After(r.Until) {
+				return time.Time{}
+			}
+			if o.After(t) && !s.excluded(o) {
+				return o
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// excluded reports whether the occurrence is one of the excluded dates.
+func (s *Set) excluded(o time.Time) bool {
+	for _, t := range s.ExDates {
+		if t.Equal(o) {
+			return true
+		}
+	}
+	return false
+}
+
+// civil returns the date of the time as midnight UTC, so that days can be added without DST transitions.
+func civil(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// daysIn returns the number of days in the month of the date.
+func daysIn(d time.Time) int {
+	return time.Date(d.Year(), d.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// daysInYear returns the number of days in the year of the date.
+func daysInYear(d time.Time) int {
+	return time.Date(d.Year(), time.December, 31, 0, 0, 0, 0, time.UTC).YearDay()
+}
+
+// firstPeriod returns the first day of the period containing the start.
+func (r *Rule) firstPeriod(start time.Time) time.Time {
+	switch r.Freq {
+	case Weekly:
+		// weeks start on Monday
+		return start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+	case Monthly:
+		return start.AddDate(0, 0, 1-start.Day())
+	case Yearly:
+		return start.AddDate(0, 0, 1-start.YearDay())
+	default:
+		return start
+	}
+}
+
+// periodsBetween returns the number of whole periods of the rule from the first one that end before the date.
+func (r *Rule) periodsBetween(first, d time.Time) int {
+	var n int
+	switch r.Freq {
+	case Weekly:
+		n = int(d.Sub(first).Hours()/24) / 7
+	case Monthly:
+		n = (d.Year()-first.Year())*12 + int(d.Month()-first.Month())
+	case Yearly:
+		n = d.Year() - first.Year()
+	default:
+		n = int(d.Sub(first).Hours() / 24)
+	}
+	if n = n/r.Interval - 1; n < 0 {
+		return 0
+	}
+	return n
+}
+
+// period returns the days of k-th period of the rule.
+func (r *Rule) period(first time.Time, k int) []time.Time {
+	var from time.Time
+	var n int
+	switch r.Freq {
+	case Weekly:
+		from, n = first.AddDate(0, 0, 7*k*r.Interval), 7
+	case Monthly:
+		from = first.AddDate(0, k*r.Interval, 0)
+		n = daysIn(from)
+	case Yearly:
+		from = first.AddDate(k*r.Interval, 0, 0)
+		n = daysInYear(from)
+	default:
+		from, n = first.AddDate(0, 0, k*r.Interval), 1
+	}
+	days := make([]time.Time, n)
+	for i := range days {
+		days[i] = from.AddDate(0, 0, i)
+	}
+	return days
+}
+
+// days returns the days of the period that match the rule, ordered.
+func (r *Rule) days(period []time.Time, start time.Time) []time.Time {
+	var days []time.Time
+	for _, d := range period {
+		if r.matches(d, start) {
+			days = append(days, d)
+		}
+	}
+	if len(r.BySetPos) == 0 {
+		return days
+	}
+	selected := make([]bool, len(days))
+	for _, p := range r.BySetPos {
+		i := p - 1
+		if p < 0 {
+			i = len(days) + p
+		}
+		if i >= 0 && i < len(days) {
+			selected[i] = true
+		}
+	}
+	var set []time.Time
+	for i, d := range days {
+		if selected[i] {
+			set = append(set, d)
+		}
+	}
+	return set
+}
+
+// matches reports whether the day matches the BYxxx rule parts, or the day of the start if there are none
+// selecting the days.
+func (r *Rule) matches(d, start time.Time) bool {
+	if len(r.ByMonth) > 0 && !r.matchesMonth(d) {
+		return false
+	}
+	if len(r.ByMonthDay) > 0 && !r.matchesMonthDay(d) {
+		return false
+	}
+	if len(r.ByDay) > 0 && !r.matchesDay(d) {
+		return false
+	}
+	if len(r.ByMonthDay) > 0 || len(r.ByDay) > 0 {
+		return true
+	}
+	switch r.Freq {
+	case Weekly:
+		return d.Weekday() == start.Weekday()
+	case Monthly:
+		return d.Day() == start.Day()
+	case Yearly:
+		return (len(r.ByMonth) > 0 || d.Month() == start.Month()) && d.Day() == start.Day()
+	default:
+		return true
+	}
+}
+
+func (r *Rule) matchesMonth(d time.Time) bool {
+	for _, m := range r.ByMonth {
+		if m == d.Month() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchesMonthDay(d time.Time) bool {
+	for _, md := range r.ByMonthDay {
+		if md == d.Day() || md < 0 && daysIn(d)+md+1 == d.Day() {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesDay reports whether the day matches BYDAY. Ordinals count the days within the month for monthly rules
+// and yearly rules limited to months, within the year otherwise.
+func (r *Rule) matchesDay(d time.Time) bool {
+	pos, length := d.YearDay(), daysInYear(d)
+	if r.Freq == Monthly || r.Freq == Yearly && len(r.ByMonth) > 0 {
+		pos, length = d.Day(), daysIn(d)
+	}
+	for _, w := range r.ByDay {
+		if w.Weekday != d.Weekday() {
+			continue
+		}
+		if w.N == 0 || w.N == (pos-1)/7+1 || w.N == -((length-pos)/7+1) {
+			return true
+		}
+	}
+	return false
+}
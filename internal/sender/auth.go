@@ -0,0 +1,67 @@
+package sender
+
+import (
+	"crypto/hmac"
+	"crypto/md5" //nolint:gosec // CRAM-MD5 is defined using MD5
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+
+	"github.com/matoous/mailback/internal/cfg"
+)
+
+// loginClient implements the obsolete LOGIN mechanism which is still required by some relays. Unlike
+// sasl.NewLoginClient it doesn't send the username as initial response and answers the prompts instead,
+// as most of the servers expect.
+type loginClient struct {
+	username, password string
+}
+
+func (a *loginClient) Start() (mech string, ir []byte, err error) {
+	return sasl.Login, nil, nil
+}
+
+func (a *loginClient) Next(challenge []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(string(challenge))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, sasl.ErrUnexpectedServerChallenge
+	}
+}
+
+// cramMD5Client implements the CRAM-MD5 mechanism (RFC 2195).
+type cramMD5Client struct {
+	username, secret string
+}
+
+func (a *cramMD5Client) Start() (mech string, ir []byte, err error) {
+	return "CRAM-MD5", nil, nil
+}
+
+func (a *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	d := hmac.New(md5.New, []byte(a.secret))
+	d.Write(challenge)
+	return []byte(a.username + " " + hex.EncodeToString(d.Sum(nil))), nil
+}
+
+// saslClient returns client for the configured authentication mechanism, nil if the relay doesn't require
+// authentication.
+func saslClient(c *cfg.RelayConfig) (sasl.Client, error) {
+	switch c.Auth {
+	case "":
+		return nil, nil
+	case cfg.AuthPlain:
+		return sasl.NewPlainClient("", c.Username, c.Password), nil
+	case cfg.AuthLogin:
+		return &loginClient{username: c.Username, password: c.Password}, nil
+	case cfg.AuthCRAMMD5:
+		return &cramMD5Client{username: c.Username, secret: c.Password}, nil
+	default:
+		return nil, fmt.Errorf("unknown relay auth mechanism: %q", c.Auth)
+	}
+}
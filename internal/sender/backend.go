@@ -7,48 +7,41 @@ import (
 	"crypto/ed25519"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	gohtml "html"
 	"io/ioutil"
-	"net/smtp"
+	netmail "net/mail"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-msgauth/dkim"
-	"github.com/jpillora/backoff"
 	"go.uber.org/zap"
-	"golang.org/x/sync/errgroup"
 
+	"github.com/matoous/mailback/internal/blob"
 	"github.com/matoous/mailback/internal/cfg"
-	"github.com/matoous/mailback/internal/mail"
+	"github.com/matoous/mailback/internal/message"
 	"github.com/matoous/mailback/internal/models"
+	"github.com/matoous/mailback/internal/store"
 )
 
-const mailTemplate = `
-To: {{.to}}\r\n
-From: {{.from}}\r\n
-Subject: {{.subject}}\r\n
-\r\n
-{{.content}}
-
-------
-{{.banner}}
-\r\n
-`
-
-// Storer is storage that can list the entries pending for being send, update and delete them.
-type Storer interface {
-	Update(e *models.Entry) error
-	Delete(e *models.Entry) error
-	PendingEntries() ([]models.Entry, error)
-}
+// recordTimeout limits recording of the outcome of the delivery, which doesn't depend on the batch deadline.
+const recordTimeout = 30 * time.Second
 
 // Sender sends mails back to the users when the time comes.
 type Sender struct {
-	db       Storer
+	db       store.Store
+	blobs    blob.Store
 	log      *zap.Logger
 	dkimOpts *dkim.SignOptions
 	config   *cfg.SenderConfig
+	// transports are all configured transports by their name.
+	transports map[string]Transport
+	retry      *retryPolicy
+	// worker identifies the sender instance in the claims of the entries.
+	worker string
 }
 
 func loadPrivateKey(path string) (crypto.Signer, error) {
@@ -85,12 +78,49 @@ func loadPrivateKey(path string) (crypto.Signer, error) {
 	}
 }
 
-// New creates new un-started sender.
-func New(storage Storer, log *zap.Logger, config *cfg.SenderConfig) *Sender {
+// New creates new un-started sender. Content of entry attachments is loaded from given blob storage.
+func New(storage store.Store, blobs blob.Store, log *zap.Logger, config *cfg.SenderConfig) *Sender {
+	switch config.TLSPolicy {
+	case cfg.TLSOpportunistic, cfg.TLSRequire, cfg.TLSVerify:
+	default:
+		panic(fmt.Errorf("unknown tls policy: %q", config.TLSPolicy))
+	}
+	transports, err := newTransports(config, log)
+	if err != nil {
+		panic(err)
+	}
+	retry, err := newRetryPolicy(config.Retry)
+	if err != nil {
+		panic(err)
+	}
+	if config.BatchSize < 1 || config.Lease <= 0 {
+		panic(fmt.Errorf("invalid batch size %d or lease %s", config.BatchSize, config.Lease))
+	}
+	switch config.CatchUp {
+	case models.CatchUpOnce, models.CatchUpAll, models.CatchUpSkip:
+	default:
+		panic(fmt.Errorf("unknown catch-up policy: %q", config.CatchUp))
+	}
+	if config.EntryTimeout <= 0 || config.EntryTimeout >= config.Lease {
+		panic(fmt.Errorf("entry timeout %s must be positive and shorter than the lease", config.EntryTimeout))
+	}
+	if config.WorkerCount < 1 {
+		panic(fmt.Errorf("invalid worker count %d", config.WorkerCount))
+	}
+	// each worker delivers its share of the batch one entry after another, all of them within the lease
+	rounds := (config.BatchSize + config.WorkerCount - 1) / config.WorkerCount
+	if time.Duration(rounds)*config.EntryTimeout >= config.Lease {
+		panic(fmt.Errorf("batch of %d entries can't be delivered by %d workers within the lease %s",
+			config.BatchSize, config.WorkerCount, config.Lease))
+	}
 	sender := &Sender{
-		db:     storage,
-		log:    log,
-		config: config,
+		db:         storage,
+		blobs:      blobs,
+		log:        log,
+		config:     config,
+		transports: transports,
+		retry:      retry,
+		worker:     workerID(config),
 	}
 	if config.Cert != "" {
 		signer, err := loadPrivateKey(config.Cert)
@@ -106,158 +136,575 @@ func New(storage Storer, log *zap.Logger, config *cfg.SenderConfig) *Sender {
 	return sender
 }
 
-// PrepareMail prepares the email body.
-func (s *Sender) PrepareMail(e *models.Entry) ([]byte, error) {
-	banner := ""
-	if e.Period != nil {
-		var unsubscribeLink string
-		if s.config.Host == "localhost" {
-			unsubscribeLink = fmt.Sprintf("http://%s/unsubscribe/%s", s.config.Host, e.ID)
+// workerID returns the configured ID of the sender instance, or ID derived from the hostname and the process ID.
+func workerID(config *cfg.SenderConfig) string {
+	if config.WorkerID != "" {
+		return config.WorkerID
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// unsubscribeLink returns link that can be used to unsubscribe from periodic entry.
+func (s *Sender) unsubscribeLink(e *models.Entry) string {
+	if s.config.Host == "localhost" {
+		return fmt.Sprintf("http://%s/unsubscribe/%s", s.config.Host, e.ID)
+	}
+	return fmt.Sprintf("https://%s/unsubscribe/%s", s.config.Host, e.ID)
+}
+
+// body creates MIME body of the email. Plain text only entries are send as single text part, HTML entries
+// as multipart/alternative and entries with attachments are wrapped in multipart/mixed.
+func (s *Sender) body(e *models.Entry) (*message.Part, error) {
+	text, html := e.Data, e.HTML
+	if e.IsPeriodic() {
+		link := s.unsubscribeLink(e)
+		text += fmt.Sprintf("\n\n---\nThis is a periodic email that you will receive %s\n"+
+			"To unsubscribe click here: %s\n", e.Schedule(), link)
+		if html != "" {
+			html += fmt.Sprintf("<hr><p>This is a periodic email that you will receive %s<br>"+
+				"To unsubscribe <a href=\"%s\">click here</a></p>", gohtml.EscapeString(e.Schedule()), link)
+		}
+	}
+
+	var inline, attached []*message.Part
+	for i := range e.Attachments {
+		a := &e.Attachments[i]
+		content, err := s.attachmentContent(a)
+		if err != nil {
+			return nil, err
+		}
+		if a.Inline() && html != "" {
+			inline = append(inline, message.Inline(a.ContentID, a.Filename, a.ContentType, content))
 		} else {
-			unsubscribeLink = fmt.Sprintf("https://%s/unsubscribe/%s", s.config.Host, e.ID)
+			attached = append(attached, message.Attachment(a.Filename, a.ContentType, content))
 		}
-		banner = fmt.Sprintf("\n\n---\nThis is a periodic email that you will receive every %s\n"+
-			"To unsubscribe click here: %s\n", e.Period.Format(), unsubscribeLink)
 	}
-	msg := fmt.Sprintf("To: %s\r\n"+
-		"From: %s <%s@%s>\r\n"+
-		"Subject: %s\r\n"+
-		"\r\n"+
-		"%s%s\r\n", e.Mail, s.config.SenderName, s.config.SenderMail, s.config.Host, e.Title, e.Data, banner)
+
+	body := message.Text("text/plain", text)
+	if html != "" {
+		htmlBody := message.Text("text/html", html)
+		if len(inline) > 0 {
+			htmlBody = message.Multipart("related", append([]*message.Part{htmlBody}, inline...)...)
+		}
+		body = message.Multipart("alternative", body, htmlBody)
+	}
+	if len(attached) > 0 {
+		body = message.Multipart("mixed", append([]*message.Part{body}, attached...)...)
+	}
+	return body, nil
+}
+
+// attachmentContent loads content of the attachment from the blob storage.
+func (s *Sender) attachmentContent(a *models.Attachment) ([]byte, error) {
+	r, err := s.blobs.Get(a.ID)
+	if err != nil {
+		return nil, fmt.Errorf("load attachment %s: %w", a.ID, err)
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// removeAttachments removes content of the attachments of the entry from blob storage once the entry is gone.
+func (s *Sender) removeAttachments(e *models.Entry) {
+	for _, a := range e.Attachments {
+		if err := s.blobs.Delete(a.ID); err != nil {
+			s.log.Error("sender.remove_attachment", zap.Error(err), zap.String("id", a.ID))
+		}
+	}
+}
+
+// subject returns subject of the email, optionally in form of a reply to the received email.
+func (s *Sender) subject(e *models.Entry) string {
+	if !s.config.ReplySubject || strings.HasPrefix(strings.ToLower(e.Title), "re:") {
+		return e.Title
+	}
+	return "Re: " + e.Title
+}
+
+// thread returns the In-Reply-To and References of the email so that it is displayed in the same thread
+// as the received email (RFC 5322 section 3.6.4).
+func thread(e *models.Entry) (inReplyTo, references []string) {
+	if e.MessageID == "" {
+		return nil, nil
+	}
+	references = message.ParseIDs(e.References)
+	if len(references) == 0 {
+		// the parent without references has single In-Reply-To identifier, if any
+		if parent := message.ParseIDs(e.InReplyTo); len(parent) == 1 {
+			references = parent
+		}
+	}
+	return []string{e.MessageID}, append(references, e.MessageID)
+}
+
+// PrepareMail prepares the email, signing it if DKIM is configured.
+func (s *Sender) PrepareMail(e *models.Entry) ([]byte, error) {
+	body, err := s.body(e)
+	if err != nil {
+		return nil, err
+	}
+	id := e.OutboundMessageID
+	if id == "" {
+		if id, err = message.NewMessageID(s.config.Host); err != nil {
+			return nil, err
+		}
+	}
+	inReplyTo, references := thread(e)
+	m := &message.Message{
+		From: &netmail.Address{
+			Name:    s.config.SenderName,
+			Address: s.config.Address(),
+		},
+		To:         []*netmail.Address{{Address: e.Mail}},
+		Subject:    s.subject(e),
+		Date:       time.Now(),
+		MessageID:  id,
+		InReplyTo:  inReplyTo,
+		References: references,
+		Body:       body,
+	}
+	msg, err := m.Bytes()
+	if err != nil {
+		return nil, err
+	}
 
 	if s.dkimOpts == nil {
-		return []byte(msg), nil
+		return msg, nil
 	}
 
 	var res bytes.Buffer
-	err := dkim.Sign(&res, strings.NewReader(msg), s.dkimOpts)
+	err = dkim.Sign(&res, bytes.NewReader(msg), s.dkimOpts)
 	if err != nil {
 		return nil, err
 	}
 	return res.Bytes(), nil
 }
 
-// Send sends the entry to SMTP server of the email receiver.
-func (s *Sender) Send(host string, e *models.Entry) error {
-	msg, err := s.PrepareMail(e)
+// ProcessEntry processes single entry claimed by the sender. This means sending the scheduled entry back to
+// the user and in case of periodical entry rescheduling it for next time. This process can be run concurrently
+// on all entries that need to be processed.
+//
+// The entry is marked as sending before the email is transmitted so that entries interrupted during
+// the delivery can be recovered, see Recover. If the lease of the entry expired and the entry was recovered by
+// another sender instance in the meantime, the entry is left to the other instance.
+func (s *Sender) ProcessEntry(ctx context.Context, e *models.Entry) error {
+	_, err := s.processEntry(ctx, e)
+	return err
+}
+
+// outcome is the result of processing single entry.
+type outcome int
+
+const (
+	// outcomeIgnored entries weren't processed, such as when they were claimed by another sender instance.
+	outcomeIgnored outcome = iota
+	// outcomeSkipped periodic entries skipped the missed occurrence according to their catch-up policy.
+	outcomeSkipped
+	// outcomeSent entries were delivered.
+	outcomeSent
+	// outcomeRetried entries failed temporarily and were rescheduled.
+	outcomeRetried
+	// outcomeGaveUp entries failed permanently or too many times.
+	outcomeGaveUp
+	// outcomeFailed entries couldn't be processed, such as when the storage failed.
+	outcomeFailed
+)
+
+func (s *Sender) processEntry(ctx context.Context, e *models.Entry) (outcome, error) {
+	o, err := s.process(ctx, e)
+	if errors.Is(err, store.ErrConflict) {
+		s.log.Warn("sender.process_entry.lost_claim", zap.String("id", e.ID), zap.String("worker", e.ClaimedBy))
+		return outcomeIgnored, nil
+	}
+	return o, err
+}
+
+func (s *Sender) process(ctx context.Context, e *models.Entry) (outcome, error) {
+	// sanity check
+	now := time.Now()
+	if now.Before(e.ScheduledFor) {
+		return outcomeIgnored, nil
+	}
+	if e.IsPeriodic() && s.catchUp(e) == models.CatchUpSkip && now.Sub(e.ScheduledFor) > s.config.CatchUpGrace {
+		s.log.Info("sender.process_entry.skip", zap.String("id", e.ID), zap.Time("scheduled_for", e.ScheduledFor))
+		if err := s.finish(ctx, e); err != nil {
+			return outcomeFailed, err
+		}
+		return outcomeSkipped, nil
+	}
+	// retries of the same occurrence keep the Message-ID
+	if e.OutboundMessageID == "" {
+		id, err := message.NewMessageID(s.config.Host)
+		if err != nil {
+			return outcomeFailed, err
+		}
+		e.OutboundMessageID = id
+	}
+
+	t, msg, err := s.prepare(e)
 	if err != nil {
-		return err
+		s.recordAttempts(ctx, e, nil, err)
+		return s.handleFailure(ctx, e, err)
+	}
+	e.Status = models.StatusSending
+	if err := s.db.Transition(ctx, e, models.StatusClaimed); err != nil {
+		return outcomeFailed, err
+	}
+	// the delivery is limited by the entry timeout, while the outcome is recorded even if the batch ran out
+	// of time meanwhile, otherwise the delivered email would be sent again once the entry is recovered
+	dctx, cancel := context.WithTimeout(ctx, s.config.EntryTimeout)
+	attempts, err := t.Deliver(dctx, e, msg)
+	cancel()
+	rctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+	defer cancel()
+	s.recordAttempts(rctx, e, attempts, err)
+	if err != nil {
+		return s.handleFailure(rctx, e, err)
+	}
+	if err := s.finish(rctx, e); err != nil {
+		return outcomeFailed, err
 	}
+	return outcomeSent, nil
+}
 
-	serverName := fmt.Sprintf("%s:%d", host, 25)
-	return smtp.SendMail(serverName, nil, "testing@mailback.io", []string{e.Mail}, msg)
+// finish finishes the delivered entry. Periodic entries are rescheduled for the next occurrence, the other ones
+// are marked as sent and removed.
+func (s *Sender) finish(ctx context.Context, e *models.Entry) error {
+	from := e.Status
+	if next := s.nextOccurrence(e); !next.IsZero() {
+		// reschedule
+		e.ScheduledFor = next
+		e.Status = models.StatusScheduled
+		e.OutboundMessageID = ""
+		// reset the failures
+		e.Fails = 0
+		e.FailingSince = nil
+		e.LastError = ""
+		return s.db.Transition(ctx, e, from)
+	}
+	// the entry is marked as sent first so that it isn't delivered again if it can't be deleted
+	e.Status = models.StatusSent
+	if err := s.db.Transition(ctx, e, from); err != nil {
+		return err
+	}
+	return s.remove(ctx, e)
 }
 
-// ProcessEntry processes single entry. This means sending the scheduled entry back to the user and in case
-// of periodical entry rescheduling it for next time. This process can be run concurrently on all entries
-// that need to be processed.
-func (s *Sender) ProcessEntry(e *models.Entry) error {
-	// sanity check
-	if time.Now().Before(e.ScheduledFor) {
-		return nil
+// catchUp returns the catch-up policy of the entry.
+func (s *Sender) catchUp(e *models.Entry) string {
+	if e.CatchUp == "" {
+		return s.config.CatchUp
 	}
+	return e.CatchUp
+}
 
-	domain := mail.Host(e.Mail)
+// nextOccurrence returns when the periodic entry should be delivered next. With the all catch-up policy
+// the missed occurrences are delivered one by one, otherwise the entry continues with the next future
+// occurrence. Zero time is returned for entries that don't recur anymore.
+func (s *Sender) nextOccurrence(e *models.Entry) time.Time {
+	if !e.IsPeriodic() {
+		return time.Time{}
+	}
+	after := time.Now()
+	if s.catchUp(e) == models.CatchUpAll {
+		after = e.ScheduledFor
+	}
+	next := e.NextOccurrence(after)
+	if next.IsZero() && e.Recurrence == "" {
+		s.log.Error("sender.next_occurrence", zap.String("id", e.ID), zap.String("period", e.Period.String()))
+	}
+	return next
+}
 
-	host, err := mail.MXRecordForHost(domain)
-	if err != nil {
-		s.log.Error("sender.process_entry.mx_records", zap.Error(err))
+// remove deletes the entry together with its attachments.
+func (s *Sender) remove(ctx context.Context, e *models.Entry) error {
+	if err := s.db.Delete(ctx, e); err != nil {
 		return err
 	}
+	s.removeAttachments(e)
+	return nil
+}
 
-	err = s.Send(host, e)
+// delivered reports whether the email of the current occurrence of the entry was delivered.
+func (s *Sender) delivered(ctx context.Context, e *models.Entry) (bool, error) {
+	attempts, err := s.db.Attempts(ctx, e.ID)
 	if err != nil {
-		e.Fails++
-		if e.Fails >= 3 {
-			// too many failures, give up
-			s.log.Error("sender.process_entry.send", zap.String("reason", "too many failures"), zap.String("to", e.Mail))
-			return s.db.Delete(e)
+		return false, err
+	}
+	for _, a := range attempts {
+		if a.MessageID == e.OutboundMessageID && a.Outcome == models.OutcomeDelivered {
+			return true, nil
 		}
-		bo := backoff.Backoff{
-			Min:    5 * time.Minute,
-			Max:    time.Hour,
-			Factor: 2,
-			Jitter: true,
+	}
+	return false, nil
+}
+
+// Recover recovers entries left in the intermediate delivery states after their lease expired, such as when
+// the sender instance that claimed them crashed. Claimed entries weren't transmitted and are scheduled again.
+// Entries interrupted during sending are finished if the delivery attempts show that the email was delivered,
+// otherwise they are scheduled again and delivered with the same Message-ID. Sent entries are removed.
+func (s *Sender) Recover(ctx context.Context) error {
+	entries, err := s.db.ExpiredEntries(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		e := &entries[i]
+		s.log.Info("sender.recover", zap.String("id", e.ID), zap.String("status", e.Status), zap.String("worker", e.ClaimedBy))
+		switch e.Status {
+		case models.StatusClaimed:
+			e.Status = models.StatusScheduled
+			err = s.db.Transition(ctx, e, models.StatusClaimed)
+		case models.StatusSending:
+			var delivered bool
+			if delivered, err = s.delivered(ctx, e); err != nil {
+				break
+			}
+			if delivered {
+				err = s.finish(ctx, e)
+				break
+			}
+			e.Status = models.StatusScheduled
+			err = s.db.Transition(ctx, e, models.StatusSending)
+		case models.StatusSent:
+			err = s.remove(ctx, e)
 		}
-		e.ScheduledFor = e.ScheduledFor.Add(bo.ForAttempt(float64(e.Fails)))
-		updateErr := s.db.Update(e)
-		if updateErr != nil {
-			s.log.Error("sender.process_entry.reschedule", zap.Error(err))
-			return updateErr
+		switch {
+		case errors.Is(err, store.ErrConflict), errors.Is(err, store.ErrNotFound):
+			// recovered by another sender instance
+			continue
+		case err != nil:
+			return fmt.Errorf("recover entry %s: %w", e.ID, err)
 		}
-		return err
 	}
+	return nil
+}
 
-	if e.Period != nil {
-		// reschedule
-		e.ScheduledFor, _ = e.Period.AddTo(e.ScheduledFor)
-		e.Fails = 0 // reset the failures
-		return s.db.Update(e)
+// recordAttempts logs the delivery attempts and saves them as the history of the entry. Failure to save
+// the attempts doesn't fail the delivery.
+func (s *Sender) recordAttempts(ctx context.Context, e *models.Entry, attempts []Attempt, err error) {
+	records := make([]*models.DeliveryAttempt, 0, len(attempts)+1)
+	for i := range attempts {
+		a := &attempts[i]
+		s.log.Info("sender.process_entry.attempt",
+			zap.String("id", e.ID),
+			zap.String("host", a.Host),
+			zap.Bool("tls", a.TLS),
+			zap.Bool("verified", a.Verified),
+			zap.Duration("duration", a.Duration),
+			zap.Error(a.Err),
+		)
+		records = append(records, attemptRecord(e, a))
+	}
+	if len(attempts) == 0 && err != nil {
+		// the delivery failed before any host was contacted, such as when the MX lookup failed
+		records = append(records, attemptRecord(e, &Attempt{Start: time.Now(), Err: err}))
+	}
+	if len(records) == 0 {
+		return
+	}
+	if saveErr := s.db.SaveAttempts(ctx, records...); saveErr != nil {
+		s.log.Error("sender.process_entry.save_attempts", zap.Error(saveErr), zap.String("id", e.ID))
 	}
-	// delete
-	return s.db.Delete(e)
 }
 
-// SendMails attempts to send all emails that are due their scheduled for date back to their originators.
-func (s *Sender) SendMails(ctx context.Context) error {
-	entries, err := s.db.PendingEntries()
-	if err != nil {
-		return err
+// attemptRecord creates the history record of the delivery attempt.
+func attemptRecord(e *models.Entry, a *Attempt) *models.DeliveryAttempt {
+	record := &models.DeliveryAttempt{
+		EntryID:   e.ID,
+		CreatedAt: a.Start,
+		MessageID: e.OutboundMessageID,
+		Host:      a.Host,
+		TLS:       a.TLS,
+		Verified:  a.Verified,
+		Duration:  a.Duration,
+		Outcome:   models.OutcomeDelivered,
 	}
+	if a.Err == nil {
+		return record
+	}
+	derr := newDeliveryError(a.Err)
+	record.Outcome = models.OutcomeDeferred
+	if derr.Permanent {
+		record.Outcome = models.OutcomeRejected
+	}
+	if derr.Code != 0 {
+		record.Code = derr.Code
+		record.Response = derr.Error()
+	}
+	record.Error = derr.Error()
+	return record
+}
 
-	g, gCtx := errgroup.WithContext(ctx)
+// handleFailure handles failed delivery of the entry. Permanently rejected entries are moved to the failed state,
+// temporarily failed entries are rescheduled according to the retry policy until the policy gives up and they
+// are moved to the dead state. The delivery error is returned for the rescheduled entries.
+func (s *Sender) handleFailure(ctx context.Context, e *models.Entry, err error) (outcome, error) {
+	derr := newDeliveryError(err)
+	from := e.Status
+	now := time.Now()
+	e.Fails++
+	e.LastError = derr.Error()
+	if e.FailingSince == nil {
+		e.FailingSince = &now
+	}
 
-	entriesChan := make(chan models.Entry)
+	if derr.Permanent {
+		s.log.Error("sender.process_entry.send", zap.String("reason", "permanent failure"), zap.String("to", e.Mail), zap.Error(derr))
+		e.Status = models.StatusFailed
+		return s.giveUp(ctx, e, from)
+	}
+	delay, ok := s.retry.next(e.Fails, now.Sub(*e.FailingSince))
+	if !ok {
+		// too many failures, give up but keep the entry so that it can be requeued
+		s.log.Error("sender.process_entry.send", zap.String("reason", "too many failures"), zap.String("to", e.Mail), zap.Error(derr))
+		e.Status = models.StatusDead
+		return s.giveUp(ctx, e, from)
+	}
+	s.log.Warn("sender.process_entry.send", zap.String("to", e.Mail), zap.Duration("retry_in", delay), zap.Error(derr))
+	// the retries keep the Message-ID as they deliver the same email
+	e.Status = models.StatusScheduled
+	e.ScheduledFor = now.Add(delay)
+	if updateErr := s.db.Transition(ctx, e, from); updateErr != nil {
+		s.log.Error("sender.process_entry.reschedule", zap.Error(updateErr))
+		return outcomeFailed, updateErr
+	}
+	return outcomeRetried, derr
+}
 
-	g.Go(func() error {
-		defer close(entriesChan)
-		for i := range entries {
-			select {
-			case entriesChan <- entries[i]:
-			case <-gCtx.Done():
-				return gCtx.Err()
-			}
-		}
-		return nil
-	})
+// giveUp saves the entry that won't be delivered anymore.
+func (s *Sender) giveUp(ctx context.Context, e *models.Entry, from string) (outcome, error) {
+	if err := s.db.Transition(ctx, e, from); err != nil {
+		return outcomeFailed, err
+	}
+	return outcomeGaveUp, nil
+}
 
-	for i := 0; i < s.config.WorkerCount; i++ {
-		g.Go(func() error {
-			for entry := range entriesChan {
-				entry := entry
-				err := s.ProcessEntry(&entry)
-				if err != nil {
-					return err
-				}
-			}
-			return nil
-		})
+// Summary summarizes the entries processed by SendMails.
+type Summary struct {
+	// Sent is the number of delivered entries.
+	Sent int
+	// Retried is the number of entries that failed temporarily and will be retried.
+	Retried int
+	// GaveUp is the number of entries that failed permanently or too many times.
+	GaveUp int
+	// Skipped is the number of periodic entries whose missed occurrence was skipped.
+	Skipped int
+	// Failed is the number of entries that couldn't be processed, such as when the storage failed. They are
+	// recovered once their lease expires.
+	Failed int
+}
+
+func (s *Summary) add(o outcome) {
+	switch o {
+	case outcomeSent:
+		s.Sent++
+	case outcomeRetried:
+		s.Retried++
+	case outcomeGaveUp:
+		s.GaveUp++
+	case outcomeFailed:
+		s.Failed++
+	case outcomeSkipped:
+		s.Skipped++
+	case outcomeIgnored:
 	}
+}
 
-	if err := g.Wait(); err != nil {
-		return err
+func (s *Summary) merge(o *Summary) {
+	s.Sent += o.Sent
+	s.Retried += o.Retried
+	s.GaveUp += o.GaveUp
+	s.Skipped += o.Skipped
+	s.Failed += o.Failed
+}
+
+// SendMails attempts to send all emails that are due their scheduled for date back to their originators.
+// The entries are claimed in batches so that multiple sender instances can share the storage, entries
+// abandoned by other instances are recovered first. Failure of single entry doesn't affect the other ones,
+// the summary of the processed entries is returned.
+func (s *Sender) SendMails(ctx context.Context) (Summary, error) {
+	rctx, cancel := context.WithTimeout(ctx, s.config.Lease)
+	err := s.Recover(rctx)
+	cancel()
+	if err != nil {
+		s.log.Error("sender.recover", zap.Error(err))
 	}
 
-	s.log.Info("sender.send_mails", zap.Int("mails_send", len(entries)))
-	return nil
+	var summary Summary
+	for ctx.Err() == nil {
+		// the claimed entries belong to the sender only until the lease expires, so the batch must be done by then
+		lease := time.Now().Add(s.config.Lease)
+		bctx, cancel := context.WithDeadline(ctx, lease)
+		entries, err := s.db.Claim(bctx, s.worker, lease, s.config.BatchSize)
+		if err != nil {
+			cancel()
+			return summary, err
+		}
+		batch := s.sendBatch(bctx, entries)
+		cancel()
+		summary.merge(&batch)
+		if len(entries) < s.config.BatchSize {
+			break
+		}
+	}
+
+	s.log.Info("sender.send_mails",
+		zap.Int("sent", summary.Sent),
+		zap.Int("retried", summary.Retried),
+		zap.Int("gave_up", summary.GaveUp),
+		zap.Int("skipped", summary.Skipped),
+		zap.Int("failed", summary.Failed),
+	)
+	return summary, nil
 }
 
-// Run runs the sender, periodically querying for emails that should be send, stopping only when the passed
-// context is canceled.
-func (s *Sender) Run(ctx context.Context) {
-	s.log.Info("sender.start")
-	t := time.NewTicker(s.config.Tick)
-	defer t.Stop()
-	for {
+// sendBatch processes the claimed entries using the configured number of workers, each entry with its own
+// timeout. Entries that weren't processed because the context was canceled are recovered once their lease
+// expires.
+func (s *Sender) sendBatch(ctx context.Context, entries []models.Entry) Summary {
+	var (
+		mu      sync.Mutex
+		summary Summary
+		wg      sync.WaitGroup
+	)
+	entriesChan := make(chan *models.Entry)
+	for i := 0; i < s.config.WorkerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entriesChan {
+				o := s.sendEntry(ctx, e)
+				mu.Lock()
+				summary.add(o)
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for i := range entries {
 		select {
+		case entriesChan <- &entries[i]:
 		case <-ctx.Done():
-			return
-		case <-t.C:
-			s.log.Info("sender.tick")
-			err := s.SendMails(ctx)
-			if err != nil {
-				s.log.Error("sender.send_mails", zap.Error(err))
-			}
+			break feed
 		}
 	}
+	close(entriesChan)
+	wg.Wait()
+	return summary
+}
+
+// sendEntry processes single entry, logging the errors.
+func (s *Sender) sendEntry(ctx context.Context, e *models.Entry) outcome {
+	o, err := s.processEntry(ctx, e)
+	if err != nil && o != outcomeRetried {
+		// failed deliveries were already logged
+		s.log.Error("sender.send_mails.process_entry", zap.String("id", e.ID), zap.Error(err))
+	}
+	return o
 }
@@ -0,0 +1,785 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-smtp"
+	"github.com/rickb777/date/period"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/matoous/mailback/internal/blob"
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/mail"
+	"github.com/matoous/mailback/internal/models"
+	"github.com/matoous/mailback/internal/rrule"
+	"github.com/matoous/mailback/internal/store"
+)
+
+func newTestSender(t *testing.T) (*Sender, blob.Store) {
+	dir, err := ioutil.TempDir("", "mailback-blobs")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	blobs, err := blob.NewFSStore(dir)
+	require.NoError(t, err)
+	return New(nil, blobs, zap.NewNop(), &cfg.SenderConfig{
+		Host:       "mailback.io",
+		SenderMail: "postman",
+		SenderName: "Mailback Postman",
+		TLSPolicy:  cfg.TLSOpportunistic,
+		Transport:  cfg.TransportMX,
+		Retry: cfg.RetryConfig{
+			MaxAge:      24 * time.Hour,
+			MaxAttempts: 3,
+			MinBackoff:  5 * time.Minute,
+			MaxBackoff:  time.Hour,
+			Factor:      2,
+		},
+		WorkerID:     "worker",
+		WorkerCount:  2,
+		BatchSize:    2,
+		Lease:        time.Minute,
+		EntryTimeout: time.Second,
+		CatchUp:      models.CatchUpOnce,
+		CatchUpGrace: time.Hour,
+	}), blobs
+}
+
+func TestSender_PrepareMail(t *testing.T) {
+	s, blobs := newTestSender(t)
+	require.NoError(t, blobs.Put("att", bytes.NewReader([]byte("%PDF-1.4"))))
+	require.NoError(t, blobs.Put("img", bytes.NewReader([]byte("GIF89a"))))
+
+	tests := []struct {
+		Name            string
+		Entry           models.Entry
+		WantText        string
+		WantHTML        string
+		WantAttachments []string
+		WantEmbedded    []string
+	}{
+		{
+			Name:     "plain text",
+			Entry:    models.Entry{Mail: "joe@example.com", Title: "Plants", Data: "Water the plants."},
+			WantText: "Water the plants.",
+		},
+		{
+			Name: "html",
+			Entry: models.Entry{
+				Mail:  "joe@example.com",
+				Title: "Plants",
+				Data:  "Water the plants.",
+				HTML:  "<p>Water the plants.</p>",
+			},
+			WantText: "Water the plants.",
+			WantHTML: "<p>Water the plants.</p>",
+		},
+		{
+			Name: "attachments",
+			Entry: models.Entry{
+				Mail:  "joe@example.com",
+				Title: "Trip",
+				Data:  "Pack the tickets.",
+				HTML:  `<p>Pack the tickets.<img src="cid:map"></p>`,
+				Attachments: []models.Attachment{
+					{ID: "att", Filename: "tickets.pdf", ContentType: "application/pdf"},
+					{ID: "img", Filename: "map.gif", ContentType: "image/gif", ContentID: "map"},
+				},
+			},
+			WantText:        "Pack the tickets.",
+			WantHTML:        `<p>Pack the tickets.<img src="cid:map"></p>`,
+			WantAttachments: []string{"tickets.pdf"},
+			WantEmbedded:    []string{"map"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			msg, err := s.PrepareMail(&tt.Entry)
+			require.NoError(t, err, "shouldn't return error")
+
+			email, err := parsemail.Parse(bytes.NewReader(msg))
+			require.NoError(t, err, "should produce valid email")
+			assert.Equal(t, tt.Entry.Title, email.Subject, "should set the subject")
+			assert.NotEmpty(t, email.MessageID, "should set the message ID")
+			assert.False(t, email.Date.IsZero(), "should set the date")
+			assert.Equal(t, tt.WantText, strings.TrimSpace(email.TextBody), "should contain the text")
+			assert.Equal(t, tt.WantHTML, strings.TrimSpace(email.HTMLBody), "should contain the HTML")
+			var attachments, embedded []string
+			for _, a := range email.Attachments {
+				attachments = append(attachments, a.Filename)
+			}
+			for _, f := range email.EmbeddedFiles {
+				embedded = append(embedded, f.CID)
+			}
+			assert.Equal(t, tt.WantAttachments, attachments, "should attach the files")
+			assert.Equal(t, tt.WantEmbedded, embedded, "should embed the inline parts")
+		})
+	}
+}
+
+type stubResolver struct {
+	txt map[string][]string
+	mx  map[string][]*net.MX
+	ip  map[string][]net.IPAddr
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *stubResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txts, ok := r.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *stubResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if mxs, ok := r.mx[name]; ok {
+		return append([]*net.MX(nil), mxs...), nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *stubResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := r.ip[host]; ok {
+		return ips, nil
+	}
+	return nil, notFound(host)
+}
+
+func TestSender_PrepareMail_DKIM(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	s, _ := newTestSender(t)
+	s.dkimOpts = &dkim.SignOptions{Domain: "mailback.io", Selector: "test", Signer: priv}
+
+	msg, err := s.PrepareMail(&models.Entry{Mail: "joe@example.com", Title: "Zalít květiny", Data: "Nezapomeň na kaktus."})
+	require.NoError(t, err, "shouldn't return error")
+
+	resolver := &stubResolver{txt: map[string][]string{
+		"test._domainkey.mailback.io": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}}
+	verifications, err := mail.VerifyDKIM(context.Background(), resolver, bytes.NewReader(msg))
+	require.NoError(t, err, "should verify the signature")
+	assert.Equal(t, mail.DKIMPass, mail.DKIMResult(verifications), "should produce valid signature")
+}
+
+func TestSender_PrepareMail_Thread(t *testing.T) {
+	tests := []struct {
+		Name           string
+		ReplySubject   bool
+		Entry          models.Entry
+		WantSubject    string
+		WantInReplyTo  []string
+		WantReferences []string
+	}{
+		{
+			Name:        "no message ID",
+			Entry:       models.Entry{Mail: "joe@example.com", Title: "Plants"},
+			WantSubject: "Plants",
+		},
+		{
+			Name:           "new thread",
+			Entry:          models.Entry{Mail: "joe@example.com", Title: "Plants", MessageID: "<a@example.com>"},
+			WantSubject:    "Plants",
+			WantInReplyTo:  []string{"a@example.com"},
+			WantReferences: []string{"a@example.com"},
+		},
+		{
+			Name:         "reply",
+			ReplySubject: true,
+			Entry: models.Entry{
+				Mail:       "joe@example.com",
+				Title:      "Plants",
+				MessageID:  "<c@example.com>",
+				InReplyTo:  "<b@example.com>",
+				References: "<a@example.com> <b@example.com>",
+			},
+			WantSubject:    "Re: Plants",
+			WantInReplyTo:  []string{"c@example.com"},
+			WantReferences: []string{"a@example.com", "b@example.com", "c@example.com"},
+		},
+		{
+			Name:         "reply to reply",
+			ReplySubject: true,
+			Entry: models.Entry{
+				Mail:      "joe@example.com",
+				Title:     "RE: Plants",
+				MessageID: "<b@example.com>",
+				InReplyTo: "<a@example.com>",
+			},
+			WantSubject:    "RE: Plants",
+			WantInReplyTo:  []string{"b@example.com"},
+			WantReferences: []string{"a@example.com", "b@example.com"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			s, _ := newTestSender(t)
+			s.config.ReplySubject = tt.ReplySubject
+			msg, err := s.PrepareMail(&tt.Entry)
+			require.NoError(t, err, "shouldn't return error")
+
+			email, err := parsemail.Parse(bytes.NewReader(msg))
+			require.NoError(t, err, "should produce valid email")
+			assert.Equal(t, tt.WantSubject, email.Subject, "should set the subject")
+			assert.Equal(t, tt.WantInReplyTo, email.InReplyTo, "should reply to the received email")
+			assert.Equal(t, tt.WantReferences, email.References, "should reference the thread")
+		})
+	}
+}
+
+// newMemoryStore creates memory store with given entries.
+func newMemoryStore(t *testing.T, entries ...models.Entry) *store.MemoryStore {
+	db := store.NewMemoryStore()
+	for i := range entries {
+		require.NoError(t, db.Save(context.Background(), &entries[i]))
+	}
+	return db
+}
+
+// storedEntry returns the entry kept in the store, nil if it was removed.
+func storedEntry(t *testing.T, db *store.MemoryStore, id string) *models.Entry {
+	e, err := db.Entry(context.Background(), id)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	require.NoError(t, err)
+	return e
+}
+
+// storedAttempts returns the attempts of the entry kept in the store.
+func storedAttempts(t *testing.T, db *store.MemoryStore, id string) []models.DeliveryAttempt {
+	attempts, err := db.Attempts(context.Background(), id)
+	require.NoError(t, err)
+	return attempts
+}
+
+// stubTransport fails all deliveries with given error, or accepts them if the error is nil.
+type stubTransport struct {
+	err error
+	mu  sync.Mutex
+	// delivered counts the delivery attempts of the entries
+	delivered map[string]int
+}
+
+func (t *stubTransport) Deliver(_ context.Context, e *models.Entry, _ []byte) ([]Attempt, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.delivered == nil {
+		t.delivered = make(map[string]int)
+	}
+	t.delivered[e.ID]++
+	return []Attempt{{Host: "stub", Start: time.Now(), Err: t.err}}, t.err
+}
+
+func TestSender_ProcessEntry_Failure(t *testing.T) {
+	permanent := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	temporary := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Try again later"}
+	longAgo := time.Now().Add(-48 * time.Hour)
+
+	tests := []struct {
+		Name         string
+		Err          error
+		Fails        uint8
+		FailingSince *time.Time
+		WantErr      bool
+		WantStatus   string
+		WantFails    uint8
+		WantOutcome  string
+	}{
+		{
+			Name:        "permanent failure",
+			Err:         permanent,
+			WantStatus:  models.StatusFailed,
+			WantFails:   1,
+			WantOutcome: models.OutcomeRejected,
+		},
+		{
+			Name:        "temporary failure",
+			Err:         temporary,
+			WantErr:     true,
+			WantStatus:  models.StatusScheduled,
+			WantFails:   1,
+			WantOutcome: models.OutcomeDeferred,
+		},
+		{
+			Name:        "too many attempts",
+			Err:         temporary,
+			Fails:       2,
+			WantStatus:  models.StatusDead,
+			WantFails:   3,
+			WantOutcome: models.OutcomeDeferred,
+		},
+		{
+			Name:         "failing for too long",
+			Err:          temporary,
+			Fails:        1,
+			FailingSince: &longAgo,
+			WantStatus:   models.StatusDead,
+			WantFails:    2,
+			WantOutcome:  models.OutcomeDeferred,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			entry := models.Entry{
+				ID:           "abc",
+				Mail:         "joe@example.com",
+				Title:        "Plants",
+				Status:       models.StatusClaimed,
+				ClaimedBy:    "worker",
+				ScheduledFor: time.Now().Add(-time.Minute),
+				Fails:        tt.Fails,
+				FailingSince: tt.FailingSince,
+			}
+			db := newMemoryStore(t, entry)
+			s, _ := newTestSender(t)
+			s.db = db
+			s.transports[cfg.TransportMX] = &stubTransport{err: tt.Err}
+
+			err := s.ProcessEntry(context.Background(), &entry)
+			if tt.WantErr {
+				assert.Error(t, err, "should return the delivery error")
+			} else {
+				assert.NoError(t, err, "shouldn't return error")
+			}
+			stored := storedEntry(t, db, entry.ID)
+			require.NotNil(t, stored, "should keep the entry")
+			assert.Equal(t, tt.WantStatus, stored.Status, "should set the status")
+			assert.Equal(t, tt.WantFails, stored.Fails, "should count the failures")
+			assert.NotEmpty(t, stored.LastError, "should record the error")
+			assert.NotNil(t, stored.FailingSince, "should record when the entry started failing")
+			if stored.Status == models.StatusScheduled {
+				assert.True(t, stored.ScheduledFor.After(time.Now()), "should reschedule the entry")
+			}
+			assert.NotEmpty(t, stored.OutboundMessageID, "should keep the Message-ID for the retries")
+			attempts := storedAttempts(t, db, entry.ID)
+			require.Len(t, attempts, 1, "should record the attempt")
+			assert.Equal(t, stored.OutboundMessageID, attempts[0].MessageID, "should record the Message-ID")
+			assert.Equal(t, "stub", attempts[0].Host, "should record the host")
+			assert.Equal(t, stored.LastError, attempts[0].Error, "should record the error")
+			assert.Equal(t, tt.WantOutcome, attempts[0].Outcome, "should record the outcome")
+			assert.Equal(t, newDeliveryError(tt.Err).Code, attempts[0].Code, "should record the reply code")
+			assert.Equal(t, stored.LastError, attempts[0].Response, "should record the reply")
+		})
+	}
+}
+
+func TestSender_ProcessEntry_Success(t *testing.T) {
+	failingSince := time.Now().Add(-time.Hour)
+	p := period.NewYMD(0, 0, 1)
+	entry := models.Entry{
+		ID:           "abc",
+		Mail:         "joe@example.com",
+		Title:        "Plants",
+		Status:       models.StatusClaimed,
+		ClaimedBy:    "worker",
+		ScheduledFor: time.Now().Add(-time.Minute),
+		Period:       &p,
+		Fails:        2,
+		FailingSince: &failingSince,
+		LastError:    "451 Try again later",
+	}
+	db := newMemoryStore(t, entry)
+	s, _ := newTestSender(t)
+	s.db = db
+	s.transports[cfg.TransportMX] = &stubTransport{}
+
+	require.NoError(t, s.ProcessEntry(context.Background(), &entry), "shouldn't fail")
+	stored := storedEntry(t, db, entry.ID)
+	require.NotNil(t, stored, "should keep the periodic entry")
+	assert.Zero(t, stored.Fails, "should reset the failures")
+	assert.Nil(t, stored.FailingSince, "should reset the failures")
+	assert.Empty(t, stored.LastError, "should reset the failures")
+	assert.True(t, stored.ScheduledFor.After(time.Now()), "should reschedule the periodic entry")
+	assert.Equal(t, models.StatusScheduled, stored.Status, "should reschedule the periodic entry")
+	assert.Empty(t, stored.OutboundMessageID, "should use new Message-ID for the next occurrence")
+	attempts := storedAttempts(t, db, entry.ID)
+	require.Len(t, attempts, 1, "should record the attempt")
+	assert.Equal(t, models.OutcomeDelivered, attempts[0].Outcome, "should record the outcome")
+	assert.Empty(t, attempts[0].Error, "shouldn't record any error")
+}
+
+// lateTransport delivers the email after given delay regardless of the context.
+type lateTransport struct {
+	delay time.Duration
+}
+
+func (t lateTransport) Deliver(_ context.Context, _ *models.Entry, _ []byte) ([]Attempt, error) {
+	time.Sleep(t.delay)
+	return []Attempt{{Host: "late", Start: time.Now()}}, nil
+}
+
+func TestSender_ProcessEntry_BatchDeadline(t *testing.T) {
+	p := period.NewYMD(0, 0, 1)
+	entry := models.Entry{
+		ID:           "abc",
+		Mail:         "joe@example.com",
+		Title:        "Plants",
+		Status:       models.StatusClaimed,
+		ClaimedBy:    "worker",
+		ScheduledFor: time.Now().Add(-time.Minute),
+		Period:       &p,
+	}
+	db := newMemoryStore(t, entry)
+	s, _ := newTestSender(t)
+	s.db = db
+	s.transports[cfg.TransportMX] = lateTransport{delay: 50 * time.Millisecond}
+
+	// the batch runs out of time while the email is being delivered
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.NoError(t, s.ProcessEntry(ctx, &entry), "should record the delivery after the batch deadline")
+	stored := storedEntry(t, db, entry.ID)
+	require.NotNil(t, stored, "should keep the periodic entry")
+	assert.Equal(t, models.StatusScheduled, stored.Status, "should reschedule the delivered entry")
+	attempts := storedAttempts(t, db, entry.ID)
+	require.Len(t, attempts, 1, "should record the attempt")
+	assert.Equal(t, models.OutcomeDelivered, attempts[0].Outcome, "should record the delivery")
+}
+
+func TestNew_Batch(t *testing.T) {
+	tests := []struct {
+		Name         string
+		BatchSize    int
+		WorkerCount  int
+		EntryTimeout time.Duration
+		WantPanic    bool
+	}{
+		{Name: "batch delivered in single round", BatchSize: 16, WorkerCount: 16, EntryTimeout: 5 * time.Minute},
+		{Name: "batch delivered in multiple rounds", BatchSize: 100, WorkerCount: 16, EntryTimeout: time.Minute},
+		{Name: "batch outliving the lease", BatchSize: 100, WorkerCount: 16, EntryTimeout: 5 * time.Minute, WantPanic: true},
+		{Name: "no workers", BatchSize: 16, EntryTimeout: time.Minute, WantPanic: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			s, blobs := newTestSender(t)
+			config := *s.config
+			config.BatchSize = tt.BatchSize
+			config.WorkerCount = tt.WorkerCount
+			config.EntryTimeout = tt.EntryTimeout
+			config.Lease = 10 * time.Minute
+			newSender := func() { New(nil, blobs, zap.NewNop(), &config) }
+			if tt.WantPanic {
+				assert.Panics(t, newSender, "should refuse the configuration")
+				return
+			}
+			assert.NotPanics(t, newSender, "should accept the configuration")
+		})
+	}
+}
+
+func TestSender_ProcessEntry_CatchUp(t *testing.T) {
+	day := period.NewYMD(0, 0, 1)
+	// the sender was down for a week
+	scheduledFor := time.Now().Add(-7*24*time.Hour + time.Minute)
+
+	tests := []struct {
+		Name          string
+		CatchUp       string
+		Default       string
+		WantDelivered int
+		WantFuture    bool
+	}{
+		{Name: "once", CatchUp: models.CatchUpOnce, WantDelivered: 1, WantFuture: true},
+		{Name: "all", CatchUp: models.CatchUpAll, WantDelivered: 1},
+		{Name: "skip", CatchUp: models.CatchUpSkip, WantFuture: true},
+		{Name: "default", Default: models.CatchUpSkip, WantFuture: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			entry := models.Entry{
+				ID:           "abc",
+				Mail:         "joe@example.com",
+				Title:        "Plants",
+				Status:       models.StatusClaimed,
+				ClaimedBy:    "worker",
+				ScheduledFor: scheduledFor,
+				Period:       &day,
+				CatchUp:      tt.CatchUp,
+			}
+			db := newMemoryStore(t, entry)
+			s, _ := newTestSender(t)
+			s.db = db
+			if tt.Default != "" {
+				s.config.CatchUp = tt.Default
+			}
+			tr := &stubTransport{}
+			s.transports[cfg.TransportMX] = tr
+
+			require.NoError(t, s.ProcessEntry(context.Background(), &entry), "shouldn't fail")
+			assert.Equal(t, tt.WantDelivered, tr.delivered[entry.ID], "should deliver according to the policy")
+			stored := storedEntry(t, db, entry.ID)
+			require.NotNil(t, stored, "should keep the periodic entry")
+			assert.Equal(t, models.StatusScheduled, stored.Status, "should reschedule the entry")
+			if tt.WantFuture {
+				assert.True(t, stored.ScheduledFor.After(time.Now()), "should continue with the next future occurrence")
+				assert.True(t, stored.ScheduledFor.Before(time.Now().Add(24*time.Hour)), "shouldn't skip the next occurrence")
+			} else {
+				assert.True(t, scheduledFor.AddDate(0, 0, 1).Equal(stored.ScheduledFor), "should continue with the next missed occurrence")
+			}
+		})
+	}
+}
+
+func TestSender_ProcessEntry_LostClaim(t *testing.T) {
+	entry := models.Entry{
+		ID:           "abc",
+		Mail:         "joe@example.com",
+		Title:        "Plants",
+		Status:       models.StatusClaimed,
+		ClaimedBy:    "worker",
+		ScheduledFor: time.Now().Add(-time.Minute),
+	}
+	// the lease expired and the entry was claimed by another instance
+	claimed := entry
+	claimed.ClaimedBy = "other"
+	db := newMemoryStore(t, claimed)
+	s, _ := newTestSender(t)
+	s.db = db
+	tr := &stubTransport{}
+	s.transports[cfg.TransportMX] = tr
+
+	require.NoError(t, s.ProcessEntry(context.Background(), &entry), "shouldn't fail")
+	assert.Zero(t, tr.delivered[entry.ID], "shouldn't deliver entry claimed by someone else")
+	assert.Equal(t, "other", storedEntry(t, db, entry.ID).ClaimedBy, "should keep the entry")
+}
+
+func TestSender_SendMails(t *testing.T) {
+	var entries []models.Entry
+	for i := 0; i < 9; i++ {
+		entries = append(entries, models.Entry{
+			ID:           fmt.Sprintf("e%d", i),
+			Mail:         "joe@example.com",
+			Title:        "Plants",
+			Status:       models.StatusScheduled,
+			ScheduledFor: time.Now().Add(-time.Minute),
+		})
+	}
+	db := newMemoryStore(t, entries...)
+	tr := &stubTransport{}
+
+	// multiple instances share the storage
+	var g errgroup.Group
+	workers := []string{"first", "second", "third"}
+	summaries := make([]Summary, len(workers))
+	for i, worker := range workers {
+		i := i
+		s, _ := newTestSender(t)
+		s.db = db
+		s.worker = worker
+		s.transports[cfg.TransportMX] = tr
+		g.Go(func() error {
+			var err error
+			summaries[i], err = s.SendMails(context.Background())
+			return err
+		})
+	}
+	require.NoError(t, g.Wait())
+
+	sent := 0
+	for _, summary := range summaries {
+		sent += summary.Sent
+	}
+	assert.Equal(t, len(entries), sent, "should count the sent entries")
+	for _, e := range entries {
+		assert.Equal(t, 1, tr.delivered[e.ID], "should deliver entry %s once", e.ID)
+		assert.Nil(t, storedEntry(t, db, e.ID), "should remove delivered entry %s", e.ID)
+	}
+}
+
+// slowTransport never delivers the email, it waits until the delivery is canceled.
+type slowTransport struct{}
+
+func (slowTransport) Deliver(ctx context.Context, _ *models.Entry, _ []byte) ([]Attempt, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSender_SendMails_Failures(t *testing.T) {
+	permanent := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	temporary := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Try again later"}
+	transports := map[string]Transport{
+		"ok":        &stubTransport{},
+		"permanent": &stubTransport{err: permanent},
+		"temporary": &stubTransport{err: temporary},
+		"slow":      slowTransport{},
+	}
+	var entries []models.Entry
+	for _, name := range []string{"ok", "permanent", "temporary", "slow", "ok"} {
+		entries = append(entries, models.Entry{
+			ID:           fmt.Sprintf("e%d", len(entries)),
+			Mail:         "joe@example.com",
+			Title:        "Plants",
+			Status:       models.StatusScheduled,
+			ScheduledFor: time.Now().Add(-time.Minute),
+			Transport:    name,
+		})
+	}
+	db := newMemoryStore(t, entries...)
+	s, _ := newTestSender(t)
+	s.db = db
+	s.config.EntryTimeout = 50 * time.Millisecond
+	for name, tr := range transports {
+		s.transports[name] = tr
+	}
+
+	summary, err := s.SendMails(context.Background())
+	require.NoError(t, err, "shouldn't fail because of single entry")
+	assert.Equal(t, Summary{Sent: 2, Retried: 2, GaveUp: 1}, summary, "should summarize the batch")
+	assert.Equal(t, models.StatusFailed, storedEntry(t, db, "e1").Status, "should give up the rejected entry")
+	assert.Equal(t, models.StatusScheduled, storedEntry(t, db, "e2").Status, "should retry the failed entry")
+	assert.Equal(t, models.StatusScheduled, storedEntry(t, db, "e3").Status, "should retry the timed out entry")
+	assert.Contains(t, storedEntry(t, db, "e3").LastError, "deadline exceeded", "should time out the slow entry")
+}
+
+func TestSender_Recover(t *testing.T) {
+	const messageID = "<1.abc@example.com>"
+	p := period.NewYMD(0, 0, 1)
+	scheduledFor := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		Name       string
+		Status     string
+		Period     *period.Period
+		Lease      time.Duration
+		Delivered  bool
+		WantStatus string
+		WantID     string
+	}{
+		{
+			Name:       "claimed",
+			Status:     models.StatusClaimed,
+			WantStatus: models.StatusScheduled,
+			WantID:     messageID,
+		},
+		{
+			Name:       "sending, not delivered",
+			Status:     models.StatusSending,
+			WantStatus: models.StatusScheduled,
+			WantID:     messageID,
+		},
+		{
+			Name:      "sending, delivered",
+			Status:    models.StatusSending,
+			Delivered: true,
+		},
+		{
+			Name:       "sending, delivered periodic",
+			Status:     models.StatusSending,
+			Period:     &p,
+			Delivered:  true,
+			WantStatus: models.StatusScheduled,
+		},
+		{
+			Name:   "sent",
+			Status: models.StatusSent,
+		},
+		{
+			Name:       "lease not expired",
+			Status:     models.StatusSending,
+			Lease:      time.Minute,
+			WantStatus: models.StatusSending,
+			WantID:     messageID,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			leaseUntil := time.Now().Add(tt.Lease - time.Second)
+			db := newMemoryStore(t, models.Entry{
+				ID:                "abc",
+				Mail:              "joe@example.com",
+				Status:            tt.Status,
+				ScheduledFor:      scheduledFor,
+				Period:            tt.Period,
+				OutboundMessageID: messageID,
+				ClaimedBy:         "crashed",
+				LeaseUntil:        &leaseUntil,
+			})
+			// attempt of the previous occurrence must be ignored
+			require.NoError(t, db.SaveAttempts(context.Background(), &models.DeliveryAttempt{
+				EntryID:   "abc",
+				MessageID: "<0.abc@example.com>",
+				Outcome:   models.OutcomeDelivered,
+			}))
+			if tt.Delivered {
+				require.NoError(t, db.SaveAttempts(context.Background(), &models.DeliveryAttempt{
+					EntryID:   "abc",
+					MessageID: messageID,
+					Outcome:   models.OutcomeDelivered,
+				}))
+			}
+			s, _ := newTestSender(t)
+			s.db = db
+
+			require.NoError(t, s.Recover(context.Background()), "shouldn't fail")
+			stored := storedEntry(t, db, "abc")
+			if tt.WantStatus == "" {
+				assert.Nil(t, stored, "should remove the entry")
+				return
+			}
+			require.NotNil(t, stored, "should keep the entry")
+			assert.Equal(t, tt.WantStatus, stored.Status, "should recover the status")
+			assert.Equal(t, tt.WantID, stored.OutboundMessageID, "should keep Message-ID of undelivered email")
+			if tt.Period != nil {
+				assert.True(t, stored.ScheduledFor.After(scheduledFor), "should reschedule the periodic entry")
+			}
+		})
+	}
+}
+
+func TestSender_ProcessEntry_Recurrence(t *testing.T) {
+	set, err := rrule.Parse("DTSTART:20200101T090000\nRRULE:FREQ=DAILY;COUNT=2", time.UTC)
+	require.NoError(t, err)
+	entry := models.Entry{
+		ID:        "abc",
+		Mail:      "joe@example.com",
+		Title:     "Plants",
+		Status:    models.StatusClaimed,
+		ClaimedBy: "worker",
+		CatchUp:   models.CatchUpAll,
+	}
+	require.NoError(t, entry.SetRecurrence(set))
+	db := newMemoryStore(t, entry)
+	s, _ := newTestSender(t)
+	s.db = db
+	tr := &stubTransport{}
+	s.transports[cfg.TransportMX] = tr
+
+	require.NoError(t, s.ProcessEntry(context.Background(), &entry), "shouldn't fail")
+	stored := storedEntry(t, db, entry.ID)
+	require.NotNil(t, stored, "should keep the entry")
+	assert.Equal(t, models.StatusScheduled, stored.Status, "should reschedule the entry")
+	assert.True(t, time.Date(2020, 1, 2, 9, 0, 0, 0, time.UTC).Equal(stored.ScheduledFor), "should reschedule for the next occurrence")
+
+	entry = *stored
+	entry.Status, entry.ClaimedBy = models.StatusClaimed, "worker"
+	require.NoError(t, db.Update(context.Background(), &entry))
+	require.NoError(t, s.ProcessEntry(context.Background(), &entry), "shouldn't fail")
+	assert.Equal(t, 2, tr.delivered[entry.ID], "should deliver both occurrences")
+	assert.Nil(t, storedEntry(t, db, entry.ID), "should remove the entry once the recurrence ends")
+}
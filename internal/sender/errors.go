@@ -0,0 +1,92 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/matoous/mailback/internal/mail"
+)
+
+// DeliveryError describes why the email couldn't be delivered and whether it makes sense to retry the delivery.
+type DeliveryError struct {
+	// Code is the SMTP reply code (RFC 5321 section 4.2), 0 if there was no reply, such as when the connection
+	// failed.
+	Code int
+	// EnhancedCode is the enhanced status code (RFC 3463), zero if the server didn't send one.
+	EnhancedCode smtp.EnhancedCode
+	// Message is the text of the reply.
+	Message string
+	// Permanent is set if the delivery would fail again, the email must not be retried.
+	Permanent bool
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *DeliveryError) Error() string {
+	if e.Code == 0 {
+		return e.Err.Error()
+	}
+	if e.EnhancedCode != (smtp.EnhancedCode{}) {
+		return fmt.Sprintf("%d %d.%d.%d %s", e.Code, e.EnhancedCode[0], e.EnhancedCode[1], e.EnhancedCode[2], e.Message)
+	}
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// permanentCode reports whether the SMTP reply is permanent failure. The class of the enhanced status code
+// takes precedence as it is more specific (RFC 3463 section 2).
+func permanentCode(code int, enhanced smtp.EnhancedCode) bool {
+	switch enhanced[0] {
+	case 2, 4, 5:
+		return enhanced[0] == 5
+	}
+	return code >= 500 && code <= 599
+}
+
+// newDeliveryError classifies the error returned by the transport. SMTP replies are classified by their codes,
+// errors that were already classified by the transport are kept and everything else, such as network errors,
+// is considered temporary.
+func newDeliveryError(err error) *DeliveryError {
+	var derr *DeliveryError
+	if errors.As(err, &derr) {
+		return derr
+	}
+
+	derr = &DeliveryError{Err: err}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		derr.Code = smtpErr.Code
+		derr.EnhancedCode = smtpErr.EnhancedCode
+		derr.Message = smtpErr.Message
+		derr.Permanent = permanentCode(smtpErr.Code, smtpErr.EnhancedCode)
+	}
+	return derr
+}
+
+// lookupError classifies failed lookup of the MX hosts of the receiver's domain. Domains that don't exist
+// according to the DNS server or don't accept email are permanent failures, other lookup failures, including
+// not found records that may be caused by misconfigured resolver, are temporary.
+func lookupError(err error) *DeliveryError {
+	derr := &DeliveryError{Err: err}
+	switch {
+	case errors.Is(err, mail.ErrNullMX):
+		// recipient address has null MX (RFC 7505 section 3)
+		derr.EnhancedCode = smtp.EnhancedCode{5, 1, 10}
+		derr.Permanent = true
+	case errors.Is(err, mail.ErrNoSuchDomain):
+		// bad destination system address (RFC 3463 section 3.2)
+		derr.EnhancedCode = smtp.EnhancedCode{5, 1, 2}
+		derr.Permanent = true
+	}
+	return derr
+}
+
+// isPermanent reports whether the error is permanent failure of the delivery.
+func isPermanent(err error) bool {
+	return newDeliveryError(err).Permanent
+}
@@ -0,0 +1,109 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matoous/mailback/internal/mail"
+)
+
+func TestNewDeliveryError(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Err           error
+		WantPermanent bool
+		WantCode      int
+		WantMessage   string
+	}{
+		{
+			Name:          "no such user",
+			Err:           &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
+			WantPermanent: true,
+			WantCode:      550,
+			WantMessage:   "550 5.1.1 No such user",
+		},
+		{
+			Name:        "greylisting",
+			Err:         &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Try again later"},
+			WantCode:    451,
+			WantMessage: "451 4.7.1 Try again later",
+		},
+		{
+			Name:        "service not available",
+			Err:         fmt.Errorf("mx.example.com: %w", &smtp.SMTPError{Code: 421, Message: "Too busy"}),
+			WantCode:    421,
+			WantMessage: "421 Too busy",
+		},
+		{
+			Name:          "permanent without enhanced code",
+			Err:           &smtp.SMTPError{Code: 554, Message: "Transaction failed"},
+			WantPermanent: true,
+			WantCode:      554,
+			WantMessage:   "554 Transaction failed",
+		},
+		{
+			Name:        "enhanced code takes precedence",
+			Err:         &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{4, 2, 2}, Message: "Mailbox full"},
+			WantCode:    550,
+			WantMessage: "550 4.2.2 Mailbox full",
+		},
+		{
+			Name:        "connection refused",
+			Err:         &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			WantMessage: "dial tcp: connection refused",
+		},
+		{
+			Name:          "already classified",
+			Err:           fmt.Errorf("webhook: %w", &DeliveryError{Err: errors.New("404 Not Found"), Permanent: true}),
+			WantPermanent: true,
+			WantMessage:   "404 Not Found",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			derr := newDeliveryError(tt.Err)
+			assert.Equal(t, tt.WantPermanent, derr.Permanent, "should classify the error")
+			assert.Equal(t, tt.WantCode, derr.Code, "should keep the reply code")
+			assert.Equal(t, tt.WantMessage, derr.Error(), "should format the error")
+		})
+	}
+}
+
+func TestLookupError(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Err           error
+		WantPermanent bool
+	}{
+		{
+			Name:          "null MX",
+			Err:           fmt.Errorf("example.com: %w", mail.ErrNullMX),
+			WantPermanent: true,
+		},
+		{
+			Name:          "non-existent domain",
+			Err:           fmt.Errorf("example.com: %w", mail.ErrNoSuchDomain),
+			WantPermanent: true,
+		},
+		{
+			Name: "record not found",
+			Err:  &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true},
+		},
+		{
+			Name: "temporary failure",
+			Err:  &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			assert.Equal(t, tt.WantPermanent, lookupError(tt.Err).Permanent, "should classify the error")
+		})
+	}
+}
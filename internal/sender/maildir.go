@@ -0,0 +1,79 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/matoous/mailback/internal/models"
+)
+
+// MaildirTransport delivers all emails into single local Maildir, which is useful for single-user
+// self-hosting and testing.
+type MaildirTransport struct {
+	dir      string
+	hostname string
+	// deliveries makes the names of the files unique within the process
+	deliveries uint64
+}
+
+// NewMaildirTransport creates new transport delivering into the Maildir in given directory, creating
+// the directory structure if necessary.
+func NewMaildirTransport(dir string) (*MaildirTransport, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, fmt.Errorf("create maildir: %w", err)
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// slashes and colons can't be part of the file name (see https://cr.yp.to/proto/maildir.html)
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	return &MaildirTransport{dir: dir, hostname: hostname}, nil
+}
+
+// Deliver writes the message into the tmp directory first and then moves it into the new directory,
+// so that the mail clients never see partially written messages.
+func (t *MaildirTransport) Deliver(_ context.Context, _ *models.Entry, msg []byte) ([]Attempt, error) {
+	a := Attempt{Host: t.dir, Start: time.Now()}
+	a.Err = t.write(msg)
+	a.Duration = time.Since(a.Start)
+	return []Attempt{a}, a.Err
+}
+
+// name returns unique name of new message file.
+func (t *MaildirTransport) name() string {
+	now := time.Now()
+	n := atomic.AddUint64(&t.deliveries, 1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, t.hostname)
+}
+
+func (t *MaildirTransport) write(msg []byte) error {
+	name := t.name()
+	tmp := filepath.Join(t.dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(msg); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.dir, "new", name))
+}
@@ -0,0 +1,64 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/matoous/mailback/internal/models"
+)
+
+// MboxTransport appends all emails to single local mbox file in the mboxrd format, which is useful for
+// single-user self-hosting and testing. The writes are serialized within the process only, the file must not
+// be written by other processes at the same time.
+type MboxTransport struct {
+	path string
+	// from is the envelope sender written into the From_ line.
+	from string
+	mu   sync.Mutex
+}
+
+// NewMboxTransport creates new transport appending to the mbox file at given path.
+func NewMboxTransport(path, from string) *MboxTransport {
+	return &MboxTransport{path: path, from: from}
+}
+
+// Deliver appends the message to the mbox file.
+func (t *MboxTransport) Deliver(_ context.Context, _ *models.Entry, msg []byte) ([]Attempt, error) {
+	a := Attempt{Host: t.path, Start: time.Now()}
+	a.Err = t.write(mboxMessage(t.from, a.Start, msg))
+	a.Duration = time.Since(a.Start)
+	return []Attempt{a}, a.Err
+}
+
+// mboxMessage formats the message as single mboxrd entry: the From_ line, the message with LF line endings
+// and lines starting with (quoted) "From " quoted once more, and trailing blank line.
+func mboxMessage(from string, date time.Time, msg []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("From " + from + " " + date.UTC().Format(time.ANSIC) + "\n")
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	for _, line := range bytes.SplitAfter(bytes.TrimRight(msg, "\n"), []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+	}
+	buf.WriteString("\n\n")
+	return buf.Bytes()
+}
+
+func (t *MboxTransport) write(entry []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, err := os.OpenFile(t.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(entry); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
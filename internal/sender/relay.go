@@ -0,0 +1,121 @@
+package sender
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/models"
+)
+
+// RelayTransport delivers all emails through the relay host (smarthost) which takes care of the delivery.
+// The certificate of the relay is always verified.
+type RelayTransport struct {
+	// hello is the name used in EHLO command.
+	hello string
+	// from is the envelope sender.
+	from   string
+	config cfg.RelayConfig
+
+	dial dialFunc
+	// rootCAs are used to verify certificate of the relay, nil means the system pool.
+	rootCAs *x509.CertPool
+}
+
+// NewRelayTransport creates new transport delivering through the configured relay.
+func NewRelayTransport(config *cfg.SenderConfig) (*RelayTransport, error) {
+	if err := validateRelay(&config.Relay); err != nil {
+		return nil, err
+	}
+	return &RelayTransport{
+		hello:  config.Host,
+		from:   config.Address(),
+		config: config.Relay,
+		dial:   defaultDial,
+	}, nil
+}
+
+// validateRelay checks that the relay configuration is complete.
+func validateRelay(c *cfg.RelayConfig) error {
+	if c.Host == "" {
+		return errors.New("relay host is not set")
+	}
+	switch c.Security {
+	case cfg.RelayTLS, cfg.RelaySTARTTLS:
+	case cfg.RelayPlaintext:
+		// the credentials and the messages would be readable by anyone on the way to the relay
+		if !isLoopback(c.Host) {
+			return fmt.Errorf("plaintext relay must be on the same host: %s", c.Host)
+		}
+	default:
+		return fmt.Errorf("unknown relay security: %q", c.Security)
+	}
+	_, err := saslClient(c)
+	return err
+}
+
+// isLoopback reports whether the host is the local host.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Deliver sends the message to the relay.
+func (t *RelayTransport) Deliver(ctx context.Context, e *models.Entry, msg []byte) ([]Attempt, error) {
+	a := Attempt{Host: t.config.Host, Start: time.Now()}
+	a.Err = t.transmit(ctx, &a, e.Mail, msg)
+	a.Duration = time.Since(a.Start)
+	return []Attempt{a}, a.Err
+}
+
+// transmit connects to the relay, authenticates and transmits the message.
+func (t *RelayTransport) transmit(ctx context.Context, a *Attempt, to string, msg []byte) error {
+	conn, err := connect(ctx, t.dial, net.JoinHostPort(t.config.Host, t.config.Port))
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{ServerName: t.config.Host, RootCAs: t.rootCAs}
+	if t.config.Security == cfg.RelayTLS {
+		conn = tls.Client(conn, tlsConfig)
+		a.TLS, a.Verified = true, true
+	}
+	c, err := smtp.NewClient(conn, t.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello(t.hello); err != nil {
+		return err
+	}
+	if t.config.Security == cfg.RelaySTARTTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("relay %s doesn't support STARTTLS", t.config.Host)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return &tlsError{err: err}
+		}
+		a.TLS, a.Verified = true, true
+	}
+	auth, err := saslClient(&t.config)
+	if err != nil {
+		return err
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("relay authentication: %w", err)
+		}
+	}
+	return sendMessage(c, t.from, to, msg)
+}
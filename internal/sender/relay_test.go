@@ -0,0 +1,243 @@
+package sender
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5" //nolint:gosec // CRAM-MD5 is defined using MD5
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/models"
+)
+
+// cramMD5Server is server side of the CRAM-MD5 mechanism which go-sasl doesn't provide.
+type cramMD5Server struct {
+	conn    *smtp.Conn
+	backend *testBackend
+	sent    bool
+}
+
+const cramMD5Challenge = "<1896.697170952@postoffice.example.net>"
+
+func (a *cramMD5Server) Next(response []byte) ([]byte, bool, error) {
+	if !a.sent {
+		a.sent = true
+		return []byte(cramMD5Challenge), false, nil
+	}
+	parts := strings.SplitN(string(response), " ", 2)
+	if len(parts) != 2 {
+		return nil, false, errors.New("malformed response")
+	}
+	d := hmac.New(md5.New, []byte(a.backend.password))
+	d.Write([]byte(cramMD5Challenge))
+	if parts[1] != hex.EncodeToString(d.Sum(nil)) {
+		return nil, false, errors.New("invalid digest")
+	}
+	state := a.conn.State()
+	session, err := a.backend.Login(&state, parts[0], a.backend.password)
+	if err != nil {
+		return nil, false, err
+	}
+	a.conn.SetSession(session)
+	return nil, true, nil
+}
+
+// startRelay starts local relay server supporting PLAIN, LOGIN and CRAM-MD5 authentication.
+func startRelay(t *testing.T, be *testBackend, security string, cert tls.Certificate) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv := smtp.NewServer(be)
+	srv.Domain = "localhost"
+	srv.AllowInsecureAuth = true
+	switch security {
+	case cfg.RelayTLS:
+		l = tls.NewListener(l, tlsConfig)
+	case cfg.RelaySTARTTLS:
+		srv.TLSConfig = tlsConfig
+	}
+	srv.EnableAuth(sasl.Login, func(conn *smtp.Conn) sasl.Server {
+		return sasl.NewLoginServer(func(username, password string) error {
+			state := conn.State()
+			session, err := be.Login(&state, username, password)
+			if err != nil {
+				return err
+			}
+			conn.SetSession(session)
+			return nil
+		})
+	})
+	srv.EnableAuth("CRAM-MD5", func(conn *smtp.Conn) sasl.Server {
+		return &cramMD5Server{conn: conn, backend: be}
+	})
+	go srv.Serve(l) //nolint:errcheck
+	// closing the listener stops the server, Server.Close races with Serve that may not have started yet
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+// relayTransport configures the sender to deliver all emails through the relay.
+func relayTransport(t *testing.T, s *Sender, config cfg.RelayConfig) *RelayTransport {
+	s.config.Transport = cfg.TransportRelay
+	s.config.Relay = config
+	relay, err := NewRelayTransport(s.config)
+	require.NoError(t, err)
+	s.transports[cfg.TransportRelay] = relay
+	return relay
+}
+
+func TestSender_Send_Relay(t *testing.T) {
+	cert, pool := selfSignedCert(t, "relay.example.com")
+
+	tests := []struct {
+		Name     string
+		Host     string
+		Security string
+		Auth     string
+		Password string
+		WantErr  bool
+		WantTLS  bool
+	}{
+		{
+			Name:     "implicit TLS with PLAIN",
+			Security: cfg.RelayTLS,
+			Auth:     cfg.AuthPlain,
+			WantTLS:  true,
+		},
+		{
+			Name:     "STARTTLS with LOGIN",
+			Security: cfg.RelaySTARTTLS,
+			Auth:     cfg.AuthLogin,
+			WantTLS:  true,
+		},
+		{
+			Name:     "STARTTLS with CRAM-MD5",
+			Security: cfg.RelaySTARTTLS,
+			Auth:     cfg.AuthCRAMMD5,
+			WantTLS:  true,
+		},
+		{
+			Name:     "plaintext with PLAIN",
+			Host:     "localhost",
+			Security: cfg.RelayPlaintext,
+			Auth:     cfg.AuthPlain,
+		},
+		{
+			Name:     "invalid password",
+			Security: cfg.RelaySTARTTLS,
+			Auth:     cfg.AuthLogin,
+			Password: "invalid",
+			WantErr:  true,
+		},
+		{
+			Name:     "missing authentication",
+			Security: cfg.RelaySTARTTLS,
+			WantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			be := &testBackend{username: "mailback", password: "secret"}
+			addr := startRelay(t, be, tt.Security, cert)
+			_, port, err := net.SplitHostPort(addr)
+			require.NoError(t, err)
+
+			password := be.password
+			if tt.Password != "" {
+				password = tt.Password
+			}
+			host := "relay.example.com"
+			if tt.Host != "" {
+				host = tt.Host
+			}
+			s, _ := newTestSender(t)
+			relay := relayTransport(t, s, cfg.RelayConfig{
+				Host:     host,
+				Port:     port,
+				Security: tt.Security,
+				Auth:     tt.Auth,
+				Username: be.username,
+				Password: password,
+			})
+			relay.rootCAs = pool
+			relay.dial = stubDialer(map[string]string{host: addr})
+			// the MX hosts must not be contacted
+			mxTransport(s).dial = stubDialer(nil)
+
+			attempts, err := s.Send(context.Background(), &models.Entry{Mail: "joe@example.com", Title: "Plants"})
+			require.Len(t, attempts, 1, "should record the attempt")
+			assert.Equal(t, host, attempts[0].Host, "should deliver to the relay")
+			if tt.WantErr {
+				assert.Error(t, err, "should fail")
+				assert.Empty(t, be.received, "shouldn't deliver the email")
+				return
+			}
+			require.NoError(t, err, "shouldn't fail")
+			assert.Equal(t, tt.WantTLS, attempts[0].TLS, "should record whether TLS was used")
+			assert.Equal(t, []string{"joe@example.com"}, be.received, "should deliver the email")
+		})
+	}
+}
+
+func TestNewRelayTransport(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Host     string
+		Security string
+		WantErr  bool
+	}{
+		{Name: "plaintext to localhost", Host: "localhost", Security: cfg.RelayPlaintext},
+		{Name: "plaintext to IPv4 loopback", Host: "127.0.0.1", Security: cfg.RelayPlaintext},
+		{Name: "plaintext to IPv6 loopback", Host: "::1", Security: cfg.RelayPlaintext},
+		{Name: "plaintext to remote host", Host: "relay.example.com", Security: cfg.RelayPlaintext, WantErr: true},
+		{Name: "plaintext to remote address", Host: "192.0.2.1", Security: cfg.RelayPlaintext, WantErr: true},
+		{Name: "TLS to remote host", Host: "relay.example.com", Security: cfg.RelayTLS},
+		{Name: "unknown security", Host: "localhost", Security: "ssl", WantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			config := &cfg.SenderConfig{Relay: cfg.RelayConfig{
+				Host:     tt.Host,
+				Port:     "25",
+				Security: tt.Security,
+				Auth:     cfg.AuthPlain,
+				Username: "mailback",
+				Password: "secret",
+			}}
+			_, err := NewRelayTransport(config)
+			if tt.WantErr {
+				assert.Error(t, err, "should refuse the relay")
+				return
+			}
+			assert.NoError(t, err, "should accept the relay")
+		})
+	}
+}
+
+func TestSender_Send_RelayUntrusted(t *testing.T) {
+	cert, _ := selfSignedCert(t, "relay.example.com")
+	be := &testBackend{}
+	addr := startRelay(t, be, cfg.RelaySTARTTLS, cert)
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	s, _ := newTestSender(t)
+	relay := relayTransport(t, s, cfg.RelayConfig{Host: "relay.example.com", Port: port, Security: cfg.RelaySTARTTLS})
+	relay.dial = stubDialer(map[string]string{"relay.example.com": addr})
+
+	_, err = s.Send(context.Background(), &models.Entry{Mail: "joe@example.com", Title: "Plants"})
+	assert.Error(t, err, "should refuse relay with untrusted certificate")
+	assert.Empty(t, be.received, "shouldn't deliver the email")
+}
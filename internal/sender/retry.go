@@ -0,0 +1,43 @@
+package sender
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/jpillora/backoff"
+
+	"github.com/matoous/mailback/internal/cfg"
+)
+
+// retryPolicy decides whether and when temporarily failed deliveries are retried.
+type retryPolicy struct {
+	config cfg.RetryConfig
+}
+
+func newRetryPolicy(c cfg.RetryConfig) (*retryPolicy, error) {
+	switch {
+	case c.MaxAttempts < 1 || c.MaxAttempts > math.MaxUint8:
+		return nil, errors.New("retry max attempts must be between 1 and 255")
+	case c.MinBackoff <= 0 || c.MaxBackoff < c.MinBackoff:
+		return nil, errors.New("retry backoff must be positive and min backoff mustn't exceed max backoff")
+	case c.Factor < 1:
+		return nil, errors.New("retry factor must be at least 1")
+	}
+	return &retryPolicy{config: c}, nil
+}
+
+// next returns delay before the next attempt to deliver the entry that failed given number of times and has
+// been failing for given time. False is returned if the delivery should be given up.
+func (p *retryPolicy) next(fails uint8, failingFor time.Duration) (time.Duration, bool) {
+	if int(fails) >= p.config.MaxAttempts || failingFor >= p.config.MaxAge {
+		return 0, false
+	}
+	bo := backoff.Backoff{
+		Min:    p.config.MinBackoff,
+		Max:    p.config.MaxBackoff,
+		Factor: p.config.Factor,
+		Jitter: true,
+	}
+	return bo.ForAttempt(math.Max(float64(fails)-1, 0)), true
+}
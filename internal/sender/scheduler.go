@@ -0,0 +1,173 @@
+package sender
+
+import (
+	"container/heap"
+	"context"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"go.uber.org/zap"
+
+	"github.com/matoous/mailback/internal/models"
+	"github.com/matoous/mailback/internal/notify"
+)
+
+// maxScheduled limits the number of upcoming entries kept in memory.
+const maxScheduled = 1000
+
+// minReload is the minimal interval between reloads of the schedule triggered by the notifications, so that
+// flood of notifications doesn't overload the storage.
+const minReload = time.Second
+
+// scheduled is upcoming entry waiting in the schedule.
+type scheduled struct {
+	id string
+	at time.Time
+}
+
+// schedule is min-heap of the upcoming entries ordered by the time they are due.
+type schedule []scheduled
+
+func (s schedule) Len() int            { return len(s) }
+func (s schedule) Less(i, j int) bool  { return s[i].at.Before(s[j].at) }
+func (s schedule) Swap(i, j int)       { s[i], s[j] = s[j], s[i] }
+func (s *schedule) Push(x interface{}) { *s = append(*s, x.(scheduled)) }
+
+func (s *schedule) Pop() interface{} {
+	old := *s
+	x := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return x
+}
+
+// scheduler keeps the entries that are due within sliding window in memory, so that the sender can be woken up
+// right when the next entry is due instead of polling the storage.
+type scheduler struct {
+	entries schedule
+	// until is the end of the window, entries due later are loaded once the window slides.
+	until time.Time
+}
+
+// load replaces the schedule with the upcoming entries of the window. If the window is full, it ends with
+// the last loaded entry.
+func (s *scheduler) load(entries []models.Entry, until time.Time, full bool) {
+	s.entries = s.entries[:0]
+	for i := range entries {
+		s.entries = append(s.entries, scheduled{id: entries[i].ID, at: entries[i].ScheduledFor})
+	}
+	heap.Init(&s.entries)
+	s.until = until
+	if full && len(entries) > 0 {
+		s.until = entries[len(entries)-1].ScheduledFor
+	}
+}
+
+// next returns when the next entry is due, or the end of the window if there are no entries.
+func (s *scheduler) next() time.Time {
+	if len(s.entries) == 0 {
+		return s.until
+	}
+	return s.entries[0].at
+}
+
+// resetTimer resets the timer to fire at given time, draining it if it fired already.
+func resetTimer(t *time.Timer, at time.Time) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(time.Until(at))
+}
+
+// reschedule loads the upcoming entries from the storage. If they can't be loaded within the tick, the sender
+// waits for the next one.
+func (s *Sender) reschedule(ctx context.Context, sched *scheduler) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Tick)
+	defer cancel()
+	until := time.Now().Add(s.config.Window)
+	entries, err := s.db.UpcomingEntries(ctx, until, maxScheduled)
+	if err != nil {
+		s.log.Error("sender.schedule", zap.Error(err))
+		sched.load(nil, time.Now().Add(s.config.Tick), false)
+		return
+	}
+	sched.load(entries, until, len(entries) == maxScheduled)
+}
+
+// Run runs the sender, stopping only when the passed context is canceled. The sender sends the emails when
+// the next scheduled entry is due and it polls the storage every tick in case some notifications were lost.
+// The notifications of new entries aren't authenticated, so they only make the sender reload the schedule from
+// the storage, at most once per second.
+func (s *Sender) Run(ctx context.Context) {
+	s.log.Info("sender.start", zap.String("worker", s.worker))
+	var wake <-chan notify.Notification
+	if s.config.Notify.Addr != "" {
+		l, err := notify.Listen(s.config.Notify.Addr)
+		if err != nil {
+			s.log.Error("sender.notify.listen", zap.Error(err), zap.String("addr", s.config.Notify.Addr))
+		} else {
+			wake = l.Notifications(ctx)
+		}
+	}
+	s.run(ctx, wake)
+}
+
+func (s *Sender) run(ctx context.Context, wake <-chan notify.Notification) {
+	poll := time.NewTicker(s.config.Tick)
+	defer poll.Stop()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	reload := time.NewTimer(0)
+	defer reload.Stop()
+	<-reload.C
+	// reloading is set while the reload requested by the notifications is pending, so that they are coalesced
+	var reloading bool
+	var sched scheduler
+	var reloaded time.Time
+	// failed sending is retried with growing delay instead of when the entries are due, as they are due already
+	retry := backoff.Backoff{Min: time.Second, Max: s.config.Tick, Factor: 2, Jitter: true}
+	var retryAt time.Time
+	wakeAt := func() time.Time {
+		if next := sched.next(); next.After(retryAt) {
+			return next
+		}
+		return retryAt
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n, ok := <-wake:
+			if !ok {
+				s.log.Warn("sender.notify", zap.String("reason", "listener stopped"))
+				wake = nil
+			} else if !reloading {
+				s.log.Debug("sender.notify", zap.String("id", n.ID))
+				reloading = true
+				resetTimer(reload, reloaded.Add(minReload))
+			}
+			continue
+		case <-reload.C:
+			reloading = false
+			s.reschedule(ctx, &sched)
+			reloaded = time.Now()
+			resetTimer(timer, wakeAt())
+			continue
+		case <-poll.C:
+			s.log.Info("sender.tick")
+		case <-timer.C:
+		}
+		if _, err := s.SendMails(ctx); err != nil {
+			s.log.Error("sender.send_mails", zap.Error(err))
+			retryAt = time.Now().Add(retry.Duration())
+		} else {
+			retry.Reset()
+			retryAt = time.Time{}
+		}
+		s.reschedule(ctx, &sched)
+		reloaded = time.Now()
+		resetTimer(timer, wakeAt())
+	}
+}
@@ -0,0 +1,183 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/models"
+	"github.com/matoous/mailback/internal/notify"
+	"github.com/matoous/mailback/internal/store"
+)
+
+func TestScheduler(t *testing.T) {
+	now := time.Now()
+	var s scheduler
+	s.load([]models.Entry{
+		{ID: "b", ScheduledFor: now.Add(2 * time.Minute)},
+		{ID: "c", ScheduledFor: now.Add(3 * time.Minute)},
+	}, now.Add(time.Hour), false)
+	assert.Equal(t, now.Add(2*time.Minute), s.next(), "should wake up when the first entry is due")
+
+	s.load(nil, now.Add(time.Hour), false)
+	assert.Equal(t, now.Add(time.Hour), s.next(), "should wake up at the end of empty window")
+
+	s.load([]models.Entry{
+		{ID: "a", ScheduledFor: now.Add(time.Minute)},
+		{ID: "b", ScheduledFor: now.Add(2 * time.Minute)},
+	}, now.Add(time.Hour), true)
+	assert.Equal(t, now.Add(2*time.Minute), s.until, "should shrink full window to the loaded entries")
+}
+
+func TestSender_Run(t *testing.T) {
+	db := newMemoryStore(t, models.Entry{
+		ID:           "soon",
+		Mail:         "joe@example.com",
+		Title:        "Plants",
+		Status:       models.StatusScheduled,
+		ScheduledFor: time.Now().Add(200 * time.Millisecond),
+	})
+	s, _ := newTestSender(t)
+	s.db = db
+	s.config.Tick = time.Hour
+	s.config.Window = time.Hour
+	tr := &stubTransport{}
+	s.transports[cfg.TransportMX] = tr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wake := make(chan notify.Notification)
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx, wake)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	delivered := func(id string) bool {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		return tr.delivered[id] == 1
+	}
+	assert.Eventually(t, func() bool { return delivered("soon") }, 5*time.Second, 10*time.Millisecond,
+		"should deliver the entry when it is due without waiting for the tick")
+
+	// new entry is delivered right away once the sender is notified
+	now := time.Now()
+	require.NoError(t, db.Save(context.Background(), &models.Entry{
+		ID:           "new",
+		Mail:         "joe@example.com",
+		Title:        "Plants",
+		Status:       models.StatusScheduled,
+		ScheduledFor: now,
+	}))
+	wake <- notify.Notification{ID: "new", At: now}
+	assert.Eventually(t, func() bool { return delivered("new") }, 5*time.Second, 10*time.Millisecond,
+		"should deliver the new entry when notified")
+}
+
+// countingStore counts the loads of the schedule and the claims of the entries.
+type countingStore struct {
+	store.Store
+	loads  int32
+	claims int32
+	// claimErr is returned by all the claims if set
+	claimErr error
+}
+
+func (s *countingStore) UpcomingEntries(ctx context.Context, until time.Time, n int) ([]models.Entry, error) {
+	atomic.AddInt32(&s.loads, 1)
+	return s.Store.UpcomingEntries(ctx, until, n)
+}
+
+func (s *countingStore) Claim(ctx context.Context, worker string, until time.Time, n int) ([]models.Entry, error) {
+	atomic.AddInt32(&s.claims, 1)
+	if s.claimErr != nil {
+		return nil, s.claimErr
+	}
+	return s.Store.Claim(ctx, worker, until, n)
+}
+
+func TestSender_Run_ForgedNotifications(t *testing.T) {
+	db := &countingStore{Store: newMemoryStore(t, models.Entry{
+		ID:           "later",
+		Mail:         "joe@example.com",
+		Title:        "Plants",
+		Status:       models.StatusScheduled,
+		ScheduledFor: time.Now().Add(time.Hour),
+	})}
+	s, _ := newTestSender(t)
+	s.db = db
+	s.config.Tick = time.Hour
+	s.config.Window = 2 * time.Hour
+	tr := &stubTransport{}
+	s.transports[cfg.TransportMX] = tr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wake := make(chan notify.Notification)
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx, wake)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&db.loads) == 1 }, 5*time.Second,
+		10*time.Millisecond, "should load the schedule on start")
+	claims := atomic.LoadInt32(&db.claims)
+
+	// notifications claiming that the entry is due already are sent in a burst
+	for i := 0; i < 50; i++ {
+		wake <- notify.Notification{ID: "later", At: time.Now().Add(-time.Hour)}
+	}
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&db.loads) == 2 }, 5*time.Second,
+		10*time.Millisecond, "should reload the schedule when notified")
+	time.Sleep(2 * minReload)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&db.loads), "should reload the schedule once for the burst")
+	assert.Equal(t, claims, atomic.LoadInt32(&db.claims), "shouldn't send the emails before they are due")
+	assert.Zero(t, tr.delivered["later"], "shouldn't deliver the entry before it is due")
+}
+
+func TestSender_Run_Backoff(t *testing.T) {
+	db := &countingStore{
+		Store: newMemoryStore(t, models.Entry{
+			ID:           "due",
+			Mail:         "joe@example.com",
+			Title:        "Plants",
+			Status:       models.StatusScheduled,
+			ScheduledFor: time.Now().Add(-time.Minute),
+		}),
+		claimErr: errors.New("disk I/O error"),
+	}
+	s, _ := newTestSender(t)
+	s.db = db
+	s.config.Tick = time.Hour
+	s.config.Window = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx, nil)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&db.claims) > 0 }, 5*time.Second,
+		10*time.Millisecond, "should try to send the entries on start")
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&db.claims), "should wait before sending the due entries again")
+}
@@ -0,0 +1,222 @@
+package sender
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"go.uber.org/zap"
+
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/mail"
+	"github.com/matoous/mailback/internal/models"
+)
+
+// smtpPort is the port on which the MX hosts accept emails.
+const smtpPort = "25"
+
+// tlsError is returned when the TLS handshake with the host fails.
+type tlsError struct {
+	err error
+}
+
+func (e *tlsError) Error() string {
+	return "starttls: " + e.err.Error()
+}
+
+func (e *tlsError) Unwrap() error {
+	return e.err
+}
+
+// MXTransport delivers the emails directly to the MX hosts of the receivers.
+type MXTransport struct {
+	// hello is the name used in EHLO command.
+	hello string
+	// from is the envelope sender.
+	from   string
+	policy string
+	log    *zap.Logger
+
+	resolver mail.Resolver
+	dial     dialFunc
+	// sts caches MTA-STS policies of the receiving domains, nil if MTA-STS is disabled.
+	sts *mail.STSCache
+	// rootCAs are used to verify certificates of the MX hosts, nil means the system pool.
+	rootCAs *x509.CertPool
+}
+
+// NewMXTransport creates new transport delivering to the MX hosts with configured TLS policy.
+func NewMXTransport(config *cfg.SenderConfig, log *zap.Logger) *MXTransport {
+	t := &MXTransport{
+		hello:    config.Host,
+		from:     config.Address(),
+		policy:   config.TLSPolicy,
+		log:      log,
+		resolver: mail.DefaultResolver,
+		dial:     defaultDial,
+	}
+	if config.MTASTS {
+		t.sts = mail.NewSTSCache(&http.Client{Timeout: time.Minute})
+	}
+	return t
+}
+
+// stsPolicy returns MTA-STS policy of the domain, nil if the domain doesn't have any or MTA-STS is disabled.
+func (t *MXTransport) stsPolicy(ctx context.Context, domain string) *mail.STSPolicy {
+	if t.sts == nil {
+		return nil
+	}
+	p, err := t.sts.Policy(ctx, t.resolver, domain)
+	if err != nil {
+		// without valid policy the email is delivered as if the domain had none (RFC 8461 section 5)
+		t.log.Warn("sender.send.mta_sts", zap.String("domain", domain), zap.Error(err))
+		return nil
+	}
+	if p == nil || p.Mode == mail.STSModeNone {
+		return nil
+	}
+	return p
+}
+
+// hostPolicy returns TLS policy for the MX host, MTA-STS policy in enforce mode requires verified TLS.
+func (t *MXTransport) hostPolicy(host string, sts *mail.STSPolicy) (string, error) {
+	if sts == nil {
+		return t.policy, nil
+	}
+	if !sts.Match(host) {
+		if sts.Mode == mail.STSModeEnforce {
+			return "", fmt.Errorf("MX host %s is not allowed by MTA-STS policy", host)
+		}
+		t.log.Warn("sender.send.mta_sts", zap.String("host", host), zap.String("reason", "host not allowed by policy"))
+		return t.policy, nil
+	}
+	if sts.Mode == mail.STSModeEnforce {
+		return cfg.TLSVerify, nil
+	}
+	return t.policy, nil
+}
+
+// Deliver sends the message to the SMTP servers of the email receiver. The MX hosts of the receiver's domain are
+// tried in order of preference until one of them accepts the email (RFC 5321 section 5.1). Permanent rejection
+// stops the delivery as other hosts of the same domain would most likely reject the email too.
+func (t *MXTransport) Deliver(ctx context.Context, e *models.Entry, msg []byte) ([]Attempt, error) {
+	domain := mail.Host(e.Mail)
+	hosts, err := mail.LookupMX(ctx, t.resolver, domain)
+	if err != nil {
+		return nil, lookupError(err)
+	}
+	sts := t.stsPolicy(ctx, domain)
+
+	attempts := make([]Attempt, 0, len(hosts))
+	for _, host := range hosts {
+		policy, err := t.hostPolicy(host, sts)
+		if err != nil {
+			attempts = append(attempts, Attempt{Host: host, Start: time.Now(), Err: err})
+			continue
+		}
+		a := t.deliver(ctx, host, e.Mail, msg, policy)
+		attempts = append(attempts, a)
+		if a.Err == nil {
+			return attempts, nil
+		}
+		t.log.Warn("sender.send.host", zap.String("host", host), zap.Error(a.Err))
+		if isPermanent(a.Err) {
+			break
+		}
+	}
+	return attempts, attempts[len(attempts)-1].Err
+}
+
+// deliver delivers the message to single MX host respecting the TLS policy. With opportunistic policy
+// the delivery is retried without TLS if the TLS handshake fails.
+func (t *MXTransport) deliver(ctx context.Context, host, to string, msg []byte, policy string) Attempt {
+	a := Attempt{Host: host, Start: time.Now()}
+	a.Err = t.transmit(ctx, &a, to, msg, policy, true)
+	var tlsErr *tlsError
+	if errors.As(a.Err, &tlsErr) && policy == cfg.TLSOpportunistic {
+		t.log.Warn("sender.send.starttls", zap.String("host", host), zap.Error(a.Err))
+		a.TLS, a.Verified = false, false
+		a.Err = t.transmit(ctx, &a, to, msg, policy, false)
+	}
+	a.Duration = time.Since(a.Start)
+	return a
+}
+
+// tlsConfig returns configuration of TLS connection to the host. Certificates are verified only with the verify
+// policy as MX hosts often use certificates that don't match their names.
+func (t *MXTransport) tlsConfig(host, policy string) *tls.Config {
+	return &tls.Config{
+		ServerName:         host,
+		RootCAs:            t.rootCAs,
+		InsecureSkipVerify: policy != cfg.TLSVerify, //nolint:gosec // opportunistic encryption (RFC 7435)
+	}
+}
+
+// transmit connects to the host and transmits the message, recording the TLS state into the attempt.
+func (t *MXTransport) transmit(ctx context.Context, a *Attempt, to string, msg []byte, policy string, useTLS bool) error {
+	conn, err := connect(ctx, t.dial, net.JoinHostPort(a.Host, smtpPort))
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, a.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello(t.hello); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok && useTLS {
+		if err := c.StartTLS(t.tlsConfig(a.Host, policy)); err != nil {
+			return &tlsError{err: err}
+		}
+		a.TLS, a.Verified = true, policy == cfg.TLSVerify
+	} else if policy != cfg.TLSOpportunistic {
+		return fmt.Errorf("%s doesn't support STARTTLS", a.Host)
+	}
+	return sendMessage(c, t.from, to, msg)
+}
+
+// connect connects to the address, the deadline of the connection is set from the context.
+func connect(ctx context.Context, dial dialFunc, addr string) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// sendMessage sends the message over established SMTP session and ends the session.
+func sendMessage(c *smtp.Client, from, to string, msg []byte) error {
+	if err := c.Mail(from, nil); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
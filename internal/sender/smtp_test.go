@@ -0,0 +1,415 @@
+package sender
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/mail"
+	"github.com/matoous/mailback/internal/models"
+)
+
+// testBackend is SMTP backend that records received emails or rejects them with given error. If the username
+// is set, the clients must authenticate.
+type testBackend struct {
+	mu                 sync.Mutex
+	reject             error
+	received           []string
+	username, password string
+}
+
+func (b *testBackend) Login(_ *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if b.username == "" {
+		return nil, smtp.ErrAuthUnsupported
+	}
+	if username != b.username || password != b.password {
+		return nil, errors.New("invalid username or password")
+	}
+	return &testSession{backend: b}, nil
+}
+
+func (b *testBackend) AnonymousLogin(_ *smtp.ConnectionState) (smtp.Session, error) {
+	if b.username != "" {
+		return nil, smtp.ErrAuthRequired
+	}
+	return &testSession{backend: b}, nil
+}
+
+type testSession struct {
+	backend *testBackend
+	to      string
+}
+
+func (s *testSession) Reset()        {}
+func (s *testSession) Logout() error { return nil }
+
+func (s *testSession) Mail(_ string, _ smtp.MailOptions) error {
+	return nil
+}
+
+func (s *testSession) Rcpt(to string) error {
+	if s.backend.reject != nil {
+		return s.backend.reject
+	}
+	s.to = to
+	return nil
+}
+
+func (s *testSession) Data(r io.Reader) error {
+	if _, err := ioutil.ReadAll(r); err != nil {
+		return err
+	}
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	s.backend.received = append(s.backend.received, s.to)
+	return nil
+}
+
+// startServer starts local SMTP server and returns its address. The server offers STARTTLS if the TLS
+// config is set.
+func startServer(t *testing.T, be smtp.Backend, tlsConfig ...*tls.Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := smtp.NewServer(be)
+	srv.Domain = "localhost"
+	if len(tlsConfig) > 0 {
+		srv.TLSConfig = tlsConfig[0]
+	}
+	go srv.Serve(l) //nolint:errcheck
+	// closing the listener stops the server, Server.Close races with Serve that may not have started yet
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+// stubDialer connects to local servers instead of the MX hosts, hosts without server refuse the connection.
+func stubDialer(servers map[string]string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		local, ok := servers[host]
+		if !ok {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, local)
+	}
+}
+
+// mxTransport returns the MX transport of the sender so that the tests can replace the resolver and dialer.
+func mxTransport(s *Sender) *MXTransport {
+	return s.transports[cfg.TransportMX].(*MXTransport)
+}
+
+func TestSender_Send(t *testing.T) {
+	temporary := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Try again later"}
+	permanent := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+
+	tests := []struct {
+		Name string
+		// Backends are the servers of the MX hosts in order of preference, nil backend refuses connections.
+		Backends     []*testBackend
+		WantErr      bool
+		WantReceived []int
+	}{
+		{
+			Name:         "first host accepts",
+			Backends:     []*testBackend{{}, {}},
+			WantReceived: []int{1, 0},
+		},
+		{
+			Name:         "first host unreachable",
+			Backends:     []*testBackend{nil, {}},
+			WantReceived: []int{0, 1},
+		},
+		{
+			Name:         "first host temporarily rejects",
+			Backends:     []*testBackend{{reject: temporary}, {}},
+			WantReceived: []int{0, 1},
+		},
+		{
+			Name:         "first host permanently rejects",
+			Backends:     []*testBackend{{reject: permanent}, {}},
+			WantErr:      true,
+			WantReceived: []int{0, 0},
+		},
+		{
+			Name:         "all hosts fail",
+			Backends:     []*testBackend{nil, {reject: temporary}},
+			WantErr:      true,
+			WantReceived: []int{0, 0},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			hosts := []string{"mx1.example.com", "mx2.example.com"}
+			res := &stubResolver{mx: map[string][]*net.MX{
+				"example.com": {{Host: hosts[1] + ".", Pref: 20}, {Host: hosts[0] + ".", Pref: 10}},
+			}}
+			servers := make(map[string]string)
+			for i, be := range tt.Backends {
+				if be != nil {
+					servers[hosts[i]] = startServer(t, be)
+				}
+			}
+			s, _ := newTestSender(t)
+			mx := mxTransport(s)
+			mx.resolver = res
+			mx.dial = stubDialer(servers)
+
+			attempts, err := s.Send(context.Background(), &models.Entry{Mail: "joe@example.com", Title: "Plants"})
+			assert.NotEmpty(t, attempts, "should record the attempts")
+			if tt.WantErr {
+				assert.Error(t, err, "should fail")
+			} else {
+				assert.NoError(t, err, "shouldn't fail")
+			}
+			for i, be := range tt.Backends {
+				if be == nil {
+					continue
+				}
+				be.mu.Lock()
+				assert.Len(t, be.received, tt.WantReceived[i], "should deliver to %s", hosts[i])
+				be.mu.Unlock()
+			}
+		})
+	}
+}
+
+func TestSender_Send_ImplicitMX(t *testing.T) {
+	be := &testBackend{}
+	s, _ := newTestSender(t)
+	mx := mxTransport(s)
+	mx.resolver = &stubResolver{ip: map[string][]net.IPAddr{
+		"example.com": {{IP: net.ParseIP("127.0.0.1")}},
+	}}
+	mx.dial = stubDialer(map[string]string{"example.com": startServer(t, be)})
+
+	_, err := s.Send(context.Background(), &models.Entry{Mail: "joe@example.com", Title: "Plants"})
+	require.NoError(t, err, "shouldn't fail")
+	assert.Equal(t, []string{"joe@example.com"}, be.received, "should deliver to the domain itself")
+}
+
+func TestSender_Send_NullMX(t *testing.T) {
+	s, _ := newTestSender(t)
+	mx := mxTransport(s)
+	mx.resolver = &stubResolver{mx: map[string][]*net.MX{"example.com": {{Host: ".", Pref: 0}}}}
+	mx.dial = stubDialer(nil)
+
+	_, err := s.Send(context.Background(), &models.Entry{Mail: "joe@example.com", Title: "Plants"})
+	assert.Error(t, err, "should refuse to deliver to domain with null MX")
+}
+
+// selfSignedCert creates self-signed certificate for the host and pool that trusts it.
+func selfSignedCert(t *testing.T, host string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestSender_Send_TLS(t *testing.T) {
+	cert, pool := selfSignedCert(t, "mx.example.com")
+	withCert := &tls.Config{Certificates: []tls.Certificate{cert}}
+	// server without certificate offers STARTTLS but the handshake fails
+	broken := &tls.Config{}
+
+	tests := []struct {
+		Name         string
+		Policy       string
+		ServerTLS    *tls.Config
+		Trusted      bool
+		WantErr      bool
+		WantTLS      bool
+		WantVerified bool
+	}{
+		{
+			Name:      "opportunistic with TLS",
+			Policy:    cfg.TLSOpportunistic,
+			ServerTLS: withCert,
+			WantTLS:   true,
+		},
+		{
+			Name:   "opportunistic without TLS",
+			Policy: cfg.TLSOpportunistic,
+		},
+		{
+			Name:      "opportunistic with failing handshake",
+			Policy:    cfg.TLSOpportunistic,
+			ServerTLS: broken,
+		},
+		{
+			Name:      "require with untrusted certificate",
+			Policy:    cfg.TLSRequire,
+			ServerTLS: withCert,
+			WantTLS:   true,
+		},
+		{
+			Name:    "require without TLS",
+			Policy:  cfg.TLSRequire,
+			WantErr: true,
+		},
+		{
+			Name:      "require with failing handshake",
+			Policy:    cfg.TLSRequire,
+			ServerTLS: broken,
+			WantErr:   true,
+		},
+		{
+			Name:         "verify with trusted certificate",
+			Policy:       cfg.TLSVerify,
+			ServerTLS:    withCert,
+			Trusted:      true,
+			WantTLS:      true,
+			WantVerified: true,
+		},
+		{
+			Name:      "verify with untrusted certificate",
+			Policy:    cfg.TLSVerify,
+			ServerTLS: withCert,
+			WantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			be := &testBackend{}
+			var addr string
+			if tt.ServerTLS != nil {
+				addr = startServer(t, be, tt.ServerTLS)
+			} else {
+				addr = startServer(t, be)
+			}
+			s, _ := newTestSender(t)
+			mx := mxTransport(s)
+			mx.policy = tt.Policy
+			mx.resolver = &stubResolver{mx: map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}}}
+			mx.dial = stubDialer(map[string]string{"mx.example.com": addr})
+			if tt.Trusted {
+				mx.rootCAs = pool
+			}
+
+			attempts, err := s.Send(context.Background(), &models.Entry{Mail: "joe@example.com", Title: "Plants"})
+			if tt.WantErr {
+				assert.Error(t, err, "should refuse to deliver")
+				assert.Empty(t, be.received, "shouldn't deliver the email")
+				return
+			}
+			require.NoError(t, err, "shouldn't fail")
+			require.Len(t, attempts, 1, "should record the attempt")
+			assert.Equal(t, "mx.example.com", attempts[0].Host, "should record the host")
+			assert.Equal(t, tt.WantTLS, attempts[0].TLS, "should record whether TLS was used")
+			assert.Equal(t, tt.WantVerified, attempts[0].Verified, "should record whether the certificate was verified")
+			assert.Len(t, be.received, 1, "should deliver the email")
+		})
+	}
+}
+
+func TestSender_Send_MTASTS(t *testing.T) {
+	cert, pool := selfSignedCert(t, "mx.example.com")
+	policyServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n")
+	}))
+	t.Cleanup(policyServer.Close)
+	client := policyServer.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig.ServerName = "example.com"
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, policyServer.Listener.Addr().String())
+	}
+
+	tests := []struct {
+		Name         string
+		Trusted      bool
+		WantErr      bool
+		WantAttempts int
+	}{
+		{
+			Name:         "trusted certificate",
+			Trusted:      true,
+			WantAttempts: 2,
+		},
+		{
+			Name:         "untrusted certificate",
+			WantErr:      true,
+			WantAttempts: 2,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			be := &testBackend{}
+			res := &stubResolver{
+				txt: map[string][]string{"_mta-sts.example.com": {"v=STSv1; id=1"}},
+				// the backup host isn't allowed by the policy
+				mx: map[string][]*net.MX{"example.com": {
+					{Host: "backup.example.net.", Pref: 5},
+					{Host: "mx.example.com.", Pref: 10},
+				}},
+			}
+			unencrypted := &testBackend{}
+			s, _ := newTestSender(t)
+			mx := mxTransport(s)
+			mx.resolver = res
+			mx.sts = mail.NewSTSCache(client)
+			mx.dial = stubDialer(map[string]string{
+				"backup.example.net": startServer(t, unencrypted),
+				"mx.example.com":     startServer(t, be, &tls.Config{Certificates: []tls.Certificate{cert}}),
+			})
+			if tt.Trusted {
+				mx.rootCAs = pool
+			}
+
+			attempts, err := s.Send(context.Background(), &models.Entry{Mail: "joe@example.com", Title: "Plants"})
+			assert.Len(t, attempts, tt.WantAttempts, "should record the attempts")
+			assert.Empty(t, unencrypted.received, "shouldn't deliver to hosts not allowed by the policy")
+			if tt.WantErr {
+				assert.Error(t, err, "should refuse to deliver")
+				assert.Empty(t, be.received, "shouldn't deliver the email")
+				return
+			}
+			require.NoError(t, err, "shouldn't fail")
+			assert.True(t, attempts[1].Verified, "should verify the certificate")
+			assert.Len(t, be.received, 1, "should deliver the email")
+		})
+	}
+}
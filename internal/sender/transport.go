@@ -0,0 +1,119 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/models"
+)
+
+// Transport delivers the emails to the receivers.
+type Transport interface {
+	// Deliver delivers the prepared message of the entry. All attempts to deliver the message are returned,
+	// including the failed ones.
+	Deliver(ctx context.Context, e *models.Entry, msg []byte) ([]Attempt, error)
+}
+
+// Attempt records single attempt to deliver the email, such as delivery to one of the MX hosts.
+type Attempt struct {
+	// Host is the host the email was delivered to, or the destination of local transports.
+	Host     string
+	Start    time.Time
+	Duration time.Duration
+	// TLS reports whether the email was transmitted over TLS.
+	TLS bool
+	// Verified reports whether the certificate of the host was verified.
+	Verified bool
+	// Err is the reason why the delivery failed, nil if the email was accepted.
+	Err error
+}
+
+// dialFunc connects to the address on the named network.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialTimeout limits how long it takes to connect to single host.
+const dialTimeout = 30 * time.Second
+
+// defaultDial is the dialer used by the SMTP transports.
+var defaultDial dialFunc = (&net.Dialer{Timeout: dialTimeout}).DialContext
+
+// newTransports creates all transports that are configured. Direct delivery to the MX hosts is always
+// available, the other transports only if they are configured.
+func newTransports(config *cfg.SenderConfig, log *zap.Logger) (map[string]Transport, error) {
+	transports := map[string]Transport{
+		cfg.TransportMX: NewMXTransport(config, log),
+	}
+	if config.Relay.Host != "" {
+		relay, err := NewRelayTransport(config)
+		if err != nil {
+			return nil, err
+		}
+		transports[cfg.TransportRelay] = relay
+	}
+	if config.Maildir != "" {
+		maildir, err := NewMaildirTransport(config.Maildir)
+		if err != nil {
+			return nil, err
+		}
+		transports[cfg.TransportMaildir] = maildir
+	}
+	if config.Mbox != "" {
+		transports[cfg.TransportMbox] = NewMboxTransport(config.Mbox, config.Address())
+	}
+	if config.Webhook.URL != "" {
+		transports[cfg.TransportWebhook] = NewWebhookTransport(&config.Webhook)
+	}
+	if _, ok := transports[config.Transport]; !ok {
+		return nil, fmt.Errorf("transport %q is unknown or not configured", config.Transport)
+	}
+	return transports, nil
+}
+
+// transport returns the transport of the entry, entries without transport use the configured default. The
+// transport of the entry is chosen by the receiver, so entries with transport that isn't configured fall back
+// to the default one too.
+func (s *Sender) transport(e *models.Entry) (Transport, error) {
+	if e.Transport != "" {
+		if t, ok := s.transports[e.Transport]; ok {
+			return t, nil
+		}
+		s.log.Warn("sender.transport.unknown",
+			zap.String("id", e.ID),
+			zap.String("transport", e.Transport),
+			zap.String("default", s.config.Transport),
+		)
+	}
+	t, ok := s.transports[s.config.Transport]
+	if !ok {
+		return nil, fmt.Errorf("transport %q is unknown or not configured", s.config.Transport)
+	}
+	return t, nil
+}
+
+// prepare prepares the email and finds the transport that delivers it.
+func (s *Sender) prepare(e *models.Entry) (Transport, []byte, error) {
+	t, err := s.transport(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := s.PrepareMail(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, msg, nil
+}
+
+// Send prepares the email and delivers it using the transport of the entry. All attempts are returned,
+// including the failed ones.
+func (s *Sender) Send(ctx context.Context, e *models.Entry) ([]Attempt, error) {
+	t, msg, err := s.prepare(e)
+	if err != nil {
+		return nil, err
+	}
+	return t.Deliver(ctx, e, msg)
+}
@@ -0,0 +1,155 @@
+package sender
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/models"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mailback-transport")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestMaildirTransport_Deliver(t *testing.T) {
+	dir := filepath.Join(tempDir(t), "Maildir")
+	tr, err := NewMaildirTransport(dir)
+	require.NoError(t, err, "should create the maildir")
+
+	for _, msg := range []string{"Subject: first\r\n\r\nHello\r\n", "Subject: second\r\n\r\nHello\r\n"} {
+		attempts, err := tr.Deliver(context.Background(), &models.Entry{}, []byte(msg))
+		require.NoError(t, err, "shouldn't fail")
+		assert.Len(t, attempts, 1, "should record the attempt")
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	require.Len(t, files, 2, "should deliver the messages into new directory")
+	content, err := ioutil.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "Hello", "should write the message")
+	tmp, err := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, tmp, "shouldn't leave temporary files")
+}
+
+func TestMboxTransport_Deliver(t *testing.T) {
+	path := filepath.Join(tempDir(t), "mbox")
+	tr := NewMboxTransport(path, "postman@mailback.io")
+
+	for _, msg := range []string{"Subject: first\r\n\r\nFrom here\r\n>From there\r\n", "Subject: second\r\n\r\nHello\r\n"} {
+		_, err := tr.Deliver(context.Background(), &models.Entry{}, []byte(msg))
+		require.NoError(t, err, "shouldn't fail")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	date := `[A-Z][a-z]{2} [A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2} \d{4}`
+	assert.Regexp(t, "^From postman@mailback.io "+date+"\n"+
+		"Subject: first\n\n>From here\n>>From there\n\n"+
+		"From postman@mailback.io "+date+"\n"+
+		"Subject: second\n\nHello\n\n$", string(content), "should append the messages in mboxrd format")
+}
+
+func TestWebhookTransport_Deliver(t *testing.T) {
+	var payload map[string]interface{}
+	var signature string
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"), "should post JSON")
+		signature = r.Header.Get(signatureHeader)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signature, "should sign the body")
+		require.NoError(t, json.Unmarshal(body, &payload))
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	tr := NewWebhookTransport(&cfg.WebhookConfig{URL: srv.URL, Secret: "secret"})
+	e := &models.Entry{
+		ID:           "abc",
+		Mail:         "joe@example.com",
+		Title:        "Plants",
+		Data:         "Water the plants",
+		ScheduledFor: time.Date(2020, 4, 1, 10, 0, 0, 0, time.UTC),
+		Attachments:  []models.Attachment{{ID: "att", Filename: "plant.jpg", ContentType: "image/jpeg", Size: 3}},
+	}
+	attempts, err := tr.Deliver(context.Background(), e, nil)
+	require.NoError(t, err, "shouldn't fail")
+	require.Len(t, attempts, 1, "should record the attempt")
+	assert.Equal(t, "abc", payload["id"], "should post the entry")
+	assert.Equal(t, "joe@example.com", payload["mail"], "should post the entry")
+	assert.Equal(t, "Water the plants", payload["text"], "should post the entry")
+	assert.Equal(t, "2020-04-01T10:00:00Z", payload["scheduled_for"], "should post the entry")
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"filename": "plant.jpg", "content_type": "image/jpeg", "size": float64(3),
+	}}, payload["attachments"], "should describe the attachments")
+
+	status = http.StatusBadGateway
+	_, err = tr.Deliver(context.Background(), e, nil)
+	assert.Error(t, err, "should fail on unsuccessful response")
+}
+
+func TestSender_Send_Transport(t *testing.T) {
+	dir := tempDir(t)
+	s, _ := newTestSender(t)
+	var err error
+	s.transports, err = newTransports(&cfg.SenderConfig{
+		Host:      "mailback.io",
+		TLSPolicy: cfg.TLSOpportunistic,
+		Transport: cfg.TransportMbox,
+		Mbox:      filepath.Join(dir, "mbox"),
+		Maildir:   filepath.Join(dir, "Maildir"),
+	}, zap.NewNop())
+	require.NoError(t, err)
+	s.config.Transport = cfg.TransportMbox
+
+	_, err = s.Send(context.Background(), &models.Entry{Mail: "joe@example.com", Title: "Plants"})
+	require.NoError(t, err, "shouldn't fail")
+	_, err = os.Stat(filepath.Join(dir, "mbox"))
+	assert.NoError(t, err, "should use the default transport")
+
+	_, err = s.Send(context.Background(), &models.Entry{Mail: "joe@example.com", Title: "Plants", Transport: cfg.TransportMaildir})
+	require.NoError(t, err, "shouldn't fail")
+	files, err := ioutil.ReadDir(filepath.Join(dir, "Maildir", "new"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1, "should use the transport of the entry")
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "mbox")))
+	_, err = s.Send(context.Background(), &models.Entry{Mail: "joe@example.com", Title: "Plants", Transport: cfg.TransportWebhook})
+	require.NoError(t, err, "shouldn't fail for transports that aren't configured")
+	_, err = os.Stat(filepath.Join(dir, "mbox"))
+	assert.NoError(t, err, "should fall back to the default transport")
+}
+
+func TestNewTransports(t *testing.T) {
+	_, err := newTransports(&cfg.SenderConfig{Transport: cfg.TransportWebhook}, zap.NewNop())
+	assert.Error(t, err, "should fail if the default transport isn't configured")
+
+	_, err = newTransports(&cfg.SenderConfig{
+		Transport: cfg.TransportRelay,
+		Relay:     cfg.RelayConfig{Host: "relay.example.com", Security: "ssl"},
+	}, zap.NewNop())
+	assert.Error(t, err, "should validate the relay configuration")
+}
@@ -0,0 +1,138 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/models"
+)
+
+const (
+	// webhookTimeout limits how long single webhook request can take.
+	webhookTimeout = 30 * time.Second
+	// signatureHeader holds HMAC-SHA256 of the request body if the webhook secret is configured.
+	signatureHeader = "X-Mailback-Signature"
+)
+
+// webhookAttachment describes the attachment of the entry, the content isn't part of the payload.
+type webhookAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// webhookPayload is the JSON body of the webhook request.
+type webhookPayload struct {
+	ID        string `json:"id"`
+	Mail      string `json:"mail"`
+	Title     string `json:"title"`
+	Text      string `json:"text"`
+	HTML      string `json:"html,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	// DeliveryID is the Message-ID of the delivered occurrence, it stays the same for the retries.
+	DeliveryID   string              `json:"delivery_id,omitempty"`
+	Period       string              `json:"period,omitempty"`
+	Recurrence   string              `json:"recurrence,omitempty"`
+	ScheduledFor time.Time           `json:"scheduled_for"`
+	CreatedAt    time.Time           `json:"created_at"`
+	Attachments  []webhookAttachment `json:"attachments,omitempty"`
+}
+
+func newWebhookPayload(e *models.Entry) *webhookPayload {
+	p := &webhookPayload{
+		ID:           e.ID,
+		Mail:         e.Mail,
+		Title:        e.Title,
+		Text:         e.Data,
+		HTML:         e.HTML,
+		MessageID:    e.MessageID,
+		DeliveryID:   e.OutboundMessageID,
+		Recurrence:   e.Recurrence,
+		ScheduledFor: e.ScheduledFor,
+		CreatedAt:    e.CreatedAt,
+	}
+	if e.Period != nil {
+		p.Period = e.Period.String()
+	}
+	for _, a := range e.Attachments {
+		p.Attachments = append(p.Attachments, webhookAttachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        a.Size,
+		})
+	}
+	return p
+}
+
+// WebhookTransport posts the entries as JSON to configured URL instead of sending emails.
+type WebhookTransport struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// NewWebhookTransport creates new transport posting to the configured webhook.
+func NewWebhookTransport(config *cfg.WebhookConfig) *WebhookTransport {
+	return &WebhookTransport{
+		url:    config.URL,
+		secret: config.Secret,
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Deliver posts the entry to the webhook, any 2xx response means the entry was delivered.
+func (t *WebhookTransport) Deliver(ctx context.Context, e *models.Entry, _ []byte) ([]Attempt, error) {
+	a := Attempt{Host: t.url, Start: time.Now()}
+	if u, err := url.Parse(t.url); err == nil {
+		a.Host = u.Host
+		a.TLS = u.Scheme == "https"
+		a.Verified = a.TLS
+	}
+	a.Err = t.post(ctx, e)
+	a.Duration = time.Since(a.Start)
+	return []Attempt{a}, a.Err
+}
+
+func (t *WebhookTransport) post(ctx context.Context, e *models.Entry) error {
+	body, err := json.Marshal(newWebhookPayload(e))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.secret != "" {
+		mac := hmac.New(sha256.New, []byte(t.secret))
+		mac.Write(body)
+		req.Header.Set(signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body so that the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &DeliveryError{
+			Err: fmt.Errorf("webhook responded with %s", resp.Status),
+			// client errors won't go away by retrying, except for timeouts and rate limiting
+			Permanent: resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+				resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests,
+		}
+	}
+	return nil
+}
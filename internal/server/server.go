@@ -1,9 +1,14 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/certmagic"
 	"github.com/go-acme/lego/v3/providers/dns/cloudflare"
@@ -11,23 +16,27 @@ import (
 
 	"github.com/gofiber/fiber"
 
+	"github.com/matoous/mailback/internal/blob"
 	"github.com/matoous/mailback/internal/cfg"
 	"github.com/matoous/mailback/internal/models"
 	"github.com/matoous/mailback/internal/store"
 )
 
-// Store is storage of entries that can delete an entry by the id from unsubscribe link.
-type Store interface {
-	Delete(e *models.Entry) error
-}
-
 // Server is web server.
 type Server struct {
-	store     Store
+	store     store.Store
+	blobs     blob.Store
 	log       *zap.Logger
 	router    *fiber.App
 	tlsConfig *tls.Config
 	port      string
+	token     string
+	timeout   time.Duration
+}
+
+// requestContext returns context of the storage operations of single request.
+func (s *Server) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
 }
 
 func (s *Server) handleIndex(ctx *fiber.Ctx) {
@@ -37,7 +46,12 @@ func (s *Server) handleIndex(ctx *fiber.Ctx) {
 }
 
 func (s *Server) handleUnsubscribe(ctx *fiber.Ctx) {
-	err := s.store.Delete(&models.Entry{ID: ctx.Params("id")})
+	rctx, cancel := s.requestContext()
+	defer cancel()
+	e, err := s.store.Entry(rctx, ctx.Params("id"))
+	if err == nil {
+		err = s.store.Delete(rctx, e)
+	}
 	switch {
 	case errors.Is(err, store.ErrNotFound):
 		ctx.Status(http.StatusNotFound)
@@ -45,16 +59,64 @@ func (s *Server) handleUnsubscribe(ctx *fiber.Ctx) {
 	case err != nil:
 		ctx.Status(http.StatusInternalServerError)
 	default:
+		for _, a := range e.Attachments {
+			if err := s.blobs.Delete(a.ID); err != nil {
+				s.log.Error("server.unsubscribe.remove_attachment", zap.Error(err), zap.String("id", a.ID))
+			}
+		}
 		ctx.SendString("Unsubscribed!")
 	}
 }
 
-// New creates new server that can handle clicks on unsubscribe links.
-func New(s Store, l *zap.Logger, config cfg.WebServerConfig) (*Server, error) {
+// authorize checks the bearer token of the operator API requests.
+func (s *Server) authorize(ctx *fiber.Ctx) {
+	token := strings.TrimPrefix(ctx.Get(fiber.HeaderAuthorization), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		ctx.SendStatus(http.StatusUnauthorized)
+		return
+	}
+	ctx.Next()
+}
+
+func (s *Server) handleAttempts(ctx *fiber.Ctx) {
+	rctx, cancel := s.requestContext()
+	defer cancel()
+	id := ctx.Params("id")
+	_, err := s.store.Entry(rctx, id)
+	var attempts []models.DeliveryAttempt
+	if err == nil {
+		attempts, err = s.store.Attempts(rctx, id)
+	}
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		ctx.SendStatus(http.StatusNotFound)
+	case err != nil:
+		s.log.Error("server.attempts", zap.Error(err), zap.String("id", id))
+		ctx.SendStatus(http.StatusInternalServerError)
+	default:
+		if attempts == nil {
+			attempts = []models.DeliveryAttempt{}
+		}
+		if err := ctx.JSON(attempts); err != nil {
+			s.log.Error("server.attempts.encode", zap.Error(err))
+			ctx.SendStatus(http.StatusInternalServerError)
+		}
+	}
+}
+
+// New creates new server that can handle clicks on unsubscribe links. If the admin token is configured,
+// the server also serves the operator API.
+func New(s store.Store, blobs blob.Store, l *zap.Logger, config cfg.WebServerConfig) (*Server, error) {
+	if config.RequestTimeout <= 0 {
+		return nil, fmt.Errorf("request timeout %s must be positive", config.RequestTimeout)
+	}
 	srv := &Server{
-		store: s,
-		log:   l,
-		port:  config.Port,
+		store:   s,
+		blobs:   blobs,
+		log:     l,
+		port:    config.Port,
+		token:   config.AdminToken,
+		timeout: config.RequestTimeout,
 	}
 
 	if config.Host != "localhost" {
@@ -76,6 +138,10 @@ func New(s Store, l *zap.Logger, config cfg.WebServerConfig) (*Server, error) {
 		TemplateEngine: "html",
 	})
 	router.Get("/unsubscribe/:id", srv.handleUnsubscribe)
+	if srv.token != "" {
+		// read-only API for operators
+		router.Get("/api/entries/:id/attempts", srv.authorize, srv.handleAttempts)
+	}
 	router.Get("/", srv.handleIndex)
 	router.Static("/", "./public")
 
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/models"
+	"github.com/matoous/mailback/internal/store"
+)
+
+func TestServer_Attempts(t *testing.T) {
+	ctx := context.Background()
+	db := store.NewMemoryStore()
+	require.NoError(t, db.Save(ctx, &models.Entry{ID: "abc"}, &models.Entry{ID: "def"}))
+	require.NoError(t, db.SaveAttempts(ctx,
+		&models.DeliveryAttempt{
+			EntryID:   "abc",
+			CreatedAt: time.Now(),
+			Host:      "mx.example.com",
+			TLS:       true,
+			Code:      451,
+			Response:  "451 4.3.0 Try again later",
+			Duration:  time.Second,
+			Outcome:   models.OutcomeDeferred,
+			Error:     "451 4.3.0 Try again later",
+		},
+	))
+	srv, err := New(db, nil, zap.NewNop(), cfg.WebServerConfig{Host: "localhost", AdminToken: "secret", RequestTimeout: time.Second})
+	require.NoError(t, err)
+
+	tests := []struct {
+		Name       string
+		ID         string
+		Token      string
+		WantStatus int
+		WantLen    int
+	}{
+		{Name: "attempts", ID: "abc", Token: "secret", WantStatus: http.StatusOK, WantLen: 1},
+		{Name: "no attempts", ID: "def", Token: "secret", WantStatus: http.StatusOK},
+		{Name: "unknown entry", ID: "xyz", Token: "secret", WantStatus: http.StatusNotFound},
+		{Name: "missing token", ID: "abc", WantStatus: http.StatusUnauthorized},
+		{Name: "wrong token", ID: "abc", Token: "wrong", WantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/entries/"+tt.ID+"/attempts", nil)
+			if tt.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.Token)
+			}
+			resp, err := srv.router.Test(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.WantStatus, resp.StatusCode, "should respond with the status")
+			if tt.WantStatus != http.StatusOK {
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			var attempts []models.DeliveryAttempt
+			require.NoError(t, json.Unmarshal(body, &attempts), "should respond with JSON")
+			require.NotNil(t, attempts, "should respond with list")
+			require.Len(t, attempts, tt.WantLen, "should list the attempts of the entry")
+			if tt.WantLen > 0 {
+				assert.Equal(t, "mx.example.com", attempts[0].Host, "should include the host")
+				assert.Equal(t, models.OutcomeDeferred, attempts[0].Outcome, "should include the outcome")
+			}
+		})
+	}
+}
+
+func TestServer_AttemptsDisabled(t *testing.T) {
+	srv, err := New(store.NewMemoryStore(), nil, zap.NewNop(), cfg.WebServerConfig{Host: "localhost", RequestTimeout: time.Second})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/entries/abc/attempts", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	resp, err := srv.router.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "shouldn't serve the API without token")
+}
@@ -0,0 +1,364 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/jpillora/backoff"
+
+	"github.com/matoous/mailback/internal/models"
+)
+
+// gormStore implements the storage on top of gorm, the dialect specific stores embed it. Gorm doesn't support
+// contexts, so its statements are executed through adapters that pass the context of the operation to
+// database/sql, which cancels the statements once the context is done. The adapters also convert all times
+// to UTC, as SQLite stores the times as text with the offset and compares them as text.
+type gormStore struct {
+	sqlDB   *sql.DB
+	dialect string
+	// busy reports whether the statement failed because the database was locked by another connection, such
+	// writes are retried until the busy timeout passes. It is nil if the database waits for the locks itself.
+	busy        func(err error) bool
+	busyTimeout time.Duration
+}
+
+// openGormStore opens the database with given gorm dialect, the dialect must be named as the SQL driver.
+func openGormStore(dialect, source string) (gormStore, error) {
+	db, err := sql.Open(dialect, source)
+	if err != nil {
+		return gormStore{}, err
+	}
+	// make sure the database connection is alive
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return gormStore{}, err
+	}
+	return gormStore{sqlDB: db, dialect: dialect}, nil
+}
+
+// with returns gorm executing the statements with the context.
+func (s *gormStore) with(ctx context.Context) *gorm.DB {
+	// opening gorm on existing connection never fails
+	db, _ := gorm.Open(s.dialect, ctxDB{ctx: ctx, db: s.sqlDB})
+	return db
+}
+
+// begin begins transaction executing the statements with the context. The transaction is rolled back
+// if the context is done before it is committed.
+func (s *gormStore) begin(ctx context.Context) (*gorm.DB, error) {
+	tx, err := s.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	db, _ := gorm.Open(s.dialect, ctxTx{ctx: ctx, tx: tx})
+	return db, nil
+}
+
+// transaction runs fn in transaction with the context, the transaction is rolled back if fn fails.
+func (s *gormStore) transaction(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	return s.retry(ctx, func() error {
+		tx, err := s.begin(ctx)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit().Error
+	})
+}
+
+// retry runs fn again while it fails because the database is busy, until the busy timeout passes or the context
+// is done. Failures caused by the context being done are reported as the error of the context.
+func (s *gormStore) retry(ctx context.Context, fn func() error) error {
+	err := fn()
+	if s.busy != nil && s.busy(err) {
+		deadline := time.Now().Add(s.busyTimeout)
+		// the jitter spreads the retries of the processes waiting for the same lock
+		bo := backoff.Backoff{Min: time.Millisecond, Max: 50 * time.Millisecond, Factor: 2, Jitter: true}
+		for s.busy(err) && time.Now().Before(deadline) && ctx.Err() == nil {
+			t := time.NewTimer(bo.Duration())
+			select {
+			case <-ctx.Done():
+			case <-t.C:
+				err = fn()
+			}
+			t.Stop()
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (s *gormStore) Close() error {
+	return s.sqlDB.Close()
+}
+
+func (s *gormStore) Save(ctx context.Context, entries ...*models.Entry) error {
+	return s.transaction(ctx, func(tx *gorm.DB) error {
+		for _, e := range entries {
+			if err := tx.Save(e).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *gormStore) Update(ctx context.Context, e *models.Entry) error {
+	return s.transaction(ctx, func(tx *gorm.DB) error {
+		return tx.Save(e).Error
+	})
+}
+
+// Transition saves the entry only if it is still in the from state and claimed by the same sender instance,
+// ErrConflict is returned otherwise.
+func (s *gormStore) Transition(ctx context.Context, e *models.Entry, from string) error {
+	return s.transaction(ctx, func(tx *gorm.DB) error {
+		res := tx.Model(&models.Entry{}).
+			Where("id = ? AND status = ? AND COALESCE(claimed_by, '') = ?", e.ID, from, e.ClaimedBy).
+			Update("status", e.Status)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrConflict
+		}
+		return tx.Save(e).Error
+	})
+}
+
+func (s *gormStore) Delete(ctx context.Context, e *models.Entry) error {
+	return s.transaction(ctx, func(tx *gorm.DB) error {
+		res := tx.Delete(e)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		if err := tx.Where("entry_id = ?", e.ID).Delete(&models.Attachment{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("entry_id = ?", e.ID).Delete(&models.DeliveryAttempt{}).Error
+	})
+}
+
+func (s *gormStore) Entry(ctx context.Context, id string) (*models.Entry, error) {
+	var e models.Entry
+	err := s.with(ctx).Preload("Attachments").Where("id = ?", id).First(&e).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *gormStore) PendingEntries(ctx context.Context) ([]models.Entry, error) {
+	var entries []models.Entry
+	err := s.with(ctx).Preload("Attachments").Where("status = ? AND scheduled_for < ?", models.StatusScheduled, time.Now()).Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Claim claims at most n entries that are due for the worker with lease until given time. The claimed entries
+// are moved to the claimed state so that no other worker claims them again.
+func (s *gormStore) Claim(ctx context.Context, worker string, until time.Time, n int) ([]models.Entry, error) {
+	var entries []models.Entry
+	err := s.transaction(ctx, func(tx *gorm.DB) error {
+		entries = nil
+		var ids []string
+		err := tx.Model(&models.Entry{}).
+			Where("status = ? AND scheduled_for < ?", models.StatusScheduled, time.Now()).
+			Order("scheduled_for").
+			Limit(n).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		// the status is checked again as the entries could have been claimed by someone else in the meantime
+		err = tx.Model(&models.Entry{}).
+			Where("id IN (?) AND status = ?", ids, models.StatusScheduled).
+			Updates(map[string]interface{}{
+				"status":      models.StatusClaimed,
+				"claimed_by":  worker,
+				"lease_until": until,
+			}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Preload("Attachments").
+			Where("id IN (?) AND status = ? AND claimed_by = ?", ids, models.StatusClaimed, worker).
+			Order("scheduled_for").
+			Find(&entries).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// UpcomingEntries returns at most n scheduled entries due before given time, ordered by the time they are due.
+// Only the ID and the scheduled time of the entries are loaded.
+func (s *gormStore) UpcomingEntries(ctx context.Context, until time.Time, n int) ([]models.Entry, error) {
+	var entries []models.Entry
+	err := s.with(ctx).Select("id, scheduled_for").
+		Where("status = ? AND scheduled_for < ?", models.StatusScheduled, until).
+		Order("scheduled_for").
+		Limit(n).
+		Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ExpiredEntries returns entries left in the intermediate delivery states whose lease expired before given
+// time, such as when the sender instance that claimed them crashed.
+func (s *gormStore) ExpiredEntries(ctx context.Context, at time.Time) ([]models.Entry, error) {
+	var entries []models.Entry
+	err := s.with(ctx).Preload("Attachments").
+		Where("status IN (?) AND (lease_until IS NULL OR lease_until < ?)",
+			[]string{models.StatusClaimed, models.StatusSending, models.StatusSent}, at).
+		Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// DeadEntries returns entries that won't be delivered anymore, either because they were permanently rejected or
+// because their delivery failed too many times.
+func (s *gormStore) DeadEntries(ctx context.Context) ([]models.Entry, error) {
+	var entries []models.Entry
+	err := s.with(ctx).Preload("Attachments").
+		Where("status IN (?)", []string{models.StatusDead, models.StatusFailed}).
+		Order("scheduled_for").
+		Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Requeue schedules the dead entry for delivery at given time again, resetting its failures.
+func (s *gormStore) Requeue(ctx context.Context, id string, at time.Time) error {
+	return s.transaction(ctx, func(tx *gorm.DB) error {
+		res := tx.Model(&models.Entry{}).
+			Where("id = ? AND status IN (?)", id, []string{models.StatusDead, models.StatusFailed}).
+			Updates(map[string]interface{}{
+				"status":              models.StatusScheduled,
+				"scheduled_for":       at,
+				"fails":               0,
+				"failing_since":       nil,
+				"last_error":          "",
+				"outbound_message_id": "",
+				"claimed_by":          "",
+				"lease_until":         nil,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (s *gormStore) SaveAttempts(ctx context.Context, attempts ...*models.DeliveryAttempt) error {
+	return s.transaction(ctx, func(tx *gorm.DB) error {
+		for _, a := range attempts {
+			if err := tx.Create(a).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Attempts returns the delivery attempts of the entry from the oldest one.
+func (s *gormStore) Attempts(ctx context.Context, entryID string) ([]models.DeliveryAttempt, error) {
+	var attempts []models.DeliveryAttempt
+	err := s.with(ctx).Where("entry_id = ?", entryID).Order("created_at, id").Find(&attempts).Error
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// utc converts the times among the statement arguments to UTC.
+func utc(args []interface{}) []interface{} {
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case time.Time:
+			args[i] = v.UTC()
+		case *time.Time:
+			if v != nil {
+				args[i] = v.UTC()
+			}
+		}
+	}
+	return args
+}
+
+// ctxDB executes the statements of gorm outside of transaction with the context.
+type ctxDB struct {
+	ctx context.Context
+	db  *sql.DB
+}
+
+func (c ctxDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.db.ExecContext(c.ctx, query, utc(args)...)
+}
+
+func (c ctxDB) Prepare(query string) (*sql.Stmt, error) {
+	return c.db.PrepareContext(c.ctx, query)
+}
+
+func (c ctxDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.QueryContext(c.ctx, query, utc(args)...)
+}
+
+func (c ctxDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.db.QueryRowContext(c.ctx, query, utc(args)...)
+}
+
+// ctxTx executes the statements of gorm in transaction with the context.
+type ctxTx struct {
+	ctx context.Context
+	tx  *sql.Tx
+}
+
+func (c ctxTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.tx.ExecContext(c.ctx, query, utc(args)...)
+}
+
+func (c ctxTx) Prepare(query string) (*sql.Stmt, error) {
+	return c.tx.PrepareContext(c.ctx, query)
+}
+
+func (c ctxTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.tx.QueryContext(c.ctx, query, utc(args)...)
+}
+
+func (c ctxTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.tx.QueryRowContext(c.ctx, query, utc(args)...)
+}
+
+func (c ctxTx) Commit() error {
+	return c.tx.Commit()
+}
+
+func (c ctxTx) Rollback() error {
+	return c.tx.Rollback()
+}
@@ -0,0 +1,451 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matoous/mailback/internal/models"
+)
+
+// MemoryStore keeps the entries in memory. It is meant for tests and ephemeral single process deployments,
+// the entries are lost once the process exits unless they are snapshotted to disk. The store is safe for
+// concurrent use, the entries are copied in and out so that callers never share them. The operations never block,
+// they only fail if the context is already done.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	entries  map[string]*models.Entry
+	attempts []models.DeliveryAttempt
+	// lastAttemptID is the ID of the last saved attempt, the IDs are assigned sequentially as by the databases.
+	lastAttemptID uint
+	createdAt     time.Time
+
+	// filename is the file the snapshots are written to, empty if snapshotting is disabled.
+	filename string
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// snapshot is the JSON representation of the memory store on disk.
+type snapshot struct {
+	Entries  []models.Entry           `json:"entries"`
+	Attempts []models.DeliveryAttempt `json:"attempts"`
+}
+
+// NewMemoryStore creates new empty memory store without snapshots.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries:   make(map[string]*models.Entry),
+		createdAt: time.Now(),
+	}
+}
+
+// LoadMemoryStore creates new memory store snapshotted to file with given filename. The store is loaded from
+// the file if it exists. The snapshot is written every interval, if it is positive, and when the store is closed.
+func LoadMemoryStore(filename string, interval time.Duration) (*MemoryStore, error) {
+	s := NewMemoryStore()
+	s.filename = filename
+	b, err := ioutil.ReadFile(filename)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		var snap snapshot
+		if err := json.Unmarshal(b, &snap); err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", filename, err)
+		}
+		for i := range snap.Entries {
+			s.entries[snap.Entries[i].ID] = &snap.Entries[i]
+		}
+		s.attempts = snap.Attempts
+		for _, a := range s.attempts {
+			if a.ID > s.lastAttemptID {
+				s.lastAttemptID = a.ID
+			}
+		}
+	}
+	if interval > 0 {
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.snapshotEvery(interval)
+	}
+	return s, nil
+}
+
+// snapshotEvery writes the snapshot every interval until the store is closed.
+func (s *MemoryStore) snapshotEvery(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// failed snapshot is retried on the next tick, the store keeps working in memory anyway
+			_ = s.Snapshot()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Snapshot writes the entries and attempts to the snapshot file. The file is replaced atomically, so that
+// the previous snapshot is kept if the process crashes while writing it. It does nothing if snapshotting
+// is disabled.
+func (s *MemoryStore) Snapshot() error {
+	if s.filename == "" {
+		return nil
+	}
+	s.mu.RLock()
+	snap := snapshot{
+		Entries:  make([]models.Entry, 0, len(s.entries)),
+		Attempts: append([]models.DeliveryAttempt(nil), s.attempts...),
+	}
+	for _, e := range s.entries {
+		snap.Entries = append(snap.Entries, clone(e))
+	}
+	s.mu.RUnlock()
+	sortEntries(snap.Entries)
+
+	b, err := json.Marshal(&snap)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.filename), filepath.Base(s.filename)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.filename)
+}
+
+// Migrate does nothing, the memory store has no schema.
+func (s *MemoryStore) Migrate(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// MigrateTo does nothing for the latest version, the memory store can't be migrated to any other.
+func (s *MemoryStore) MigrateTo(ctx context.Context, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if version != LatestVersion() {
+		return fmt.Errorf("memory store can't be migrated to version %d", version)
+	}
+	return nil
+}
+
+// SchemaVersion returns the latest version, the memory store always matches the models.
+func (s *MemoryStore) SchemaVersion(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return LatestVersion(), nil
+}
+
+// Migrations returns all the migrations as applied when the store was created.
+func (s *MemoryStore) Migrations(ctx context.Context) ([]MigrationState, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i] = MigrationState{Version: m.Version, Name: m.Name, AppliedAt: &s.createdAt}
+	}
+	return states, nil
+}
+
+// Close stops the periodic snapshots and writes the last one.
+func (s *MemoryStore) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+	return s.Snapshot()
+}
+
+func (s *MemoryStore) Save(ctx context.Context, entries ...*models.Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		s.put(e)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, e *models.Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(e)
+	return nil
+}
+
+// Transition saves the entry only if it is still in the from state and claimed by the same sender instance,
+// ErrConflict is returned otherwise.
+func (s *MemoryStore) Transition(ctx context.Context, e *models.Entry, from string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.entries[e.ID]
+	if !ok || stored.Status != from || stored.ClaimedBy != e.ClaimedBy {
+		return ErrConflict
+	}
+	s.put(e)
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, e *models.Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[e.ID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.entries, e.ID)
+	attempts := s.attempts[:0]
+	for _, a := range s.attempts {
+		if a.EntryID != e.ID {
+			attempts = append(attempts, a)
+		}
+	}
+	s.attempts = attempts
+	return nil
+}
+
+func (s *MemoryStore) Entry(ctx context.Context, id string) (*models.Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.entries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := clone(e)
+	return &c, nil
+}
+
+func (s *MemoryStore) PendingEntries(ctx context.Context) ([]models.Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return s.find(func(e *models.Entry) bool {
+		return e.Status == models.StatusScheduled && e.ScheduledFor.Before(now)
+	}, 0), nil
+}
+
+// Claim claims at most n entries that are due for the worker with lease until given time. The claimed entries
+// are moved to the claimed state so that no other worker claims them again.
+func (s *MemoryStore) Claim(ctx context.Context, worker string, until time.Time, n int) ([]models.Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	entries := s.filter(func(e *models.Entry) bool {
+		return e.Status == models.StatusScheduled && e.ScheduledFor.Before(now)
+	}, n)
+	for i := range entries {
+		e := &entries[i]
+		e.Status = models.StatusClaimed
+		e.ClaimedBy = worker
+		lease := until
+		e.LeaseUntil = &lease
+		s.put(e)
+	}
+	return entries, nil
+}
+
+// UpcomingEntries returns at most n scheduled entries due before given time, ordered by the time they are due.
+func (s *MemoryStore) UpcomingEntries(ctx context.Context, until time.Time, n int) ([]models.Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.find(func(e *models.Entry) bool {
+		return e.Status == models.StatusScheduled && e.ScheduledFor.Before(until)
+	}, n), nil
+}
+
+// ExpiredEntries returns entries left in the intermediate delivery states whose lease expired before given
+// time, such as when the sender instance that claimed them crashed.
+func (s *MemoryStore) ExpiredEntries(ctx context.Context, at time.Time) ([]models.Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.find(func(e *models.Entry) bool {
+		switch e.Status {
+		case models.StatusClaimed, models.StatusSending, models.StatusSent:
+			return e.LeaseUntil == nil || e.LeaseUntil.Before(at)
+		default:
+			return false
+		}
+	}, 0), nil
+}
+
+// DeadEntries returns entries that won't be delivered anymore, either because they were permanently rejected or
+// because their delivery failed too many times.
+func (s *MemoryStore) DeadEntries(ctx context.Context) ([]models.Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.find(func(e *models.Entry) bool {
+		return e.Status == models.StatusDead || e.Status == models.StatusFailed
+	}, 0), nil
+}
+
+// Requeue schedules the dead entry for delivery at given time again, resetting its failures.
+func (s *MemoryStore) Requeue(ctx context.Context, id string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[id]
+	if !ok || e.Status != models.StatusDead && e.Status != models.StatusFailed {
+		return ErrNotFound
+	}
+	e.Status = models.StatusScheduled
+	e.ScheduledFor = at
+	e.Fails = 0
+	e.FailingSince = nil
+	e.LastError = ""
+	e.OutboundMessageID = ""
+	e.ClaimedBy = ""
+	e.LeaseUntil = nil
+	return nil
+}
+
+func (s *MemoryStore) SaveAttempts(ctx context.Context, attempts ...*models.DeliveryAttempt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range attempts {
+		s.lastAttemptID++
+		a.ID = s.lastAttemptID
+		if a.CreatedAt.IsZero() {
+			a.CreatedAt = time.Now()
+		}
+		s.attempts = append(s.attempts, *a)
+	}
+	return nil
+}
+
+// Attempts returns the delivery attempts of the entry from the oldest one.
+func (s *MemoryStore) Attempts(ctx context.Context, entryID string) ([]models.DeliveryAttempt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var attempts []models.DeliveryAttempt
+	for _, a := range s.attempts {
+		if a.EntryID == entryID {
+			attempts = append(attempts, a)
+		}
+	}
+	sort.SliceStable(attempts, func(i, j int) bool {
+		if !attempts[i].CreatedAt.Equal(attempts[j].CreatedAt) {
+			return attempts[i].CreatedAt.Before(attempts[j].CreatedAt)
+		}
+		return attempts[i].ID < attempts[j].ID
+	})
+	return attempts, nil
+}
+
+// put stores copy of the entry, the caller must hold the write lock.
+func (s *MemoryStore) put(e *models.Entry) {
+	c := clone(e)
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = time.Now()
+	}
+	if c.Status == "" {
+		c.Status = models.StatusScheduled
+	}
+	s.entries[c.ID] = &c
+}
+
+// find returns copies of at most n entries matching the filter ordered by the time they are due, all of them
+// if n is 0.
+func (s *MemoryStore) find(match func(e *models.Entry) bool, n int) []models.Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.filter(match, n)
+}
+
+// filter is find for callers that already hold the lock.
+func (s *MemoryStore) filter(match func(e *models.Entry) bool, n int) []models.Entry {
+	var entries []models.Entry
+	for _, e := range s.entries {
+		if match(e) {
+			entries = append(entries, clone(e))
+		}
+	}
+	sortEntries(entries)
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// sortEntries orders the entries by the time they are due.
+func sortEntries(entries []models.Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].ScheduledFor.Equal(entries[j].ScheduledFor) {
+			return entries[i].ScheduledFor.Before(entries[j].ScheduledFor)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+}
+
+// clone returns deep copy of the entry, so that the stored entries can't be modified by the callers.
+func clone(e *models.Entry) models.Entry {
+	c := *e
+	c.Attachments = append([]models.Attachment(nil), e.Attachments...)
+	if e.Period != nil {
+		p := *e.Period
+		c.Period = &p
+	}
+	if e.PeriodString != nil {
+		p := *e.PeriodString
+		c.PeriodString = &p
+	}
+	if e.FailingSince != nil {
+		t := *e.FailingSince
+		c.FailingSince = &t
+	}
+	if e.LeaseUntil != nil {
+		t := *e.LeaseUntil
+		c.LeaseUntil = &t
+	}
+	return c
+}
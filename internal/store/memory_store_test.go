@@ -0,0 +1,69 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rickb777/date/period"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matoous/mailback/internal/models"
+	"github.com/matoous/mailback/internal/store"
+	"github.com/matoous/mailback/internal/store/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return store.NewMemoryStore()
+	})
+}
+
+func TestMemoryStore_Snapshot(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "mailback-store")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	filename := filepath.Join(dir, "snapshot.json")
+
+	s, err := store.LoadMemoryStore(filename, time.Millisecond)
+	require.NoError(t, err)
+	day := period.NewYMD(0, 0, 1)
+	scheduledFor := time.Now().Add(time.Hour)
+	require.NoError(t, s.Save(ctx, &models.Entry{
+		ID:           "abc",
+		Status:       models.StatusScheduled,
+		ScheduledFor: scheduledFor,
+		Period:       &day,
+		Attachments:  []models.Attachment{{ID: "att", EntryID: "abc", Filename: "plants.jpg"}},
+	}))
+	require.NoError(t, s.SaveAttempts(ctx, &models.DeliveryAttempt{EntryID: "abc", Outcome: models.OutcomeDeferred}))
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filename)
+		return err == nil
+	}, 5*time.Second, time.Millisecond, "should write the snapshot periodically")
+	require.NoError(t, s.Close())
+
+	s, err = store.LoadMemoryStore(filename, 0)
+	require.NoError(t, err)
+	e, err := s.Entry(ctx, "abc")
+	require.NoError(t, err, "should load the entry from the snapshot")
+	assert.True(t, scheduledFor.Equal(e.ScheduledFor), "should keep the scheduled time")
+	require.NotNil(t, e.Period, "should keep the period")
+	assert.Equal(t, day, *e.Period, "should keep the period")
+	assert.Len(t, e.Attachments, 1, "should keep the attachments")
+	require.NoError(t, s.SaveAttempts(ctx, &models.DeliveryAttempt{EntryID: "abc", Outcome: models.OutcomeDelivered}))
+	attempts, err := s.Attempts(ctx, "abc")
+	require.NoError(t, err)
+	require.Len(t, attempts, 2, "should keep the attempts")
+	assert.NotEqual(t, attempts[0].ID, attempts[1].ID, "should continue with the attempt IDs")
+	require.NoError(t, s.Close())
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("garbage"), 0600))
+	_, err = store.LoadMemoryStore(filename, 0)
+	assert.Error(t, err, "should fail to load corrupted snapshot")
+}
@@ -0,0 +1,230 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Dialects of the migration scripts, as named by gorm.
+const (
+	dialectSQLite   = "sqlite3"
+	dialectPostgres = "postgres"
+)
+
+// script is the SQL of migration for single dialect. The statements are executed in order.
+type script struct {
+	// Adopt lists the columns added to the tables that exist already, such as the ones created by gorm's
+	// AutoMigrate, before the Up statements are executed.
+	Adopt []column
+	Up    []string
+	Down  []string
+}
+
+// column is column of the table that is added if the table exists without it.
+type column struct {
+	Table string
+	Name  string
+	Type  string
+}
+
+// migration is single versioned change of the schema with script for each of the dialects.
+type migration struct {
+	Version int
+	Name    string
+	Scripts map[string]script
+}
+
+// schemaVersionTables create the table recording the applied migrations.
+var schemaVersionTables = map[string]string{
+	dialectSQLite: `CREATE TABLE IF NOT EXISTS "schema_version" (
+		"version" integer PRIMARY KEY,
+		"name" text NOT NULL,
+		"applied_at" datetime NOT NULL
+	)`,
+	dialectPostgres: `CREATE TABLE IF NOT EXISTS "schema_version" (
+		"version" integer PRIMARY KEY,
+		"name" text NOT NULL,
+		"applied_at" timestamp with time zone NOT NULL
+	)`,
+}
+
+// columnsQueries list the columns of given table, no columns are listed if the table doesn't exist.
+var columnsQueries = map[string]string{
+	dialectSQLite:   `SELECT "name" FROM pragma_table_info(?)`,
+	dialectPostgres: `SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ?`,
+}
+
+// schemaVersion is applied migration.
+type schemaVersion struct {
+	Version   int `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// TableName returns the name of the table recording the applied migrations.
+func (schemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// MigrationState is the state of single migration of the schema.
+type MigrationState struct {
+	Version int
+	Name    string
+	// AppliedAt is when the migration was applied, nil if it wasn't.
+	AppliedAt *time.Time
+}
+
+// LatestVersion returns the version of the schema after all the migrations are applied.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrate applies all the migrations that weren't applied yet.
+func (s *gormStore) Migrate(ctx context.Context) error {
+	return s.MigrateTo(ctx, LatestVersion())
+}
+
+// MigrateTo migrates the schema up or down to given version, 0 reverts all the migrations. Each migration is
+// applied in its own transaction, so the schema is left at the last successfully migrated version on failure.
+func (s *gormStore) MigrateTo(ctx context.Context, version int) error {
+	if version < 0 || version > LatestVersion() {
+		return fmt.Errorf("unknown schema version %d", version)
+	}
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if current > LatestVersion() {
+		return fmt.Errorf("schema version %d is newer than the latest known version %d", current, LatestVersion())
+	}
+	for ; current < version; current++ {
+		if err := s.apply(ctx, &migrations[current], true); err != nil {
+			return err
+		}
+	}
+	for ; current > version; current-- {
+		if err := s.apply(ctx, &migrations[current-1], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 if none was applied.
+func (s *gormStore) SchemaVersion(ctx context.Context) (int, error) {
+	if err := s.createSchemaVersion(ctx); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	if err := s.with(ctx).Model(&schemaVersion{}).Select("MAX(version)").Row().Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Migrations returns the state of all the known migrations.
+func (s *gormStore) Migrations(ctx context.Context) ([]MigrationState, error) {
+	if err := s.createSchemaVersion(ctx); err != nil {
+		return nil, err
+	}
+	var applied []schemaVersion
+	if err := s.with(ctx).Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	appliedAt := make(map[int]time.Time, len(applied))
+	for _, v := range applied {
+		appliedAt[v.Version] = v.AppliedAt
+	}
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i] = MigrationState{Version: m.Version, Name: m.Name}
+		if at, ok := appliedAt[m.Version]; ok {
+			states[i].AppliedAt = &at
+		}
+	}
+	return states, nil
+}
+
+// createSchemaVersion creates the table recording the applied migrations if it doesn't exist.
+func (s *gormStore) createSchemaVersion(ctx context.Context) error {
+	q, ok := schemaVersionTables[s.dialect]
+	if !ok {
+		return fmt.Errorf("migrations don't support dialect %s", s.dialect)
+	}
+	return s.retry(ctx, func() error {
+		return s.with(ctx).Exec(q).Error
+	})
+}
+
+// apply applies the migration up or down and records it in the schema version table.
+func (s *gormStore) apply(ctx context.Context, m *migration, up bool) error {
+	sc, ok := m.Scripts[s.dialect]
+	if !ok {
+		return fmt.Errorf("migration %d doesn't support dialect %s", m.Version, s.dialect)
+	}
+	statements := sc.Down
+	if up {
+		statements = sc.Up
+	}
+	return s.transaction(ctx, func(tx *gorm.DB) error {
+		if up {
+			if err := s.adopt(tx, sc.Adopt); err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+		}
+		for _, q := range statements {
+			if err := tx.Exec(q).Error; err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+		}
+		if up {
+			return tx.Create(&schemaVersion{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		}
+		return tx.Where("version = ?", m.Version).Delete(&schemaVersion{}).Error
+	})
+}
+
+// adopt adds the columns that are missing in the existing tables.
+func (s *gormStore) adopt(tx *gorm.DB, columns []column) error {
+	existing := make(map[string]map[string]bool)
+	for _, c := range columns {
+		if _, ok := existing[c.Table]; !ok {
+			names, err := s.columns(tx, c.Table)
+			if err != nil {
+				return err
+			}
+			existing[c.Table] = names
+		}
+		names := existing[c.Table]
+		if len(names) == 0 || names[c.Name] {
+			// the table is created by the migration or it has the column already
+			continue
+		}
+		if err := tx.Exec(fmt.Sprintf(`ALTER TABLE %q ADD COLUMN %q %s`, c.Table, c.Name, c.Type)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// columns returns the names of the columns of the table, it is empty if the table doesn't exist.
+func (s *gormStore) columns(tx *gorm.DB, table string) (map[string]bool, error) {
+	rows, err := tx.Raw(columnsQueries[s.dialect], table).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	return names, rows.Err()
+}
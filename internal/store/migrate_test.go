@@ -0,0 +1,21 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrations(t *testing.T) {
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version, "should number the migrations sequentially")
+		assert.NotEmpty(t, m.Name, "should name migration %d", m.Version)
+		for _, dialect := range []string{dialectSQLite, dialectPostgres} {
+			sc, ok := m.Scripts[dialect]
+			if assert.True(t, ok, "should support %s in migration %d", dialect, m.Version) {
+				assert.NotEmpty(t, sc.Up, "should migrate %s up in migration %d", dialect, m.Version)
+				assert.NotEmpty(t, sc.Down, "should migrate %s down in migration %d", dialect, m.Version)
+			}
+		}
+	}
+}
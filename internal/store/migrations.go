@@ -0,0 +1,230 @@
+package store
+
+// migrations are the versioned changes of the schema, ordered by version starting at 1. Applied migrations must
+// never be changed, changes of the schema are added as new migrations. The initial tables are created only if
+// they don't exist and the columns missing in the entries table are added, so that databases created by gorm's
+// AutoMigrate can be adopted.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create entries",
+		Scripts: map[string]script{
+			dialectSQLite: {
+				Adopt: []column{
+					{Table: "entries", Name: "data", Type: "text"},
+					{Table: "entries", Name: "html", Type: "text"},
+					{Table: "entries", Name: "title", Type: "text"},
+					{Table: "entries", Name: "message_id", Type: "text"},
+					{Table: "entries", Name: "in_reply_to", Type: "text"},
+					{Table: "entries", Name: "references", Type: "text"},
+					{Table: "entries", Name: "mail", Type: "text"},
+					{Table: "entries", Name: "scheduled_for", Type: "datetime"},
+					{Table: "entries", Name: "created_at", Type: "datetime"},
+					{Table: "entries", Name: "period_string", Type: "text"},
+					{Table: "entries", Name: "recurrence", Type: "text"},
+					{Table: "entries", Name: "time_zone", Type: "text"},
+					{Table: "entries", Name: "local_time", Type: "text"},
+					{Table: "entries", Name: "catch_up", Type: "text"},
+					{Table: "entries", Name: "fails", Type: "integer"},
+					{Table: "entries", Name: "status", Type: "text DEFAULT 'scheduled'"},
+					{Table: "entries", Name: "last_error", Type: "text"},
+					{Table: "entries", Name: "failing_since", Type: "datetime"},
+					{Table: "entries", Name: "dkim", Type: "text"},
+					{Table: "entries", Name: "dmarc", Type: "text"},
+					{Table: "entries", Name: "dmarc_policy", Type: "text"},
+					{Table: "entries", Name: "outbound_message_id", Type: "text"},
+					{Table: "entries", Name: "claimed_by", Type: "text"},
+					{Table: "entries", Name: "lease_until", Type: "datetime"},
+					{Table: "entries", Name: "transport", Type: "text"},
+				},
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "entries" (
+						"id" text PRIMARY KEY,
+						"data" text,
+						"html" text,
+						"title" text,
+						"message_id" text,
+						"in_reply_to" text,
+						"references" text,
+						"mail" text,
+						"scheduled_for" datetime,
+						"created_at" datetime,
+						"period_string" text,
+						"recurrence" text,
+						"time_zone" text,
+						"local_time" text,
+						"catch_up" text,
+						"fails" integer,
+						"status" text DEFAULT 'scheduled',
+						"last_error" text,
+						"failing_since" datetime,
+						"dkim" text,
+						"dmarc" text,
+						"dmarc_policy" text,
+						"outbound_message_id" text,
+						"claimed_by" text,
+						"lease_until" datetime,
+						"transport" text
+					)`,
+					`UPDATE "entries" SET "status" = 'scheduled' WHERE "status" IS NULL`,
+				},
+				Down: []string{`DROP TABLE "entries"`},
+			},
+			dialectPostgres: {
+				Adopt: []column{
+					{Table: "entries", Name: "data", Type: "text"},
+					{Table: "entries", Name: "html", Type: "text"},
+					{Table: "entries", Name: "title", Type: "text"},
+					{Table: "entries", Name: "message_id", Type: "text"},
+					{Table: "entries", Name: "in_reply_to", Type: "text"},
+					{Table: "entries", Name: "references", Type: "text"},
+					{Table: "entries", Name: "mail", Type: "text"},
+					{Table: "entries", Name: "scheduled_for", Type: "timestamp with time zone"},
+					{Table: "entries", Name: "created_at", Type: "timestamp with time zone"},
+					{Table: "entries", Name: "period_string", Type: "text"},
+					{Table: "entries", Name: "recurrence", Type: "text"},
+					{Table: "entries", Name: "time_zone", Type: "text"},
+					{Table: "entries", Name: "local_time", Type: "text"},
+					{Table: "entries", Name: "catch_up", Type: "text"},
+					{Table: "entries", Name: "fails", Type: "integer"},
+					{Table: "entries", Name: "status", Type: "text DEFAULT 'scheduled'"},
+					{Table: "entries", Name: "last_error", Type: "text"},
+					{Table: "entries", Name: "failing_since", Type: "timestamp with time zone"},
+					{Table: "entries", Name: "dkim", Type: "text"},
+					{Table: "entries", Name: "dmarc", Type: "text"},
+					{Table: "entries", Name: "dmarc_policy", Type: "text"},
+					{Table: "entries", Name: "outbound_message_id", Type: "text"},
+					{Table: "entries", Name: "claimed_by", Type: "text"},
+					{Table: "entries", Name: "lease_until", Type: "timestamp with time zone"},
+					{Table: "entries", Name: "transport", Type: "text"},
+				},
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "entries" (
+						"id" text PRIMARY KEY,
+						"data" text,
+						"html" text,
+						"title" text,
+						"message_id" text,
+						"in_reply_to" text,
+						"references" text,
+						"mail" text,
+						"scheduled_for" timestamp with time zone,
+						"created_at" timestamp with time zone,
+						"period_string" text,
+						"recurrence" text,
+						"time_zone" text,
+						"local_time" text,
+						"catch_up" text,
+						"fails" integer,
+						"status" text DEFAULT 'scheduled',
+						"last_error" text,
+						"failing_since" timestamp with time zone,
+						"dkim" text,
+						"dmarc" text,
+						"dmarc_policy" text,
+						"outbound_message_id" text,
+						"claimed_by" text,
+						"lease_until" timestamp with time zone,
+						"transport" text
+					)`,
+					`UPDATE "entries" SET "status" = 'scheduled' WHERE "status" IS NULL`,
+				},
+				Down: []string{`DROP TABLE "entries"`},
+			},
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create attachments",
+		Scripts: map[string]script{
+			dialectSQLite: {
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "attachments" (
+						"id" text PRIMARY KEY,
+						"entry_id" text,
+						"filename" text,
+						"content_type" text,
+						"content_id" text,
+						"size" bigint
+					)`,
+					`CREATE INDEX IF NOT EXISTS idx_attachments_entry_id ON "attachments" ("entry_id")`,
+				},
+				Down: []string{`DROP TABLE "attachments"`},
+			},
+			dialectPostgres: {
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "attachments" (
+						"id" text PRIMARY KEY,
+						"entry_id" text,
+						"filename" text,
+						"content_type" text,
+						"content_id" text,
+						"size" bigint
+					)`,
+					`CREATE INDEX IF NOT EXISTS idx_attachments_entry_id ON "attachments" ("entry_id")`,
+				},
+				Down: []string{`DROP TABLE "attachments"`},
+			},
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create delivery attempts",
+		Scripts: map[string]script{
+			dialectSQLite: {
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "delivery_attempts" (
+						"id" integer PRIMARY KEY AUTOINCREMENT,
+						"entry_id" text,
+						"created_at" datetime,
+						"message_id" text,
+						"host" text,
+						"tls" boolean,
+						"verified" boolean,
+						"code" integer,
+						"response" text,
+						"duration" bigint,
+						"outcome" text,
+						"error" text
+					)`,
+					`CREATE INDEX IF NOT EXISTS idx_delivery_attempts_entry_id ON "delivery_attempts" ("entry_id")`,
+				},
+				Down: []string{`DROP TABLE "delivery_attempts"`},
+			},
+			dialectPostgres: {
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "delivery_attempts" (
+						"id" serial PRIMARY KEY,
+						"entry_id" text,
+						"created_at" timestamp with time zone,
+						"message_id" text,
+						"host" text,
+						"tls" boolean,
+						"verified" boolean,
+						"code" integer,
+						"response" text,
+						"duration" bigint,
+						"outcome" text,
+						"error" text
+					)`,
+					`CREATE INDEX IF NOT EXISTS idx_delivery_attempts_entry_id ON "delivery_attempts" ("entry_id")`,
+				},
+				Down: []string{`DROP TABLE "delivery_attempts"`},
+			},
+		},
+	},
+	{
+		Version: 4,
+		Name:    "index entries by scheduled time",
+		Scripts: map[string]script{
+			dialectSQLite: {
+				Up:   []string{`CREATE INDEX IF NOT EXISTS idx_entries_scheduled_for ON "entries" ("scheduled_for")`},
+				Down: []string{`DROP INDEX idx_entries_scheduled_for`},
+			},
+			dialectPostgres: {
+				Up:   []string{`CREATE INDEX IF NOT EXISTS idx_entries_scheduled_for ON "entries" ("scheduled_for")`},
+				Down: []string{`DROP INDEX idx_entries_scheduled_for`},
+			},
+		},
+	},
+}
@@ -0,0 +1,37 @@
+package store_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/matoous/mailback/internal/store"
+	"github.com/matoous/mailback/internal/store/storetest"
+)
+
+// newTestPostgresStore creates new store in the database given by POSTGRES_TEST_DSN. All the migrations are
+// reverted before and after the test, so the database must not be used for anything else.
+func newTestPostgresStore(t *testing.T, dsn string) *store.PostgresStore {
+	s, err := store.NewPostgresStore(dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	require.NoError(t, s.MigrateTo(context.Background(), 0))
+	t.Cleanup(func() { s.MigrateTo(context.Background(), 0) })
+	require.NoError(t, s.Migrate(context.Background()))
+	return s
+}
+
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN isn't set")
+	}
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return newTestPostgresStore(t, dsn)
+	})
+	t.Run("Migrate", func(t *testing.T) {
+		testMigrate(t, newTestPostgresStore(t, dsn))
+	})
+}
@@ -2,63 +2,77 @@ package store
 
 import (
 	"errors"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/jinzhu/gorm"
 	// obviously use sqlite dialect for SQLite store
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/mattn/go-sqlite3"
+)
+
+// busyWait is how long single statement waits for the database locked by another connection. The waiting can't
+// be interrupted, so the statements wait only shortly and are retried until the busy timeout passes.
+const busyWait = 100 * time.Millisecond
 
-	"github.com/matoous/mailback/internal/models"
+// Defaults of the SQLite options.
+const (
+	defaultBusyTimeout  = 5 * time.Second
+	defaultMaxOpenConns = 4
 )
 
-var ErrNotFound = errors.New("record not found")
+// SQLiteOptions tune the access to the SQLite database that is shared by multiple connections and processes.
+type SQLiteOptions struct {
+	// BusyTimeout is how long the writes wait for the database locked by another connection before they fail,
+	// 5s if it is zero.
+	BusyTimeout time.Duration
+	// MaxOpenConns limits the number of open connections to the database, 4 if it is zero.
+	MaxOpenConns int
+}
 
-// SQLiteStore is SQLite backed storage.
+// SQLiteStore is SQLite backed storage. The database is used in WAL mode, so that the readers don't block the
+// writer and the processes sharing the database file only wait for each other when they write.
 type SQLiteStore struct {
-	db *gorm.DB
+	gormStore
 }
 
 // NewSQLiteStore creates new SQLite store using file with given filename as the persistent storage.
-func NewSQLiteStore(filename string) (*SQLiteStore, error) {
-	db, err := gorm.Open("sqlite3", filename)
+func NewSQLiteStore(filename string, opts SQLiteOptions) (*SQLiteStore, error) {
+	if opts.BusyTimeout == 0 {
+		opts.BusyTimeout = defaultBusyTimeout
+	}
+	if opts.MaxOpenConns == 0 {
+		opts.MaxOpenConns = defaultMaxOpenConns
+	}
+	s, err := openGormStore(dialectSQLite, sqliteDSN(filename))
 	if err != nil {
 		return nil, err
 	}
-	return &SQLiteStore{db}, nil
-}
-
-func (s *SQLiteStore) Migrate() error {
-	return s.db.AutoMigrate(&models.Entry{}).Error
-}
-
-func (s *SQLiteStore) Close() error {
-	return s.db.Close()
+	s.sqlDB.SetMaxOpenConns(opts.MaxOpenConns)
+	s.sqlDB.SetMaxIdleConns(opts.MaxOpenConns)
+	s.busy = isBusy
+	s.busyTimeout = opts.BusyTimeout
+	return &SQLiteStore{s}, nil
 }
 
-func (s *SQLiteStore) Save(e *models.Entry) error {
-	return s.db.Save(e).Error
-}
-
-func (s *SQLiteStore) Update(e *models.Entry) error {
-	return s.db.Save(e).Error
-}
-
-func (s *SQLiteStore) Delete(e *models.Entry) error {
-	res := s.db.Delete(e)
-	if res.Error != nil {
-		return res.Error
+// sqliteDSN returns the data source name of the database file with the connection parameters. The transactions
+// take the write lock when they begin, so that two transactions never deadlock upgrading their read locks.
+func sqliteDSN(filename string) string {
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_synchronous", "NORMAL")
+	params.Set("_busy_timeout", strconv.Itoa(int(busyWait/time.Millisecond)))
+	params.Set("_txlock", "immediate")
+	sep := "?"
+	if strings.Contains(filename, "?") {
+		sep = "&"
 	}
-	if res.RowsAffected == 0 {
-		return ErrNotFound
-	}
-	return nil
+	return filename + sep + params.Encode()
 }
 
-func (s *SQLiteStore) PendingEntries() ([]models.Entry, error) {
-	var entries []models.Entry
-	err := s.db.Where("scheduled_for < ?", time.Now()).Find(&entries).Error
-	if err != nil {
-		return nil, err
-	}
-	return entries, nil
+// isBusy reports whether the statement failed because the database was locked by another connection.
+func isBusy(err error) bool {
+	var serr sqlite3.Error
+	return errors.As(err, &serr) && (serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked)
 }
@@ -0,0 +1,338 @@
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matoous/mailback/internal/models"
+	"github.com/matoous/mailback/internal/store"
+	"github.com/matoous/mailback/internal/store/storetest"
+)
+
+// tempDatabase returns filename of new database in temporary directory that is removed after the test.
+func tempDatabase(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mailback-store")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "test.db")
+}
+
+func openTestSQLiteStore(t *testing.T, filename string, opts store.SQLiteOptions) *store.SQLiteStore {
+	s, err := store.NewSQLiteStore(filename, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	require.NoError(t, s.Migrate(context.Background()))
+	return s
+}
+
+func newTestSQLiteStore(t *testing.T) *store.SQLiteStore {
+	return openTestSQLiteStore(t, tempDatabase(t), store.SQLiteOptions{})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return newTestSQLiteStore(t)
+	})
+	t.Run("Migrate", func(t *testing.T) {
+		testMigrate(t, newTestSQLiteStore(t))
+	})
+}
+
+// testMigrate reverts all the migrations of the SQL store and applies them again.
+func testMigrate(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	version, err := s.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, store.LatestVersion(), version, "should apply all the migrations")
+	require.NoError(t, s.Migrate(context.Background()), "should do nothing when migrated")
+
+	require.NoError(t, s.MigrateTo(context.Background(), 0), "should revert all the migrations")
+	version, err = s.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, version, "should revert all the migrations")
+	states, err := s.Migrations(ctx)
+	require.NoError(t, err)
+	require.Len(t, states, store.LatestVersion(), "should list all the migrations")
+	for _, m := range states {
+		assert.Nil(t, m.AppliedAt, "should revert migration %d", m.Version)
+	}
+	assert.Error(t, s.Save(ctx, &models.Entry{ID: "abc"}), "should drop the tables")
+
+	require.NoError(t, s.MigrateTo(ctx, 1), "should migrate up to the version")
+	states, err = s.Migrations(ctx)
+	require.NoError(t, err)
+	assert.NotNil(t, states[0].AppliedAt, "should apply the first migration")
+	assert.Nil(t, states[1].AppliedAt, "shouldn't apply the following migrations")
+
+	require.NoError(t, s.Migrate(context.Background()), "should apply the remaining migrations")
+	require.NoError(t, s.Save(ctx, &models.Entry{ID: "abc", Status: models.StatusScheduled, ScheduledFor: time.Now()}))
+	_, err = s.Entry(ctx, "abc")
+	assert.NoError(t, err, "should create usable schema")
+	assert.Error(t, s.MigrateTo(ctx, store.LatestVersion()+1), "shouldn't migrate to unknown version")
+}
+
+// legacySchema is the entries table created by gorm's AutoMigrate before the schema was versioned.
+const legacySchema = `CREATE TABLE "entries" ("id" varchar(255),"data" varchar(255),"title" varchar(255),` +
+	`"mail" varchar(255),"scheduled_for" datetime,"created_at" datetime,"period_string" varchar(255),` +
+	`"fails" integer , PRIMARY KEY ("id"))`
+
+func TestSQLiteStore_Adopt(t *testing.T) {
+	ctx := context.Background()
+	filename := tempDatabase(t)
+	db, err := sql.Open("sqlite3", filename)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(legacySchema)
+	require.NoError(t, err)
+	past := time.Now().Add(-time.Hour).UTC()
+	_, err = db.Exec(`INSERT INTO "entries" ("id", "data", "title", "mail", "scheduled_for", "created_at", "fails")
+		VALUES ('legacy', 'Water the plants.', 'Plants', 'joe@example.com', ?, ?, 0)`, past, past)
+	require.NoError(t, err)
+
+	s := openTestSQLiteStore(t, filename, store.SQLiteOptions{})
+	version, err := s.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, store.LatestVersion(), version, "should apply all the migrations")
+
+	e, err := s.Entry(ctx, "legacy")
+	require.NoError(t, err, "should keep the existing entries")
+	assert.Equal(t, "Water the plants.", e.Data, "should keep the existing entries")
+	assert.Equal(t, models.StatusScheduled, e.Status, "should schedule the existing entries")
+
+	claimed, err := s.Claim(ctx, "worker", time.Now().Add(time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1, "should deliver the existing entries")
+	assert.Equal(t, "legacy", claimed[0].ID, "should deliver the existing entries")
+
+	require.NoError(t, s.Save(ctx, &models.Entry{
+		ID:           "new",
+		HTML:         "<p>Water the plants.</p>",
+		Status:       models.StatusScheduled,
+		ScheduledFor: time.Now(),
+		ClaimedBy:    "worker",
+	}), "should add the missing columns")
+	e, err = s.Entry(ctx, "new")
+	require.NoError(t, err)
+	assert.Equal(t, "<p>Water the plants.</p>", e.HTML, "should add the missing columns")
+}
+
+// lockDatabase takes the write lock of the database by another connection. The lock is held until the release
+// function is called or the test ends.
+func lockDatabase(t *testing.T, filename string) (release func()) {
+	db, err := sql.Open("sqlite3", filename)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec(`INSERT INTO entries (id) VALUES ('lock')`)
+	require.NoError(t, err)
+	var once sync.Once
+	release = func() { once.Do(func() { tx.Rollback() }) }
+	t.Cleanup(release)
+	return release
+}
+
+func TestSQLiteStore_Busy(t *testing.T) {
+	tests := []struct {
+		Name        string
+		BusyTimeout time.Duration
+		// Release is when the lock is released, it is held until the end of the test if zero.
+		Release time.Duration
+		// Timeout is the timeout of the context.
+		Timeout time.Duration
+		Want    func(t *testing.T, err error)
+	}{
+		{
+			Name:        "waits for lock",
+			BusyTimeout: 5 * time.Second,
+			Release:     200 * time.Millisecond,
+			Timeout:     5 * time.Second,
+			Want: func(t *testing.T, err error) {
+				assert.NoError(t, err, "should save the entry once the lock is released")
+			},
+		},
+		{
+			Name:        "busy timeout",
+			BusyTimeout: 300 * time.Millisecond,
+			Timeout:     5 * time.Second,
+			Want: func(t *testing.T, err error) {
+				require.Error(t, err, "shouldn't save to locked database")
+				assert.Contains(t, err.Error(), "locked", "should fail because the database is locked")
+			},
+		},
+		{
+			Name:        "deadline",
+			BusyTimeout: 5 * time.Second,
+			Timeout:     100 * time.Millisecond,
+			Want: func(t *testing.T, err error) {
+				assert.True(t, errors.Is(err, context.DeadlineExceeded), "should fail once the deadline passes, got %v", err)
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			filename := tempDatabase(t)
+			s := openTestSQLiteStore(t, filename, store.SQLiteOptions{BusyTimeout: tt.BusyTimeout})
+			release := lockDatabase(t, filename)
+			if tt.Release > 0 {
+				time.AfterFunc(tt.Release, release)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.Timeout)
+			defer cancel()
+			start := time.Now()
+			err := s.Save(ctx, &models.Entry{ID: "abc", Status: models.StatusScheduled, ScheduledFor: time.Now()})
+			tt.Want(t, err)
+			assert.Less(t, int64(time.Since(start)), int64(time.Second), "shouldn't wait longer than necessary")
+		})
+	}
+}
+
+// stressEnv names the database hammered by the child processes of the stress test, the worker is named by
+// stressWorkerEnv.
+const (
+	stressEnv       = "MAILBACK_STRESS_DATABASE"
+	stressWorkerEnv = "MAILBACK_STRESS_WORKER"
+)
+
+// TestSQLiteStore_Stress hammers single database from several processes, each running several workers. The
+// workers claim and deliver the due entries while scheduling new ones, every entry must be claimed exactly once.
+func TestSQLiteStore_Stress(t *testing.T) {
+	if filename := os.Getenv(stressEnv); filename != "" {
+		// child process
+		s, err := store.NewSQLiteStore(filename, store.SQLiteOptions{})
+		require.NoError(t, err)
+		defer s.Close()
+		ids, err := hammer(s, os.Getenv(stressWorkerEnv))
+		require.NoError(t, err)
+		for _, id := range ids {
+			fmt.Println("claimed", id)
+		}
+		return
+	}
+	if testing.Short() {
+		t.Skip("skipping stress test in short mode")
+	}
+
+	const (
+		processes = 3
+		workers   = 3
+		due       = 300
+	)
+	filename := tempDatabase(t)
+	s := openTestSQLiteStore(t, filename, store.SQLiteOptions{})
+	entries := make([]*models.Entry, due)
+	for i := range entries {
+		entries[i] = &models.Entry{
+			ID:           fmt.Sprintf("due-%d", i),
+			Status:       models.StatusScheduled,
+			ScheduledFor: time.Now().Add(-time.Duration(i) * time.Second),
+		}
+	}
+	require.NoError(t, s.Save(context.Background(), entries...))
+
+	var (
+		mu      sync.Mutex
+		claimed = map[string]int{}
+		wg      sync.WaitGroup
+	)
+	record := func(ids []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, id := range ids {
+			claimed[id]++
+		}
+	}
+	for i := 0; i < processes; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSQLiteStore_Stress$")
+		cmd.Env = append(os.Environ(), stressEnv+"="+filename, fmt.Sprintf("%s=process-%d", stressWorkerEnv, i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := cmd.Output()
+			assert.NoError(t, err, "child process shouldn't fail: %s", out)
+			var ids []string
+			for _, line := range strings.Split(string(out), "\n") {
+				if strings.HasPrefix(line, "claimed ") {
+					ids = append(ids, strings.TrimPrefix(line, "claimed "))
+				}
+			}
+			record(ids)
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		worker := fmt.Sprintf("goroutine-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids, err := hammer(s, worker)
+			assert.NoError(t, err, "worker shouldn't fail")
+			record(ids)
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, claimed, due, "should claim all the due entries")
+	for id, n := range claimed {
+		assert.Equal(t, 1, n, "should claim entry %s exactly once", id)
+	}
+	pending, err := s.PendingEntries(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, pending, "should deliver all the due entries")
+}
+
+// hammer claims and delivers the due entries until there are none left, scheduling new entry for the future
+// and listing the upcoming entries in between. The IDs of the claimed entries are returned.
+func hammer(s store.Store, worker string) ([]string, error) {
+	ctx := context.Background()
+	var ids []string
+	for i := 0; ; i++ {
+		future := &models.Entry{
+			ID:           fmt.Sprintf("%s-%d", worker, i),
+			Status:       models.StatusScheduled,
+			ScheduledFor: time.Now().Add(time.Hour),
+		}
+		if err := s.Save(ctx, future); err != nil {
+			return ids, fmt.Errorf("save: %w", err)
+		}
+		if _, err := s.UpcomingEntries(ctx, time.Now(), 10); err != nil {
+			return ids, fmt.Errorf("upcoming entries: %w", err)
+		}
+		entries, err := s.Claim(ctx, worker, time.Now().Add(time.Minute), 5)
+		if err != nil {
+			return ids, fmt.Errorf("claim: %w", err)
+		}
+		if len(entries) == 0 {
+			return ids, nil
+		}
+		for i := range entries {
+			e := &entries[i]
+			ids = append(ids, e.ID)
+			e.Status = models.StatusSending
+			if err := s.Transition(ctx, e, models.StatusClaimed); err != nil {
+				return ids, fmt.Errorf("transition %s: %w", e.ID, err)
+			}
+			attempt := &models.DeliveryAttempt{EntryID: e.ID, Outcome: models.OutcomeDelivered}
+			if err := s.SaveAttempts(ctx, attempt); err != nil {
+				return ids, fmt.Errorf("save attempts %s: %w", e.ID, err)
+			}
+			if err := s.Delete(ctx, e); err != nil {
+				return ids, fmt.Errorf("delete %s: %w", e.ID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Package store persists the entries, their attachments and delivery attempts. SQLite is used for single host
+// deployments, PostgreSQL when the receiver, sender and server processes run separately. The memory store
+// serves tests and ephemeral deployments.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/matoous/mailback/internal/cfg"
+	"github.com/matoous/mailback/internal/models"
+)
+
+var ErrNotFound = errors.New("record not found")
+
+// ErrConflict is returned when the entry isn't in the state it is expected to be in, such as when it was
+// claimed by someone else.
+var ErrConflict = errors.New("entry state conflict")
+
+// Store is the storage implemented by all the backends and used by the receiver, the sender and the server.
+// The operations are bound to the context, they fail with the error of the context once it is done, so that
+// slow or locked database doesn't block the callers indefinitely.
+type Store interface {
+	Migrate(ctx context.Context) error
+	MigrateTo(ctx context.Context, version int) error
+	SchemaVersion(ctx context.Context) (int, error)
+	Migrations(ctx context.Context) ([]MigrationState, error)
+	Close() error
+	Save(ctx context.Context, entries ...*models.Entry) error
+	Update(ctx context.Context, e *models.Entry) error
+	Transition(ctx context.Context, e *models.Entry, from string) error
+	Delete(ctx context.Context, e *models.Entry) error
+	Entry(ctx context.Context, id string) (*models.Entry, error)
+	PendingEntries(ctx context.Context) ([]models.Entry, error)
+	Claim(ctx context.Context, worker string, until time.Time, n int) ([]models.Entry, error)
+	UpcomingEntries(ctx context.Context, until time.Time, n int) ([]models.Entry, error)
+	ExpiredEntries(ctx context.Context, at time.Time) ([]models.Entry, error)
+	DeadEntries(ctx context.Context) ([]models.Entry, error)
+	Requeue(ctx context.Context, id string, at time.Time) error
+	SaveAttempts(ctx context.Context, attempts ...*models.DeliveryAttempt) error
+	Attempts(ctx context.Context, entryID string) ([]models.DeliveryAttempt, error)
+}
+
+// Open opens the store selected by the storage configuration.
+func Open(config *cfg.StorageConfig) (Store, error) {
+	switch config.Driver {
+	case cfg.DriverSQLite:
+		return NewSQLiteStore(config.Database, SQLiteOptions{
+			BusyTimeout:  config.BusyTimeout,
+			MaxOpenConns: config.MaxOpenConns,
+		})
+	case cfg.DriverPostgres:
+		return NewPostgresStore(config.Database)
+	case cfg.DriverMemory:
+		if config.Database == "" {
+			return NewMemoryStore(), nil
+		}
+		return LoadMemoryStore(config.Database, config.SnapshotInterval)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", config.Driver)
+	}
+}
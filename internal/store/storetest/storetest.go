@@ -0,0 +1,342 @@
+// Package storetest provides conformance tests that every store backend must pass.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matoous/mailback/internal/models"
+	"github.com/matoous/mailback/internal/store"
+)
+
+// Run runs the conformance tests shared by all the store backends. newStore must return new empty store with
+// migrated schema, it is called for each of the tests.
+func Run(t *testing.T, newStore func(t *testing.T) store.Store) {
+	tests := []struct {
+		Name string
+		Test func(t *testing.T, s store.Store)
+	}{
+		{Name: "Entry", Test: testEntry},
+		{Name: "UpcomingEntries", Test: testUpcomingEntries},
+		{Name: "TimeZones", Test: testTimeZones},
+		{Name: "DeadEntries", Test: testDeadEntries},
+		{Name: "Attempts", Test: testAttempts},
+		{Name: "Transition", Test: testTransition},
+		{Name: "Claim", Test: testClaim},
+		{Name: "ConcurrentClaim", Test: testConcurrentClaim},
+		{Name: "Canceled", Test: testCanceled},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			tt.Test(t, newStore(t))
+		})
+	}
+}
+
+func testEntry(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	scheduledFor := time.Now().Add(time.Hour)
+	e := &models.Entry{
+		ID:           "abc",
+		Mail:         "joe@example.com",
+		Title:        "Plants",
+		Data:         "Water the plants.",
+		Status:       models.StatusScheduled,
+		ScheduledFor: scheduledFor,
+		Attachments:  []models.Attachment{{ID: "att", EntryID: "abc", Filename: "plants.jpg", Size: 42}},
+	}
+	require.NoError(t, s.Save(ctx, e))
+
+	got, err := s.Entry(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, "Water the plants.", got.Data, "should load the entry")
+	assert.WithinDuration(t, scheduledFor, got.ScheduledFor, time.Millisecond, "should keep the scheduled time")
+	require.Len(t, got.Attachments, 1, "should load the attachments")
+	assert.Equal(t, "plants.jpg", got.Attachments[0].Filename, "should load the attachments")
+
+	got.Title = "Flowers"
+	require.NoError(t, s.Update(ctx, got))
+	got, err = s.Entry(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, "Flowers", got.Title, "should update the entry")
+
+	require.NoError(t, s.Delete(ctx, got))
+	_, err = s.Entry(ctx, "abc")
+	assert.Equal(t, store.ErrNotFound, err, "should delete the entry")
+	assert.Equal(t, store.ErrNotFound, s.Delete(ctx, got), "shouldn't delete missing entry")
+}
+
+func testUpcomingEntries(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, s.Save(ctx,
+		&models.Entry{ID: "soon", Status: models.StatusScheduled, ScheduledFor: now.Add(time.Minute)},
+		&models.Entry{ID: "now", Status: models.StatusScheduled, ScheduledFor: now},
+		&models.Entry{ID: "later", Status: models.StatusScheduled, ScheduledFor: now.Add(2 * time.Hour)},
+		&models.Entry{ID: "claimed", Status: models.StatusClaimed, ScheduledFor: now},
+	))
+
+	upcoming, err := s.UpcomingEntries(ctx, now.Add(time.Hour), 10)
+	require.NoError(t, err)
+	require.Len(t, upcoming, 2, "should list only scheduled entries due before the time")
+	assert.Equal(t, "now", upcoming[0].ID, "should order the entries")
+	assert.Equal(t, "soon", upcoming[1].ID, "should order the entries")
+
+	upcoming, err = s.UpcomingEntries(ctx, now.Add(time.Hour), 1)
+	require.NoError(t, err)
+	assert.Len(t, upcoming, 1, "should list at most n entries")
+}
+
+func testTimeZones(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	now := time.Now()
+	east := time.FixedZone("UTC+10", 10*60*60)
+	west := time.FixedZone("UTC-10", -10*60*60)
+	require.NoError(t, s.Save(ctx,
+		&models.Entry{ID: "due", Status: models.StatusScheduled, ScheduledFor: now.Add(-time.Minute).In(east)},
+		&models.Entry{ID: "later", Status: models.StatusScheduled, ScheduledFor: now.Add(time.Minute).In(west)},
+	))
+
+	pending, err := s.PendingEntries(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 1, "should compare the times regardless of their time zones")
+	assert.Equal(t, "due", pending[0].ID, "should deliver the entry that is due")
+
+	upcoming, err := s.UpcomingEntries(ctx, now.In(west), 10)
+	require.NoError(t, err)
+	require.Len(t, upcoming, 1, "should compare the times regardless of their time zones")
+	assert.Equal(t, "due", upcoming[0].ID, "should list the entry that is due")
+
+	e, err := s.Entry(ctx, "later")
+	require.NoError(t, err)
+	assert.True(t, now.Add(time.Minute).Equal(e.ScheduledFor), "should keep the scheduled time")
+}
+
+func testDeadEntries(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	past := time.Now().Add(-time.Hour)
+	lease := past.Add(10 * time.Minute)
+	require.NoError(t, s.Save(ctx,
+		&models.Entry{ID: "scheduled", Status: models.StatusScheduled, ScheduledFor: past},
+		&models.Entry{
+			ID:                "dead",
+			Status:            models.StatusDead,
+			ScheduledFor:      past,
+			Fails:             30,
+			LastError:         "451 Try again later",
+			OutboundMessageID: "<dead@mailback.io>",
+			ClaimedBy:         "worker-1",
+			LeaseUntil:        &lease,
+		},
+		&models.Entry{ID: "failed", Status: models.StatusFailed, ScheduledFor: past.Add(time.Minute), Fails: 1},
+	))
+
+	dead, err := s.DeadEntries(ctx)
+	require.NoError(t, err)
+	require.Len(t, dead, 2, "should list only the dead entries")
+	assert.Equal(t, "dead", dead[0].ID, "should order the entries")
+	assert.Equal(t, "451 Try again later", dead[0].LastError, "should keep the last error")
+
+	pending, err := s.PendingEntries(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 1, "shouldn't deliver dead entries")
+
+	at := time.Now().Add(-time.Second)
+	require.NoError(t, s.Requeue(ctx, "dead", at), "should requeue the entry")
+	assert.Equal(t, store.ErrNotFound, s.Requeue(ctx, "dead", at), "shouldn't requeue scheduled entry")
+	assert.Equal(t, store.ErrNotFound, s.Requeue(ctx, "missing", at), "shouldn't requeue missing entry")
+
+	e, err := s.Entry(ctx, "dead")
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusScheduled, e.Status, "should schedule the entry")
+	assert.Zero(t, e.Fails, "should reset the failures")
+	assert.Nil(t, e.FailingSince, "should reset the failures")
+	assert.Empty(t, e.LastError, "should clear the last error")
+	assert.Empty(t, e.OutboundMessageID, "should deliver new message")
+	assert.Empty(t, e.ClaimedBy, "should release the claim")
+	assert.Nil(t, e.LeaseUntil, "should release the claim")
+	pending, err = s.PendingEntries(ctx)
+	require.NoError(t, err)
+	assert.Len(t, pending, 2, "should deliver the requeued entry")
+}
+
+func testAttempts(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	e := &models.Entry{ID: "abc", Status: models.StatusScheduled, ScheduledFor: time.Now()}
+	require.NoError(t, s.Save(ctx, e))
+	now := time.Now()
+	require.NoError(t, s.SaveAttempts(ctx,
+		&models.DeliveryAttempt{
+			EntryID:   "abc",
+			CreatedAt: now,
+			Host:      "mx1.example.com",
+			Outcome:   models.OutcomeDeferred,
+			Error:     "connection refused",
+		},
+		&models.DeliveryAttempt{
+			EntryID:   "abc",
+			CreatedAt: now.Add(time.Second),
+			Host:      "mx2.example.com",
+			TLS:       true,
+			Duration:  time.Second,
+			Outcome:   models.OutcomeDelivered,
+		},
+	))
+
+	attempts, err := s.Attempts(ctx, "abc")
+	require.NoError(t, err)
+	require.Len(t, attempts, 2, "should return the attempts")
+	assert.Equal(t, "mx1.example.com", attempts[0].Host, "should order the attempts")
+	assert.Equal(t, "connection refused", attempts[0].Error, "should keep the error")
+	assert.True(t, attempts[1].TLS, "should keep whether TLS was used")
+	assert.Equal(t, time.Second, attempts[1].Duration, "should keep the duration")
+	assert.Equal(t, models.OutcomeDelivered, attempts[1].Outcome, "should keep the outcome")
+
+	require.NoError(t, s.Delete(ctx, e))
+	attempts, err = s.Attempts(ctx, "abc")
+	require.NoError(t, err)
+	assert.Empty(t, attempts, "should delete the attempts with the entry")
+}
+
+func testTransition(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, s.Save(ctx,
+		&models.Entry{ID: "abc", Status: models.StatusScheduled, ScheduledFor: past},
+		&models.Entry{ID: "sent", Status: models.StatusSent, ScheduledFor: past},
+	))
+
+	e, err := s.Entry(ctx, "abc")
+	require.NoError(t, err)
+	e.Status = models.StatusClaimed
+	e.OutboundMessageID = "<1.abc@example.com>"
+	require.NoError(t, s.Transition(ctx, e, models.StatusScheduled), "should claim the entry")
+	assert.Equal(t, store.ErrConflict, s.Transition(ctx, e, models.StatusScheduled), "shouldn't claim the entry twice")
+	missing := &models.Entry{ID: "missing", Status: models.StatusClaimed}
+	assert.Equal(t, store.ErrConflict, s.Transition(ctx, missing, models.StatusScheduled), "shouldn't create missing entry")
+
+	e, err = s.Entry(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusClaimed, e.Status, "should save the status")
+	assert.Equal(t, "<1.abc@example.com>", e.OutboundMessageID, "should save the entry")
+
+	pending, err := s.PendingEntries(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pending, "shouldn't deliver the claimed entry again")
+	expired, err := s.ExpiredEntries(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Len(t, expired, 2, "should list the entries in intermediate states without lease")
+}
+
+func testClaim(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, s.Save(ctx,
+		&models.Entry{ID: "first", Status: models.StatusScheduled, ScheduledFor: now.Add(-3 * time.Minute)},
+		&models.Entry{ID: "second", Status: models.StatusScheduled, ScheduledFor: now.Add(-2 * time.Minute)},
+		&models.Entry{ID: "third", Status: models.StatusScheduled, ScheduledFor: now.Add(-time.Minute)},
+		&models.Entry{ID: "future", Status: models.StatusScheduled, ScheduledFor: now.Add(time.Hour)},
+		&models.Entry{ID: "dead", Status: models.StatusDead, ScheduledFor: now.Add(-time.Hour)},
+	))
+
+	lease := now.Add(time.Minute)
+	claimed, err := s.Claim(ctx, "a", lease, 2)
+	require.NoError(t, err)
+	require.Len(t, claimed, 2, "should claim at most n entries")
+	assert.Equal(t, "first", claimed[0].ID, "should claim the oldest entries first")
+	assert.Equal(t, models.StatusClaimed, claimed[0].Status, "should claim the entries")
+	assert.Equal(t, "a", claimed[0].ClaimedBy, "should claim the entries for the worker")
+	require.NotNil(t, claimed[0].LeaseUntil, "should set the lease")
+
+	claimed, err = s.Claim(ctx, "b", lease, 2)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1, "shouldn't claim the entries twice")
+	assert.Equal(t, "third", claimed[0].ID, "should claim the remaining due entry")
+
+	claimed, err = s.Claim(ctx, "b", lease, 2)
+	require.NoError(t, err)
+	assert.Empty(t, claimed, "shouldn't claim anything")
+
+	expired, err := s.ExpiredEntries(ctx, now)
+	require.NoError(t, err)
+	assert.Empty(t, expired, "shouldn't recover entries with valid lease")
+	expired, err = s.ExpiredEntries(ctx, lease.Add(time.Second))
+	require.NoError(t, err)
+	assert.Len(t, expired, 3, "should recover entries with expired lease")
+
+	first, err := s.Entry(ctx, "first")
+	require.NoError(t, err)
+	first.ClaimedBy = "b"
+	first.Status = models.StatusSending
+	assert.Equal(t, store.ErrConflict, s.Transition(ctx, first, models.StatusClaimed), "shouldn't move entry claimed by someone else")
+}
+
+func testConcurrentClaim(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	entries := make([]*models.Entry, 50)
+	for i := range entries {
+		entries[i] = &models.Entry{
+			ID:           fmt.Sprintf("e%d", i),
+			Status:       models.StatusScheduled,
+			ScheduledFor: time.Now().Add(-time.Minute),
+		}
+	}
+	require.NoError(t, s.Save(ctx, entries...))
+
+	var (
+		mu      sync.Mutex
+		claimed = map[string]int{}
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 5; i++ {
+		worker := fmt.Sprintf("w%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				batch, err := s.Claim(ctx, worker, time.Now().Add(time.Minute), 3)
+				if !assert.NoError(t, err, "shouldn't fail to claim") || len(batch) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, e := range batch {
+					claimed[e.ID]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, claimed, len(entries), "should claim all the entries")
+	for id, n := range claimed {
+		assert.Equal(t, 1, n, "should claim entry %s exactly once", id)
+	}
+}
+
+func testCanceled(t *testing.T, s store.Store) {
+	require.NoError(t, s.Save(context.Background(), &models.Entry{ID: "abc", Status: models.StatusScheduled, ScheduledFor: time.Now()}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.Save(ctx, &models.Entry{ID: "def", Status: models.StatusScheduled, ScheduledFor: time.Now()})
+	assert.True(t, errors.Is(err, context.Canceled), "should fail with canceled context, got %v", err)
+	_, err = s.Entry(ctx, "abc")
+	assert.True(t, errors.Is(err, context.Canceled), "should fail with canceled context, got %v", err)
+	_, err = s.Claim(ctx, "a", time.Now().Add(time.Minute), 10)
+	assert.True(t, errors.Is(err, context.Canceled), "should fail with canceled context, got %v", err)
+
+	_, err = s.Entry(context.Background(), "def")
+	assert.Equal(t, store.ErrNotFound, err, "shouldn't save the entry with canceled context")
+	claimed, err := s.Claim(context.Background(), "a", time.Now().Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Len(t, claimed, 1, "shouldn't claim the entry with canceled context")
+}
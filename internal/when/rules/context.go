@@ -21,8 +21,6 @@ type Context struct {
 }
 
 func (c *Context) Time(t time.Time) (time.Time, error) {
-	t = time.Now()
-
 	if t.IsZero() {
 		t = time.Now()
 	}